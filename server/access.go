@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// serverFileSettings returns the file settings of the Mattermost server.
+func (p *Plugin) serverFileSettings() model.FileSettings {
+	if config := p.API.GetConfig(); config != nil {
+		return config.FileSettings
+	}
+	return model.FileSettings{}
+}
+
+// pluginURL returns the absolute URL of a plugin route, for URLs the server calls
+// back such as interactive message buttons. Without a configured site URL it falls
+// back to the path relative to the server.
+func (p *Plugin) pluginURL(route string) string {
+	path := fmt.Sprintf("/plugins/%s%s", pluginID, route)
+	if config := p.API.GetConfig(); config != nil && config.ServiceSettings.SiteURL != nil && *config.ServiceSettings.SiteURL != "" {
+		return strings.TrimSuffix(*config.ServiceSettings.SiteURL, "/") + path
+	}
+	return path
+}
+
+// maxFileSize returns the upload size limit in bytes for a media type: the plugin
+// setting, capped by the server's maximum file size.
+func (p *Plugin) maxFileSize(t *mediaType) int64 {
+	limit := t.maxFileSizeBytes()
+	if settings := p.serverFileSettings(); settings.MaxFileSize != nil && *settings.MaxFileSize > 0 && *settings.MaxFileSize < limit {
+		limit = *settings.MaxFileSize
+	}
+	return limit
+}
+
+// checkUploadAccess checks that the user may post clips in the channel: file
+// attachments must be enabled on the server, the channel must not be archived, and
+// the user needs both the create_post and upload_file permissions, so that channel
+// moderation disabling file uploads applies to clips too.
+func (p *Plugin) checkUploadAccess(userID, channelID string) *clipError {
+	if clipErr := p.checkFileAttachments(); clipErr != nil {
+		return clipErr
+	}
+
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return &clipError{Status: http.StatusForbidden, Message: "No permission to post in this channel"}
+		}
+		p.API.LogError("Failed to get channel", "channel_id", channelID, "error", appErr.Error())
+		return &clipError{Status: http.StatusInternalServerError, Message: "Failed to get channel"}
+	}
+	if channel.DeleteAt != 0 {
+		return &clipError{Status: http.StatusForbidden, Message: "This channel is archived"}
+	}
+
+	if !p.API.HasPermissionToChannel(userID, channelID, model.PermissionCreatePost) {
+		return &clipError{Status: http.StatusForbidden, Message: "No permission to post in this channel"}
+	}
+	if !p.API.HasPermissionToChannel(userID, channelID, model.PermissionUploadFile) {
+		return &clipError{Status: http.StatusForbidden, Message: "File uploads are not allowed in this channel"}
+	}
+	return nil
+}
+
+// checkFileAttachments checks that file attachments are enabled on the server.
+func (p *Plugin) checkFileAttachments() *clipError {
+	if settings := p.serverFileSettings(); settings.EnableFileAttachments != nil && !*settings.EnableFileAttachments {
+		return &clipError{Status: http.StatusForbidden, Message: "File attachments are disabled on this server"}
+	}
+	return nil
+}
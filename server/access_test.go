@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckUploadAccess(t *testing.T) {
+	tests := []struct {
+		name                string
+		attachmentsDisabled bool
+		channel             *model.Channel
+		channelErr          *model.AppError
+		canPost             bool
+		canUpload           bool
+		expectedStatus      int
+		expectedMessage     string
+	}{
+		{"allowed", false, &model.Channel{Id: "channel123"}, nil, true, true, 0, ""},
+		{"attachments disabled", true, &model.Channel{Id: "channel123"}, nil, true, true, http.StatusForbidden, "File attachments are disabled on this server"},
+		{"channel not found", false, nil, model.NewAppError("GetChannel", "not_found", nil, "", http.StatusNotFound), true, true, http.StatusForbidden, "No permission to post in this channel"},
+		{"channel error", false, nil, model.NewAppError("GetChannel", "error", nil, "", http.StatusInternalServerError), true, true, http.StatusInternalServerError, "Failed to get channel"},
+		{"archived channel", false, &model.Channel{Id: "channel123", DeleteAt: 1}, nil, true, true, http.StatusForbidden, "This channel is archived"},
+		{"no create_post", false, &model.Channel{Id: "channel123"}, nil, false, true, http.StatusForbidden, "No permission to post in this channel"},
+		{"no upload_file", false, &model.Channel{Id: "channel123"}, nil, true, false, http.StatusForbidden, "File uploads are not allowed in this channel"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{}
+			plugin.SetAPI(api)
+
+			config := &model.Config{}
+			config.SetDefaults()
+			*config.FileSettings.EnableFileAttachments = !tt.attachmentsDisabled
+			api.On("GetConfig").Return(config)
+			api.On("GetChannel", "channel123").Return(tt.channel, tt.channelErr).Maybe()
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(tt.canPost).Maybe()
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionUploadFile).Return(tt.canUpload).Maybe()
+			api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+			clipErr := plugin.checkUploadAccess("user123", "channel123")
+			if tt.expectedStatus == 0 {
+				assert.Nil(t, clipErr)
+				return
+			}
+			require.NotNil(t, clipErr)
+			assert.Equal(t, tt.expectedStatus, clipErr.Status)
+			assert.Equal(t, tt.expectedMessage, clipErr.Message)
+		})
+	}
+}
+
+func TestMaxFileSize_ServerLimit(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(&configuration{MaxAudioFileSize: 50, MaxVideoFileSize: 100})
+
+	config := &model.Config{}
+	config.SetDefaults()
+	*config.FileSettings.MaxFileSize = 20 * 1024 * 1024
+	api.On("GetConfig").Return(config)
+
+	mediaTypes := plugin.getConfiguration().mediaTypes()
+	assert.Equal(t, int64(20*1024*1024), plugin.maxFileSize(mediaTypes.get("audio")))
+	assert.Equal(t, int64(20*1024*1024), plugin.maxFileSize(mediaTypes.get("video")))
+
+	*config.FileSettings.MaxFileSize = 200 * 1024 * 1024
+	assert.Equal(t, int64(50*1024*1024), plugin.maxFileSize(mediaTypes.get("audio")))
+	assert.Equal(t, int64(100*1024*1024), plugin.maxFileSize(mediaTypes.get("video")))
+}
+
+func TestHandleUpload_ArchivedChannel(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockKVStore(api)
+
+	config := &model.Config{}
+	config.SetDefaults()
+	api.On("GetConfig").Return(config)
+	api.On("GetChannel", "channel123").Return(&model.Channel{Id: "channel123", DeleteAt: 1}, nil)
+
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM())
+	addSession(t, plugin, req, "channel123", "audio")
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "This channel is archived")
+	api.AssertNotCalled(t, "UploadFile", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestHandleConfig_Availability(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	config := &model.Config{}
+	config.SetDefaults()
+	api.On("GetConfig").Return(config)
+	api.On("GetChannel", "channel123").Return(&model.Channel{Id: "channel123"}, nil)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionUploadFile).Return(false)
+
+	getConfig := func(path string) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Mattermost-User-Id", "user123")
+		w := httptest.NewRecorder()
+		plugin.handleConfig(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := getConfig("/api/v1/config")
+	assert.Equal(t, true, response["recording_available"])
+
+	response = getConfig("/api/v1/config?channel_id=channel123")
+	assert.Equal(t, false, response["recording_available"])
+	assert.Equal(t, "File uploads are not allowed in this channel", response["unavailable_reason"])
+
+	*config.FileSettings.EnableFileAttachments = false
+	response = getConfig("/api/v1/config")
+	assert.Equal(t, false, response["recording_available"])
+	assert.Equal(t, "File attachments are disabled on this server", response["unavailable_reason"])
+}
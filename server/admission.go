@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// admissionWait is how long an upload waits for capacity before it is rejected.
+const admissionWait = 10 * time.Second
+
+// admissionRetryAfter is the Retry-After hint sent with rejected uploads.
+const admissionRetryAfter = 30 * time.Second
+
+var (
+	// errUploadBudgetExhausted is returned when the server-wide budget stays exhausted
+	// for longer than admissionWait.
+	errUploadBudgetExhausted = errors.New("upload capacity exhausted")
+
+	// errUserUploadLimit is returned when a user already has the maximum number of
+	// uploads in flight.
+	errUserUploadLimit = errors.New("too many concurrent uploads")
+)
+
+// admissionLimits is the budget enforced by the admission controller. Zero values
+// disable the corresponding limit.
+type admissionLimits struct {
+	MaxConcurrent int
+	MaxBytes      int64
+	MaxPerUser    int
+}
+
+// admissionStats is a snapshot of the admission controller counters.
+type admissionStats struct {
+	InFlight      int    `json:"in_flight"`
+	InFlightBytes int64  `json:"in_flight_bytes"`
+	QueueDepth    int    `json:"queue_depth"`
+	Admitted      uint64 `json:"admitted_total"`
+	RejectedTotal uint64 `json:"rejected_total"`
+	RejectedUser  uint64 `json:"rejected_user_total"`
+}
+
+// admissionController caps the number of uploads and the bytes they may hold in
+// memory at once across the plugin process. The zero value is ready to use.
+type admissionController struct {
+	mu      sync.Mutex
+	changed chan struct{}
+	perUser map[string]int
+	stats   admissionStats
+}
+
+// acquire reserves capacity for an upload of size bytes, waiting until ctx is done
+// if the global budget is exhausted. The returned release func must be called once
+// the upload no longer holds memory.
+func (a *admissionController) acquire(ctx context.Context, userID string, size int64, limits admissionLimits) (func(), error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.perUser == nil {
+		a.perUser = make(map[string]int)
+	}
+
+	if limits.MaxPerUser > 0 && a.perUser[userID] >= limits.MaxPerUser {
+		a.stats.RejectedUser++
+		return nil, errUserUploadLimit
+	}
+
+	for !a.fits(size, limits) {
+		if a.changed == nil {
+			a.changed = make(chan struct{})
+		}
+		changed := a.changed
+
+		a.stats.QueueDepth++
+		a.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		a.mu.Lock()
+		a.stats.QueueDepth--
+
+		if ctx.Err() != nil && !a.fits(size, limits) {
+			a.stats.RejectedTotal++
+			return nil, errUploadBudgetExhausted
+		}
+	}
+
+	a.stats.InFlight++
+	a.stats.InFlightBytes += size
+	a.stats.Admitted++
+	a.perUser[userID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.release(userID, size)
+		})
+	}, nil
+}
+
+// fits reports whether an upload of size bytes can start now. An upload larger than
+// the whole byte budget is let through only when nothing else is in flight, so that
+// it cannot starve forever.
+func (a *admissionController) fits(size int64, limits admissionLimits) bool {
+	if limits.MaxConcurrent > 0 && a.stats.InFlight >= limits.MaxConcurrent {
+		return false
+	}
+	if limits.MaxBytes > 0 && a.stats.InFlight > 0 && a.stats.InFlightBytes+size > limits.MaxBytes {
+		return false
+	}
+	return true
+}
+
+func (a *admissionController) release(userID string, size int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stats.InFlight--
+	a.stats.InFlightBytes -= size
+	if a.perUser[userID]--; a.perUser[userID] <= 0 {
+		delete(a.perUser, userID)
+	}
+
+	// Wake up every waiter so they can re-check the budget.
+	if a.changed != nil {
+		close(a.changed)
+		a.changed = nil
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (a *admissionController) Stats() admissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats
+}
+
+// uploadMemoryCopies is how many copies of a file an upload holds in memory while
+// it is posted. The plugin API takes files as byte slices, so the file is read
+// whole, and the RPC call to the server encodes it once more; encryption adds the
+// sealed copy.
+func uploadMemoryCopies(encrypted bool) int64 {
+	if encrypted {
+		return 3
+	}
+	return 2
+}
+
+// admitUpload reserves upload capacity for the request, writing a 429 or 503 response
+// with Retry-After when it cannot be admitted. size is the expected size of the
+// upload, of which the reservation covers every copy held in memory; when ok is
+// false the caller must stop handling the request.
+func (p *Plugin) admitUpload(w http.ResponseWriter, r *http.Request, userID string, size int64) (release func(), ok bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), admissionWait)
+	defer cancel()
+
+	config := p.getConfiguration()
+	reserve := size * uploadMemoryCopies(config.encryption != nil)
+	release, err := p.admission.acquire(ctx, userID, reserve, config.admissionLimits())
+	if err == nil {
+		return release, true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(admissionRetryAfter.Seconds())))
+	if errors.Is(err, errUserUploadLimit) {
+		http.Error(w, "Too many uploads in progress, please wait for them to finish", http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	p.API.LogWarn("Upload rejected, server upload budget exhausted", "user_id", userID, "size", size)
+	http.Error(w, "Server is busy, please try again later", http.StatusServiceUnavailable)
+	return nil, false
+}
+
+// expectedUploadSize estimates how many bytes a request will hold, using the
+// declared Content-Length when available and the size limit otherwise.
+func expectedUploadSize(r *http.Request, limit int64) int64 {
+	if r.ContentLength > 0 && r.ContentLength < limit {
+		return r.ContentLength
+	}
+	return limit
+}
+
+// writeAdmissionMetrics writes the admission counters in the Prometheus text format.
+func writeAdmissionMetrics(w http.ResponseWriter, stats admissionStats) {
+	metrics := []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"voice_clips_uploads_in_flight", "gauge", "Uploads currently being processed.", stats.InFlight},
+		{"voice_clips_upload_bytes_in_flight", "gauge", "Bytes reserved by uploads currently being processed.", stats.InFlightBytes},
+		{"voice_clips_upload_queue_depth", "gauge", "Uploads waiting for capacity.", stats.QueueDepth},
+		{"voice_clips_uploads_admitted_total", "counter", "Uploads admitted.", stats.Admitted},
+		{"voice_clips_uploads_rejected_total", "counter", "Uploads rejected because the server budget was exhausted.", stats.RejectedTotal},
+		{"voice_clips_uploads_rejected_user_total", "counter", "Uploads rejected because of the per-user concurrency limit.", stats.RejectedUser},
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
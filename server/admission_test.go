@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionController_PerUserLimit(t *testing.T) {
+	var a admissionController
+	limits := admissionLimits{MaxPerUser: 1}
+
+	release, err := a.acquire(context.Background(), "user1", 10, limits)
+	require.NoError(t, err)
+
+	_, err = a.acquire(context.Background(), "user1", 10, limits)
+	assert.ErrorIs(t, err, errUserUploadLimit)
+
+	// Other users are unaffected.
+	releaseOther, err := a.acquire(context.Background(), "user2", 10, limits)
+	require.NoError(t, err)
+	releaseOther()
+
+	release()
+	release() // releasing twice is harmless
+
+	stats := a.Stats()
+	assert.Equal(t, 0, stats.InFlight)
+	assert.Equal(t, int64(0), stats.InFlightBytes)
+	assert.Equal(t, uint64(1), stats.RejectedUser)
+}
+
+func TestAdmissionController_WaitsForCapacity(t *testing.T) {
+	var a admissionController
+	limits := admissionLimits{MaxBytes: 100}
+
+	release, err := a.acquire(context.Background(), "user1", 80, limits)
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		releaseSecond, err := a.acquire(context.Background(), "user2", 50, limits)
+		if err == nil {
+			releaseSecond()
+		}
+		done <- err
+	}()
+
+	assert.Eventually(t, func() bool { return a.Stats().QueueDepth == 1 }, time.Second, time.Millisecond)
+	release()
+	assert.NoError(t, <-done)
+}
+
+func TestAdmissionController_RejectsWhenExhausted(t *testing.T) {
+	var a admissionController
+	limits := admissionLimits{MaxConcurrent: 1}
+
+	release, err := a.acquire(context.Background(), "user1", 10, limits)
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = a.acquire(ctx, "user2", 10, limits)
+	assert.ErrorIs(t, err, errUploadBudgetExhausted)
+	assert.Equal(t, uint64(1), a.Stats().RejectedTotal)
+}
+
+func TestAdmissionController_OversizedUploadRunsAlone(t *testing.T) {
+	var a admissionController
+
+	release, err := a.acquire(context.Background(), "user1", 1000, admissionLimits{MaxBytes: 100})
+	require.NoError(t, err)
+	release()
+}
+
+func TestHandleUpload_PerUserLimit(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	plugin.setConfiguration(&configuration{MaxConcurrentUploadsPerUser: 1})
+
+	release, err := plugin.admission.acquire(context.Background(), "user123", 10, plugin.getConfiguration().admissionLimits())
+	require.NoError(t, err)
+	defer release()
+
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123"}, "audio", testWebM())
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+}
+
+func TestHandleUpload_MemoryBudgetCountsCopies(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	plugin.setConfiguration(&configuration{MaxUploadMemory: 1})
+
+	release, err := plugin.admission.acquire(context.Background(), "user456", 1, plugin.getConfiguration().admissionLimits())
+	require.NoError(t, err)
+	defer release()
+
+	// The upload fits the budget, but the copies it holds while being posted don't.
+	data := append(testWebM(), make([]byte, 600*1024)...)
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", data)
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req.WithContext(ctx))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Equal(t, int64(1), plugin.admission.Stats().InFlightBytes)
+}
+
+func TestServeMetrics(t *testing.T) {
+	plugin := &Plugin{}
+	plugin.SetAPI(&plugintest.API{})
+
+	w := httptest.NewRecorder()
+	plugin.ServeMetrics(nil, w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Contains(t, w.Body.String(), "voice_clips_upload_queue_depth 0")
+	assert.Contains(t, w.Body.String(), "# TYPE voice_clips_uploads_rejected_total counter")
+}
+
+func TestHandleStats_RequiresSystemAdmin(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	api.On("HasPermissionTo", "user123", mock.Anything).Return(false)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil)
+	req.Header.Set("Mattermost-User-Id", "user123")
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+}
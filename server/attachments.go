@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+const (
+	attachmentValidationOff      = "off"
+	attachmentValidationValidate = "validate"
+	attachmentValidationSanitize = "sanitize"
+)
+
+// attachmentLimits are the limits for a media file attached to an ordinary post:
+// those of the most permissive media type that allows its format.
+type attachmentLimits struct {
+	MaxFileSize int64
+	MaxDuration int
+	IsVideo     bool
+}
+
+// attachmentLimitsFor returns the limits for files with the extension, or nil when
+// no media type allows it.
+func (p *Plugin) attachmentLimitsFor(extension string) *attachmentLimits {
+	var limits *attachmentLimits
+	for _, t := range p.getConfiguration().mediaTypes().all() {
+		if !t.allowedExtensions()[extension] {
+			continue
+		}
+		if limits == nil {
+			limits = &attachmentLimits{}
+		}
+		if size := p.maxFileSize(t); size > limits.MaxFileSize {
+			limits.MaxFileSize = size
+		}
+		if t.MaxDuration > limits.MaxDuration {
+			limits.MaxDuration = t.MaxDuration
+		}
+		limits.IsVideo = limits.IsVideo || t.isVideo()
+	}
+	return limits
+}
+
+// FileWillBeUploaded applies the clip checks to media files uploaded through the
+// standard file API, which would otherwise bypass every plugin limit. Files in a
+// format no media type allows are left alone. With AttachmentValidation set to
+// sanitize, metadata is also stripped from files that pass.
+func (p *Plugin) FileWillBeUploaded(c *plugin.Context, info *model.FileInfo, file io.Reader, output io.Writer) (*model.FileInfo, string) {
+	mode := p.getConfiguration().attachmentValidation()
+	if mode == attachmentValidationOff {
+		return nil, ""
+	}
+
+	extension := strings.ToLower(filepath.Ext(info.Name))
+	limits := p.attachmentLimitsFor(extension)
+	if limits == nil {
+		return nil, ""
+	}
+
+	sizeError := fmt.Sprintf("File size exceeds maximum allowed (%d MB)", limits.MaxFileSize/(1024*1024))
+	if info.Size > limits.MaxFileSize {
+		return nil, sizeError
+	}
+	data, err := io.ReadAll(io.LimitReader(file, limits.MaxFileSize+1))
+	if err != nil {
+		p.API.LogError("Failed to read uploaded file", "name", info.Name, "error", err.Error())
+		return nil, "Failed to read file"
+	}
+	if int64(len(data)) > limits.MaxFileSize {
+		return nil, sizeError
+	}
+
+	if !isValidMediaFile(data, extension, limits.IsVideo) {
+		return nil, "File content does not match expected format"
+	}
+	if duration, ok := probeDuration(data, extension); ok && duration > float64(limits.MaxDuration) {
+		return nil, fmt.Sprintf("Duration exceeds maximum allowed (%d seconds)", limits.MaxDuration)
+	}
+
+	if mode != attachmentValidationSanitize {
+		return nil, ""
+	}
+	stripped, changed := stripMetadata(data, extension)
+	if !changed {
+		return nil, ""
+	}
+	if _, err := output.Write(stripped); err != nil {
+		p.API.LogError("Failed to write sanitized file", "name", info.Name, "error", err.Error())
+		return nil, "Failed to sanitize file"
+	}
+	info.Size = int64(len(stripped))
+	return info, ""
+}
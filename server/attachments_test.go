@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testWAV returns a WAV file whose data chunk header declares the duration in seconds.
+func testWAV(seconds uint32, chunks ...[]byte) []byte {
+	body := []byte("WAVEfmt \x10\x00\x00\x00")
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint32(fmtChunk[8:12], 1000) // byte rate
+	body = append(body, fmtChunk...)
+	body = append(body, bytes.Join(chunks, nil)...)
+	body = append(body, "data"...)
+	body = binary.LittleEndian.AppendUint32(body, seconds*1000)
+	body = append(body, make([]byte, 2048)...)
+	return append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+}
+
+func newAttachmentPlugin(t *testing.T, mode string) *Plugin {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	config := &model.Config{}
+	config.SetDefaults()
+	*config.FileSettings.MaxFileSize = 2 * 1024 * 1024
+	api.On("GetConfig").Return(config).Maybe()
+
+	plugin.setConfiguration(&configuration{
+		MaxDuration:          300,
+		MaxVideoDuration:     120,
+		MaxAudioFileSize:     1,
+		MaxVideoFileSize:     100,
+		AllowedAudioFormats:  "webm,wav,ogg",
+		AllowedVideoFormats:  "webm,mp4",
+		AllowedScreenFormats: "webm",
+		AttachmentValidation: mode,
+	})
+	return plugin
+}
+
+func TestFileWillBeUploaded(t *testing.T) {
+	list := []byte("LIST\x08\x00\x00\x00INFOIART")
+
+	tests := []struct {
+		name     string
+		mode     string
+		fileName string
+		size     int64
+		data     []byte
+		expected string
+	}{
+		{"off", "off", "clip.wav", 0, testWAV(3600), ""},
+		{"not media", "validate", "notes.txt", 0, []byte("hello"), ""},
+		{"format of no media type", "validate", "song.mp3", 0, []byte("not an mp3"), ""},
+		{"valid", "validate", "clip.wav", 0, testWAV(60, list), ""},
+		{"declared size over the limit", "validate", "clip.wav", 2 * 1024 * 1024, testWAV(60), "File size exceeds maximum allowed (1 MB)"},
+		{"content over the limit", "validate", "clip.webm", 0, append(testWebM(), make([]byte, 3*1024*1024)...), "File size exceeds maximum allowed (2 MB)"},
+		{"bad signature", "validate", "clip.WAV", 0, testWebM(), "File content does not match expected format"},
+		{"too long", "sanitize", "clip.wav", 0, testWAV(301), "Duration exceeds maximum allowed (300 seconds)"},
+		{"truncated ogg", "validate", "clip.ogg", 0, append([]byte("OggS"), bytes.Repeat([]byte{0xFF}, 36)...), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := newAttachmentPlugin(t, tt.mode)
+			var output bytes.Buffer
+			info, reason := plugin.FileWillBeUploaded(nil, &model.FileInfo{Name: tt.fileName, Size: tt.size}, bytes.NewReader(tt.data), &output)
+			assert.Nil(t, info)
+			assert.Equal(t, tt.expected, reason)
+			assert.Zero(t, output.Len(), "validation must not change the file")
+		})
+	}
+}
+
+func TestFileWillBeUploaded_Sanitize(t *testing.T) {
+	plugin := newAttachmentPlugin(t, "sanitize")
+	list := []byte("LIST\x08\x00\x00\x00INFOIART")
+
+	var output bytes.Buffer
+	original := testWAV(60, list)
+	info, reason := plugin.FileWillBeUploaded(nil, &model.FileInfo{Name: "clip.wav", Size: int64(len(original))}, bytes.NewReader(original), &output)
+	assert.Empty(t, reason)
+	require.NotNil(t, info)
+	assert.Equal(t, testWAV(60), output.Bytes())
+	assert.Equal(t, int64(output.Len()), info.Size)
+
+	// Files without metadata are kept as uploaded.
+	output.Reset()
+	info, reason = plugin.FileWillBeUploaded(nil, &model.FileInfo{Name: "clip.wav"}, bytes.NewReader(testWAV(60)), &output)
+	assert.Empty(t, reason)
+	assert.Nil(t, info)
+	assert.Zero(t, output.Len())
+}
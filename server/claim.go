@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const claimPath = "/api/v1/claim"
+
+// handleClaim posts a media file already uploaded through the Mattermost API as a
+// clip. Large files can then use the server's streaming upload instead of the
+// plugin's request limits; the file gets the same validation as an upload.
+func (p *Plugin) handleClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		FileID    string   `json:"file_id"`
+		ChannelID string   `json:"channel_id"`
+		Type      string   `json:"type"`
+		Duration  *int     `json:"duration"`
+		Message   string   `json:"message"`
+		RootID    string   `json:"root_id"`
+		FileIDs   []string `json:"file_ids"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFormValueSize)).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if body.FileID == "" {
+		http.Error(w, "file_id is required", http.StatusBadRequest)
+		return
+	}
+	if body.ChannelID == "" {
+		http.Error(w, "channel_id is required", http.StatusBadRequest)
+		return
+	}
+	mediaType, clipErr := p.getMediaType(body.Type)
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	config := p.getConfiguration()
+	var session *recordingSession
+	if config.RequireRecordingSession {
+		if session, clipErr = p.verifySession(r.Header.Get(sessionHeader), userID); clipErr != nil {
+			writeClipError(w, clipErr)
+			return
+		}
+	}
+
+	// The file must belong to the caller and the channel, and not be posted yet.
+	info, clipErr := p.getAttachableFile(body.FileID, userID, body.ChannelID)
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+	media := &clipMedia{Type: mediaType, Stored: info}
+	if body.Duration != nil {
+		media.Duration = strconv.Itoa(*body.Duration)
+	}
+	if session != nil {
+		if clipErr := session.checkMedia(body.ChannelID, []*clipMedia{media}); clipErr != nil {
+			writeClipError(w, clipErr)
+			return
+		}
+	}
+
+	// Reading the file for validation counts against the upload budget. Files over
+	// the size limit are rejected without reading them.
+	if maxFileSize := p.maxFileSize(mediaType); info.Size > maxFileSize {
+		http.Error(w, fmt.Sprintf("File size exceeds maximum allowed (%d MB)", maxFileSize/(1024*1024)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	release, ok := p.admitUpload(w, r, userID, info.Size)
+	if !ok {
+		return
+	}
+	defer release()
+
+	data, appErr := p.API.GetFile(info.Id)
+	if appErr != nil {
+		p.API.LogError("Failed to read claimed file", "file_id", info.Id, "error", appErr.Error())
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	header := data
+	if len(header) > sniffLen {
+		header = header[:sniffLen]
+	}
+	media.File = &spooledFile{Filename: info.Name, Header: header, Size: int64(len(data)), data: data}
+
+	posted := false
+	if session != nil {
+		// A session can be used for one post only; release it on failure so that
+		// the client can retry.
+		claimed, err := p.claimSession(session)
+		if err != nil {
+			p.API.LogError("Failed to claim recording session", "error", err.Error())
+			http.Error(w, "Failed to verify recording session", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			http.Error(w, "Recording session has already been used", http.StatusConflict)
+			return
+		}
+		defer func() {
+			if posted {
+				p.completeSession(session)
+			} else {
+				p.releaseSession(session)
+			}
+		}()
+	}
+
+	// The claimed file is the media of the post, not an extra attachment.
+	fileIDs := make([]string, 0, len(body.FileIDs))
+	for _, fileID := range body.FileIDs {
+		if fileID != info.Id {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+
+	result, clipErr := p.createClip(&clipRequest{
+		UserID:    userID,
+		ChannelID: body.ChannelID,
+		Media:     []*clipMedia{media},
+		FileIDs:   fileIDs,
+		Message:   body.Message,
+		RootID:    body.RootID,
+	})
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+	posted = true
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"post_id":  result.Post.Id,
+		"file_id":  result.FileInfo.Id,
+		"file_ids": result.FileIDs,
+		"job_ids":  result.JobIDs,
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newClaimRequest(t *testing.T, plugin *Plugin, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, claimPath, strings.NewReader(body))
+	req.Header.Set("Mattermost-User-Id", "user123")
+	addSession(t, plugin, req, "channel123", "video")
+	return req
+}
+
+func TestHandleClaim(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("GetFileInfo", "file123").Return(&model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", Name: "recording.webm", Size: 2048}, nil)
+	api.On("GetFile", "file123").Return(testWebM(), nil)
+
+	var created *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		created = args.Get(0).(*model.Post)
+	}).Return(&model.Post{Id: "post123"}, nil)
+
+	req := newClaimRequest(t, plugin, `{"file_id": "file123", "channel_id": "channel123", "type": "video", "duration": 30, "message": "Demo", "file_ids": ["file123"]}`)
+	w := httptest.NewRecorder()
+	plugin.handleClaim(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode, w.Body.String())
+
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "post123", response["post_id"])
+	assert.Equal(t, "file123", response["file_id"])
+
+	require.NotNil(t, created)
+	assert.Equal(t, "custom_video_clip", created.Type)
+	assert.Equal(t, "Demo", created.Message)
+	assert.Equal(t, model.StringArray{"file123"}, created.FileIds)
+	props := created.GetProp("video_clip").(map[string]interface{})
+	assert.Equal(t, 30, props["duration"])
+	assert.Equal(t, ".webm", props["format"])
+	api.AssertNotCalled(t, "UploadFile", mock.Anything, mock.Anything, mock.Anything)
+
+}
+
+func TestHandleClaim_Rejected(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		info            *model.FileInfo
+		data            []byte
+		expectedStatus  int
+		expectedMessage string
+	}{
+		{"missing file id", `{"channel_id": "channel123", "type": "video"}`, nil, nil, http.StatusBadRequest, "file_id is required"},
+		{"missing channel id", `{"file_id": "file123", "type": "video"}`, nil, nil, http.StatusBadRequest, "channel_id is required"},
+		{"unknown type", `{"file_id": "file123", "channel_id": "channel123", "type": "hologram"}`, nil, nil, http.StatusBadRequest, "Unknown media type"},
+		{"other user's file", `{"file_id": "file123", "channel_id": "channel123", "type": "video"}`, &model.FileInfo{Id: "file123", CreatorId: "user456", ChannelId: "channel123", Name: "clip.webm", Size: 2048}, nil, http.StatusBadRequest, "File file123 cannot be attached to this post"},
+		{"already posted", `{"file_id": "file123", "channel_id": "channel123", "type": "video"}`, &model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", PostId: "post123", Name: "clip.webm", Size: 2048}, nil, http.StatusBadRequest, "File file123 cannot be attached to this post"},
+		{"other channel", `{"file_id": "file123", "channel_id": "channel123", "type": "video"}`, &model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel456", Name: "clip.webm", Size: 2048}, nil, http.StatusBadRequest, "File file123 cannot be attached to this post"},
+		{"too large", `{"file_id": "file123", "channel_id": "channel123", "type": "video", "duration": 5}`, &model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", Name: "clip.webm", Size: 500 * 1024 * 1024}, nil, http.StatusRequestEntityTooLarge, "File size exceeds maximum allowed (100 MB)"},
+		{"too long", `{"file_id": "file123", "channel_id": "channel123", "type": "video", "duration": 600}`, &model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", Name: "clip.webm", Size: 2048}, nil, http.StatusBadRequest, "Duration exceeds maximum allowed (300 seconds)"},
+		{"bad content", `{"file_id": "file123", "channel_id": "channel123", "type": "video", "duration": 5}`, &model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", Name: "clip.mp4", Size: 2048}, testWebM(), http.StatusBadRequest, "File content does not match expected format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{}
+			plugin.SetAPI(api)
+			mockUploadAccess(api)
+			mockKVStore(api)
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true).Maybe()
+			if tt.info != nil {
+				api.On("GetFileInfo", "file123").Return(tt.info, nil)
+			}
+			if tt.data != nil {
+				api.On("GetFile", "file123").Return(tt.data, nil)
+			}
+
+			w := httptest.NewRecorder()
+			plugin.handleClaim(w, newClaimRequest(t, plugin, tt.body))
+			assert.Equal(t, tt.expectedStatus, w.Result().StatusCode)
+			assert.Contains(t, w.Body.String(), tt.expectedMessage)
+			api.AssertNotCalled(t, "CreatePost", mock.Anything)
+		})
+	}
+}
+
+func TestHandleClaim_KeepsFileOnFailure(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("GetFileInfo", "file123").Return(&model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", Name: "clip.webm", Size: 2048}, nil)
+	api.On("GetFile", "file123").Return(testWebM(), nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, model.NewAppError("CreatePost", "invalid", nil, "", http.StatusBadRequest))
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+	w := httptest.NewRecorder()
+	plugin.handleClaim(w, newClaimRequest(t, plugin, `{"file_id": "file123", "channel_id": "channel123", "type": "video", "duration": 5}`))
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	api.AssertNotCalled(t, "GetDirectChannel", mock.Anything, mock.Anything)
+	api.AssertNotCalled(t, "DeletePost", mock.Anything)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// clipError is a failure while validating or posting a clip, carrying the HTTP status
+// and the message that should be returned to the client.
+type clipError struct {
+	Status  int
+	Message string
+
+	// RetryAfter, in seconds, is sent as the Retry-After header when set.
+	RetryAfter int
+
+	// Retryable marks refusals that depend on the user rather than the media, such
+	// as quotas and media policies, so the same media may be accepted later.
+	Retryable bool
+}
+
+func (e *clipError) Error() string {
+	return e.Message
+}
+
+// permanent reports whether sending the same media again cannot succeed, as opposed
+// to server errors, rate limits and retryable refusals, which may pass on a later
+// attempt.
+func (e *clipError) permanent() bool {
+	return !e.Retryable && e.Status >= 400 && e.Status < 500 && e.Status != http.StatusTooManyRequests
+}
+
+// writeClipError writes err as a plain text HTTP error response.
+func writeClipError(w http.ResponseWriter, err *clipError) {
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(err.RetryAfter))
+	}
+	http.Error(w, err.Message, err.Status)
+}
+
+// maxClipMedia is the number of media files accepted in a single clip post.
+const maxClipMedia = 4
+
+// maxPostFiles is the Mattermost limit on files attached to a single post.
+const maxPostFiles = 10
+
+// clipMedia is one uploaded media file of a clip.
+type clipMedia struct {
+	Type     *mediaType
+	Duration string
+	File     *spooledFile
+
+	// Stored is set for a file already uploaded through the Mattermost API. It is
+	// attached to the post as is, and File only carries its name, size and header.
+	Stored *model.FileInfo
+}
+
+// clipRequest describes uploaded media files that should be posted as one clip.
+type clipRequest struct {
+	UserID    string
+	ChannelID string
+	Media     []*clipMedia
+
+	// FileIDs are files already uploaded through the Mattermost API, such as
+	// screenshots, that are attached to the post as they are.
+	FileIDs []string
+
+	// Message is the caption used as the post text instead of the default text.
+	Message string
+
+	// RootID makes the clip a reply in the thread of that post.
+	RootID string
+}
+
+// clipResult is the outcome of a successfully posted clip.
+type clipResult struct {
+	Post *model.Post
+
+	// FileInfo is the primary media file of the post.
+	FileInfo *model.FileInfo
+
+	// FileIDs lists every file attached to the post, primary media first.
+	FileIDs []string
+	JobIDs  []string
+}
+
+// createClip validates the uploaded media, stores it in Mattermost and creates the
+// clip post. It is shared by every upload path so they all enforce the same rules.
+func (p *Plugin) createClip(req *clipRequest) (*clipResult, *clipError) {
+	if len(req.Media) == 0 {
+		return nil, &clipError{Status: http.StatusBadRequest, Message: "Failed to get media file"}
+	}
+	if len(req.Media) > maxClipMedia {
+		return nil, &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Too many media files (maximum %d)", maxClipMedia)}
+	}
+	if len(req.Media)+len(req.FileIDs) > maxPostFiles {
+		return nil, &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Too many files (maximum %d)", maxPostFiles)}
+	}
+	message := strings.TrimSpace(req.Message)
+	if utf8.RuneCountInString(message) > model.PostMessageMaxRunesV2 {
+		return nil, &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Message is too long (maximum %d characters)", model.PostMessageMaxRunesV2)}
+	}
+
+	// The first file of the media type with the highest priority is the primary
+	// media that decides the post type. It goes first so that it is also the first
+	// file of the post.
+	media := make([]*clipMedia, 0, len(req.Media))
+	for _, m := range req.Media {
+		if len(media) > 0 && m.Type.Priority > media[0].Type.Priority {
+			media = append([]*clipMedia{m}, media...)
+		} else {
+			media = append(media, m)
+		}
+	}
+	primary := media[0].Type
+
+	extensions := make([]string, len(media))
+	for i, m := range media {
+		extension, clipErr := p.validateClipMedia(m)
+		if clipErr != nil {
+			return nil, clipErr
+		}
+		extensions[i] = extension
+	}
+
+	// Validate channel access
+	if clipErr := p.checkUploadAccess(req.UserID, req.ChannelID); clipErr != nil {
+		return nil, clipErr
+	}
+	types := make([]*mediaType, len(media))
+	for i, m := range media {
+		types[i] = m.Type
+	}
+	if clipErr := p.checkMediaPolicy(req.UserID, req.ChannelID, types...); clipErr != nil {
+		return nil, clipErr
+	}
+	if clipErr := p.checkGuestMedia(req.UserID, media); clipErr != nil {
+		return nil, clipErr
+	}
+
+	rootID, clipErr := p.getThreadRoot(req)
+	if clipErr != nil {
+		return nil, clipErr
+	}
+
+	attachments, clipErr := p.getAttachments(req)
+	if clipErr != nil {
+		return nil, clipErr
+	}
+
+	durations := make([]int, len(media))
+	for i, m := range media {
+		duration, clipErr := p.validateClipDuration(m)
+		if clipErr != nil {
+			return nil, clipErr
+		}
+		durations[i] = duration
+	}
+
+	if clipErr := p.scanClipMedia(req, media); clipErr != nil {
+		return nil, clipErr
+	}
+
+	// Count the clip against the rate limits of the user; the reservation is
+	// released if the clip is not posted.
+	var size int64
+	for _, m := range media {
+		size += m.File.Size
+	}
+	releaseRate, clipErr := p.reserveRate(req.UserID, size)
+	if clipErr != nil {
+		return nil, clipErr
+	}
+
+	// Count the media against the storage quotas of the user and team.
+	sizes := make(map[string]int64)
+	for _, m := range media {
+		sizes[m.Type.Name] += m.File.Size
+	}
+	releaseStorage, clipErr := p.reserveStorage(req.UserID, req.ChannelID, sizes)
+	if clipErr != nil {
+		releaseRate()
+		return nil, clipErr
+	}
+
+	// Upload files to Mattermost, removing the ones already stored if one fails.
+	// Claimed files belong to the user and are kept. With encryption on, every file
+	// is stored encrypted, so claimed files are uploaded again as an encrypted copy
+	// and the plaintext original is removed once the post exists.
+	encryption := p.getConfiguration().encryption
+	uploaded := make([]*model.FileInfo, 0, len(media))
+	discardUploaded := func() {
+		for i, info := range uploaded {
+			if info != media[i].Stored {
+				p.discardUploadedFile(info)
+			}
+		}
+	}
+	for i, m := range media {
+		if m.Stored != nil && encryption == nil {
+			uploaded = append(uploaded, m.Stored)
+			continue
+		}
+		fileInfo, clipErr := p.uploadClipMedia(req.ChannelID, m, extensions[i], encryption)
+		if clipErr != nil {
+			discardUploaded()
+			releaseRate()
+			releaseStorage()
+			return nil, clipErr
+		}
+		uploaded = append(uploaded, fileInfo)
+	}
+
+	// Every file gets an entry in the clip props; the top-level duration and
+	// format describe the primary media. The list is a []interface{}, as in posts
+	// decoded from JSON, because plugin RPC encodes posts with gob, which only
+	// knows that slice type.
+	fileIDs := make([]string, 0, len(uploaded)+len(attachments))
+	files := make([]interface{}, 0, len(uploaded)+len(attachments))
+	for i, info := range uploaded {
+		fileIDs = append(fileIDs, info.Id)
+		file := map[string]interface{}{
+			"file_id":  info.Id,
+			"type":     media[i].Type.Name,
+			"duration": durations[i],
+			"format":   extensions[i],
+			"size":     media[i].File.Size,
+		}
+		if encryption != nil {
+			file["encrypted"] = true
+		}
+		files = append(files, file)
+	}
+	for _, info := range attachments {
+		fileIDs = append(fileIDs, info.Id)
+		files = append(files, map[string]interface{}{
+			"file_id":   info.Id,
+			"type":      "file",
+			"name":      info.Name,
+			"mime_type": info.MimeType,
+		})
+	}
+
+	// Post-upload processing runs in the background; the post is marked as
+	// processing until every job has finished.
+	propsKey := primary.PropsKey
+	jobs := make([]*job, 0, len(uploaded))
+	jobIDs := make([]string, 0, len(uploaded))
+	for i, info := range uploaded {
+		j := &job{ID: model.NewId(), Type: jobTypeProbe, FileID: info.Id, PropsKey: propsKey, Format: extensions[i]}
+		jobs = append(jobs, j)
+		jobIDs = append(jobIDs, j.ID)
+	}
+
+	// Create post with the media files. A caption replaces the default text so
+	// that mentions, hashtags and search work as for any other post; otherwise the
+	// text is localized for the author so that push notifications and other clients
+	// show something useful.
+	if message == "" {
+		message = p.clipMessage(primary, p.getUserForText(req.UserID), durations[0])
+	}
+	post := &model.Post{
+		UserId:    req.UserID,
+		ChannelId: req.ChannelID,
+		Message:   message,
+		RootId:    rootID,
+		FileIds:   fileIDs,
+		Type:      primary.PostType,
+	}
+	props := map[string]interface{}{
+		"duration":   durations[0],
+		"format":     extensions[0],
+		"files":      files,
+		"processing": true,
+		"job_ids":    jobIDs,
+	}
+	if encryption != nil {
+		props["encrypted"] = true
+	}
+	post.AddProp(propsKey, props)
+
+	// The signature lets MessageWillBePosted tell clip posts created here from
+	// forged ones.
+	if err := p.signClipPost(post, propsKey); err != nil {
+		p.API.LogError("Failed to sign clip post", "error", err.Error())
+		discardUploaded()
+		releaseRate()
+		releaseStorage()
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to create post"}
+	}
+
+	// The pending post id lets the server deduplicate a retry of a create that
+	// actually succeeded but reported an error.
+	post.PendingPostId = fmt.Sprintf("%s:%d", req.UserID, model.GetMillis())
+
+	var createdPost *model.Post
+	appErr := p.withRetry("create post", func() *model.AppError {
+		var createErr *model.AppError
+		createdPost, createErr = p.API.CreatePost(post)
+		return createErr
+	})
+	if appErr != nil {
+		p.API.LogError("Failed to create post", "error", appErr.Error())
+		discardUploaded()
+		releaseRate()
+		releaseStorage()
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to create post: " + appErr.Error()}
+	}
+
+	untracked := make([]string, 0, len(uploaded))
+	for i, info := range uploaded {
+		if info != media[i].Stored {
+			untracked = append(untracked, info.Id)
+		}
+	}
+	p.untrackUploadedFiles(untracked...)
+
+	// With encryption on, the plaintext originals of claimed files must not stay in
+	// the file store. If one cannot be removed, the clip is withdrawn; deleting the
+	// post removes its encrypted copies and frees their storage.
+	for i, info := range uploaded {
+		stored := media[i].Stored
+		if stored == nil || info == stored {
+			continue
+		}
+		if err := p.deleteFile(stored); err != nil {
+			p.API.LogError("Failed to remove plaintext original of claimed file", "file_id", stored.Id, "error", err.Error())
+			if appErr := p.API.DeletePost(createdPost.Id); appErr != nil {
+				p.API.LogError("Failed to withdraw clip post", "post_id", createdPost.Id, "error", appErr.Error())
+			}
+			releaseRate()
+			return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to remove the unencrypted original file"}
+		}
+	}
+
+	for _, j := range jobs {
+		j.PostID = createdPost.Id
+		j.UserID = req.UserID
+		j.ChannelID = req.ChannelID
+	}
+	if err := p.enqueueJobs(jobs); err != nil {
+		// The clip is usable without post-processing, so don't fail the upload.
+		p.API.LogError("Failed to enqueue post-upload jobs", "post_id", createdPost.Id, "error", err.Error())
+	}
+
+	return &clipResult{Post: createdPost, FileInfo: uploaded[0], FileIDs: fileIDs, JobIDs: jobIDs}, nil
+}
+
+// validateClipMedia checks the size, format and signature of an uploaded media file
+// and returns its extension.
+func (p *Plugin) validateClipMedia(media *clipMedia) (string, *clipError) {
+	file := media.File
+	mediaType := media.Type
+
+	// Validate file size using the media type and the server limit
+	maxFileSize := p.maxFileSize(mediaType)
+	if file.Size > maxFileSize {
+		return "", &clipError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("File size exceeds maximum allowed (%d MB)", maxFileSize/(1024*1024))}
+	}
+
+	// Validate minimum file size (at least 1 KB to prevent empty files)
+	if file.Size < 1024 {
+		return "", &clipError{Status: http.StatusBadRequest, Message: "File is too small or empty"}
+	}
+
+	// Determine file extension and mime type based on format
+	extension := filepath.Ext(file.Filename)
+	if extension == "" {
+		extension = ".webm"
+	}
+
+	// Validate file extension against the formats of the media type
+	if !mediaType.allowedExtensions()[strings.ToLower(extension)] {
+		return "", &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid %s file format. Allowed: %s", mediaType.Name, mediaType.AllowedFormats)}
+	}
+
+	// Validate MIME type from file header (magic numbers)
+	if !isValidMediaFile(file.Header, extension, mediaType.isVideo()) {
+		return "", &clipError{Status: http.StatusBadRequest, Message: "File content does not match expected format"}
+	}
+
+	return extension, nil
+}
+
+// validateClipDuration parses the declared duration and checks it against the limit.
+// Without a duration the clip could not be checked, so it is required.
+func (p *Plugin) validateClipDuration(media *clipMedia) (int, *clipError) {
+	if media.Duration == "" {
+		return 0, &clipError{Status: http.StatusBadRequest, Message: "Duration is required"}
+	}
+
+	duration, err := strconv.Atoi(media.Duration)
+	if err != nil || duration < 0 {
+		return 0, &clipError{Status: http.StatusBadRequest, Message: "Invalid duration"}
+	}
+	// Validate against the max duration of the media type
+	maxDuration := media.Type.MaxDuration
+	if duration > maxDuration {
+		return 0, &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Duration exceeds maximum allowed (%d seconds)", maxDuration)}
+	}
+	return duration, nil
+}
+
+// getThreadRoot checks that the user can reply to the requested root post and
+// returns the id of the thread root. Replying to a reply continues its thread.
+func (p *Plugin) getThreadRoot(req *clipRequest) (string, *clipError) {
+	if req.RootID == "" {
+		return "", nil
+	}
+
+	root, appErr := p.API.GetPost(req.RootID)
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return "", &clipError{Status: http.StatusBadRequest, Message: "Root post not found"}
+		}
+		p.API.LogError("Failed to get root post", "root_id", req.RootID, "error", appErr.Error())
+		return "", &clipError{Status: http.StatusInternalServerError, Message: "Failed to get root post"}
+	}
+	if root.DeleteAt != 0 {
+		return "", &clipError{Status: http.StatusBadRequest, Message: "Root post not found"}
+	}
+	if root.ChannelId != req.ChannelID {
+		return "", &clipError{Status: http.StatusBadRequest, Message: "Root post is in a different channel"}
+	}
+	if !p.API.HasPermissionToChannel(req.UserID, root.ChannelId, model.PermissionReadChannelContent) {
+		return "", &clipError{Status: http.StatusForbidden, Message: "No permission to read the root post"}
+	}
+
+	if root.RootId != "" {
+		return root.RootId, nil
+	}
+	return root.Id, nil
+}
+
+// getAttachments loads the regular files to attach to the clip post.
+func (p *Plugin) getAttachments(req *clipRequest) ([]*model.FileInfo, *clipError) {
+	attachments := make([]*model.FileInfo, 0, len(req.FileIDs))
+	seen := make(map[string]bool)
+	for _, fileID := range req.FileIDs {
+		if seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+
+		info, clipErr := p.getAttachableFile(fileID, req.UserID, req.ChannelID)
+		if clipErr != nil {
+			return nil, clipErr
+		}
+		attachments = append(attachments, info)
+	}
+	return attachments, nil
+}
+
+// getAttachableFile loads a file uploaded through the Mattermost API. It must have
+// been uploaded by the user, to the channel, and not be attached to a post yet.
+func (p *Plugin) getAttachableFile(fileID, userID, channelID string) (*model.FileInfo, *clipError) {
+	info, appErr := p.API.GetFileInfo(fileID)
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return nil, &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("File %s not found", fileID)}
+		}
+		p.API.LogError("Failed to get file info", "file_id", fileID, "error", appErr.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to get file info"}
+	}
+	if info.CreatorId != userID || info.PostId != "" || info.DeleteAt != 0 || (info.ChannelId != "" && info.ChannelId != channelID) {
+		return nil, &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("File %s cannot be attached to this post", fileID)}
+	}
+	return info, nil
+}
+
+// uploadClipMedia stores one media file in Mattermost, encrypted with the data key of
+// the channel when encryption keys are given.
+func (p *Plugin) uploadClipMedia(channelID string, media *clipMedia, extension string, encryption *encryptionKeys) (*model.FileInfo, *clipError) {
+	// Generate filename with timestamp
+	timestamp := time.Now().Unix()
+	filename := fmt.Sprintf("%s_%d%s", media.Type.PropsKey, timestamp, extension)
+
+	data, err := media.File.ReadAll()
+	if err != nil {
+		p.API.LogError("Failed to read spooled file", "error", err.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to read file"}
+	}
+
+	if encryption != nil {
+		if data, err = p.encryptClipData(encryption, channelID, data); err != nil {
+			p.API.LogError("Failed to encrypt file", "channel_id", channelID, "error", err.Error())
+			return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to encrypt file"}
+		}
+		filename += encryptedExtension
+	}
+
+	var fileInfo *model.FileInfo
+	appErr := p.withRetry("upload file", func() *model.AppError {
+		var uploadErr *model.AppError
+		fileInfo, uploadErr = p.API.UploadFile(data, channelID, filename)
+		return uploadErr
+	})
+	if appErr != nil {
+		p.API.LogError("Failed to upload file", "error", appErr.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to upload file: " + appErr.Error()}
+	}
+	p.trackUploadedFile(fileInfo.Id)
+	return fileInfo, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"reflect"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -23,9 +24,78 @@ type configuration struct {
 	MaxVideoFileSize int    `json:"max_video_file_size"`
 	VideoBitrate     int    `json:"video_bitrate"`
 
+	// Screen recording settings
+	MaxScreenDuration int `json:"max_screen_duration"`
+	MaxScreenFileSize int `json:"max_screen_file_size"`
+
 	// Allowed formats (comma-separated)
-	AllowedAudioFormats string `json:"allowed_audio_formats"`
-	AllowedVideoFormats string `json:"allowed_video_formats"`
+	AllowedAudioFormats  string `json:"allowed_audio_formats"`
+	AllowedVideoFormats  string `json:"allowed_video_formats"`
+	AllowedScreenFormats string `json:"allowed_screen_formats"`
+
+	// CustomMediaTypes is a JSON array of additional media types.
+	CustomMediaTypes string `json:"custom_media_types"`
+
+	// MessageTemplates is a JSON object of post text templates by locale and media type.
+	MessageTemplates string `json:"message_templates"`
+
+	// MediaPolicies is a JSON object of allow and deny rules by media type.
+	MediaPolicies string `json:"media_policies"`
+
+	// Upload settings
+	IdempotencyWindow  int    `json:"idempotency_window"`
+	OrphanedFileAction string `json:"orphaned_file_action"`
+
+	// Upload budget settings
+	MaxConcurrentUploads        int `json:"max_concurrent_uploads"`
+	MaxUploadMemory             int `json:"max_upload_memory"`
+	MaxConcurrentUploadsPerUser int `json:"max_concurrent_uploads_per_user"`
+
+	// Rate limit settings
+	MaxClipsPerMinute      int    `json:"max_clips_per_minute"`
+	MaxClipsPerHour        int    `json:"max_clips_per_hour"`
+	MaxClipsPerDay         int    `json:"max_clips_per_day"`
+	MaxUploadSizePerMinute int    `json:"max_upload_size_per_minute"`
+	MaxUploadSizePerHour   int    `json:"max_upload_size_per_hour"`
+	MaxUploadSizePerDay    int    `json:"max_upload_size_per_day"`
+	RateLimitExemptBots    string `json:"rate_limit_exempt_bots"`
+
+	// Storage quota settings
+	UserStorageQuota int `json:"user_storage_quota"`
+	TeamStorageQuota int `json:"team_storage_quota"`
+
+	// Guest settings
+	GuestVoiceClips        bool `json:"guest_voice_clips"`
+	GuestVideoClips        bool `json:"guest_video_clips"`
+	GuestMaxDuration       int  `json:"guest_max_duration"`
+	GuestMaxFileSize       int  `json:"guest_max_file_size"`
+	GuestShowTranscripts   bool `json:"guest_show_transcripts"`
+	GuestDownloadOriginals bool `json:"guest_download_originals"`
+
+	// Malware scanning settings
+	MalwareScanAddress string `json:"malware_scan_address"`
+	MalwareScanFailure string `json:"malware_scan_failure"`
+	MalwareScanTimeout int    `json:"malware_scan_timeout"`
+
+	// Encryption settings
+	EncryptionMasterKey          string `json:"encryption_master_key"`
+	EncryptionPreviousMasterKeys string `json:"encryption_previous_master_keys"`
+
+	// Processing settings
+	JobWorkers int `json:"job_workers"`
+
+	// Security settings
+	RequireRecordingSession bool   `json:"require_recording_session"`
+	ForgedClipAction        string `json:"forged_clip_action"`
+	AttachmentValidation    string `json:"attachment_validation"`
+	ConvertAttachments      bool   `json:"convert_attachments"`
+
+	// registry, messageTemplates, mediaPolicies and encryption are built from the
+	// settings above in OnConfigurationChange.
+	registry         *mediaTypeRegistry
+	messageTemplates map[string]map[string]string
+	mediaPolicies    map[string]*mediaPolicy
+	encryption       *encryptionKeys
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -35,6 +105,48 @@ func (c *configuration) Clone() *configuration {
 	return &clone
 }
 
+// idempotencyWindow returns how long Idempotency-Key results are remembered.
+func (c *configuration) idempotencyWindow() time.Duration {
+	if c.IdempotencyWindow <= 0 {
+		return 24 * time.Hour // Default 24 hours
+	}
+	return time.Duration(c.IdempotencyWindow) * time.Minute
+}
+
+// admissionLimits returns the upload budget. Zero settings disable a limit.
+func (c *configuration) admissionLimits() admissionLimits {
+	return admissionLimits{
+		MaxConcurrent: c.MaxConcurrentUploads,
+		MaxBytes:      int64(c.MaxUploadMemory) * 1024 * 1024,
+		MaxPerUser:    c.MaxConcurrentUploadsPerUser,
+	}
+}
+
+// jobWorkers returns the number of background job workers per server.
+func (c *configuration) jobWorkers() int {
+	if c.JobWorkers <= 0 {
+		return 2 // Default 2 workers
+	}
+	return c.JobWorkers
+}
+
+// forgedClipAction returns what happens to clip posts not created by the plugin.
+func (c *configuration) forgedClipAction() string {
+	if c.ForgedClipAction == forgedClipActionDowngrade {
+		return forgedClipActionDowngrade
+	}
+	return forgedClipActionReject // Default reject
+}
+
+// attachmentValidation returns how media files uploaded outside the plugin are checked.
+func (c *configuration) attachmentValidation() string {
+	switch c.AttachmentValidation {
+	case attachmentValidationValidate, attachmentValidationSanitize:
+		return c.AttachmentValidation
+	}
+	return attachmentValidationOff // Default off
+}
+
 // getConfiguration retrieves the active configuration under lock, making it safe to use
 // concurrently. The active configuration may change underneath the client of this method, but
 // the struct returned by this API call is considered immutable.
@@ -57,9 +169,41 @@ func (p *Plugin) getConfiguration() *configuration {
 			MaxVideoFileSize: 100,
 			VideoBitrate:     1500,
 
+			// Screen recording defaults
+			MaxScreenDuration: 600,
+			MaxScreenFileSize: 250,
+
 			// Allowed formats defaults
-			AllowedAudioFormats: "webm,ogg,mp4,m4a,mp3,aac,wav",
-			AllowedVideoFormats: "webm,mp4,mov",
+			AllowedAudioFormats:  "webm,ogg,mp4,m4a,mp3,aac,wav",
+			AllowedVideoFormats:  "webm,mp4,mov",
+			AllowedScreenFormats: "webm,mp4",
+
+			// Upload defaults
+			IdempotencyWindow:  1440,
+			OrphanedFileAction: "report",
+
+			// Upload budget defaults
+			MaxConcurrentUploads:        10,
+			MaxUploadMemory:             512,
+			MaxConcurrentUploadsPerUser: 2,
+
+			// Guest defaults
+			GuestVoiceClips:        true,
+			GuestVideoClips:        true,
+			GuestShowTranscripts:   true,
+			GuestDownloadOriginals: true,
+
+			// Malware scanning defaults
+			MalwareScanFailure: "closed",
+			MalwareScanTimeout: 30,
+
+			// Processing defaults
+			JobWorkers: 2,
+
+			// Security defaults
+			RequireRecordingSession: true,
+			ForgedClipAction:        "reject",
+			AttachmentValidation:    "off",
 		}
 	}
 
@@ -94,6 +238,30 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	registry, err := configuration.loadMediaTypes()
+	if err != nil {
+		return errors.Wrap(err, "invalid media type configuration")
+	}
+	configuration.registry = registry
+
+	templates, err := configuration.loadMessageTemplates()
+	if err != nil {
+		return errors.Wrap(err, "invalid message template configuration")
+	}
+	configuration.messageTemplates = templates
+
+	policies, err := configuration.loadMediaPolicies(registry)
+	if err != nil {
+		return errors.Wrap(err, "invalid media policy configuration")
+	}
+	configuration.mediaPolicies = policies
+
+	encryption, err := configuration.loadEncryptionKeys()
+	if err != nil {
+		return errors.Wrap(err, "invalid encryption configuration")
+	}
+	configuration.encryption = encryption
+
 	p.setConfiguration(configuration)
 
 	return nil
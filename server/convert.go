@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	// clipSourceAttachment marks clip props of posts converted from a regular attachment.
+	clipSourceAttachment = "attachment"
+
+	// conversionConfirmTimeout is how long the reservations of a converted post wait
+	// for MessageHasBeenPosted before checking whether the post was saved.
+	conversionConfirmTimeout = time.Minute
+)
+
+// pendingConversions holds the rate limit and storage reservations of converted
+// posts, by the id of their probe job, until the post is saved. Another plugin or
+// the server may still reject the post after MessageWillBePosted. Both hooks run on
+// the server creating the post, so the reservations are kept in memory.
+type pendingConversions struct {
+	mu       sync.Mutex
+	releases map[string]func()
+}
+
+func (c *pendingConversions) add(jobID string, release func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.releases == nil {
+		c.releases = make(map[string]func())
+	}
+	c.releases[jobID] = release
+}
+
+// take removes the reservations of a converted post, returning their release func.
+func (c *pendingConversions) take(jobID string) (func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	release, ok := c.releases[jobID]
+	delete(c.releases, jobID)
+	return release, ok
+}
+
+// attachmentMediaType returns the media type a regular attachment is converted to:
+// audio for audio files and video for video files, if the type allows the format and
+// the file is within its size limit. It returns nil for anything else.
+func (p *Plugin) attachmentMediaType(info *model.FileInfo) *mediaType {
+	mediaTypes := p.getConfiguration().mediaTypes()
+
+	var t *mediaType
+	switch {
+	case strings.HasPrefix(info.MimeType, "audio/"):
+		t = mediaTypes.get("audio")
+	case strings.HasPrefix(info.MimeType, "video/"):
+		t = mediaTypes.get("video")
+	}
+	if t == nil || !t.allowedExtensions()["."+strings.ToLower(info.Extension)] {
+		return nil
+	}
+	if info.Size > p.maxFileSize(t) {
+		return nil
+	}
+	return t
+}
+
+// convertAttachmentPost turns a regular post with a single audio or video attachment,
+// such as a voice note shared from the mobile app, into a clip post, if the user may
+// send it as a clip. The duration is not known yet, so a probe job is queued once the
+// post exists. It returns nil when the post is not converted.
+func (p *Plugin) convertAttachmentPost(post *model.Post) *model.Post {
+	// Posts of the bot attach files only to delete them.
+	if post.Type != model.PostTypeDefault || len(post.FileIds) != 1 || post.UserId == p.botUserID {
+		return nil
+	}
+
+	// The attachment is already stored in plaintext, and re-uploading it encrypted
+	// would block posting; with encryption on, it stays a regular attachment.
+	if p.getConfiguration().encryption != nil {
+		return nil
+	}
+
+	info, appErr := p.API.GetFileInfo(post.FileIds[0])
+	if appErr != nil {
+		p.API.LogWarn("Failed to get attachment for conversion", "file_id", post.FileIds[0], "error", appErr.Error())
+		return nil
+	}
+	t := p.attachmentMediaType(info)
+	if t == nil {
+		return nil
+	}
+
+	// The user may not be allowed to send the clip; the post then stays a regular
+	// attachment.
+	release, clipErr := p.admitAttachmentClip(post, t, info)
+	if clipErr != nil {
+		return nil
+	}
+
+	format := "." + strings.ToLower(info.Extension)
+	jobID := model.NewId()
+	if strings.TrimSpace(post.Message) == "" {
+		post.Message = p.clipMessage(t, p.getUserForText(post.UserId), 0)
+	}
+	post.Type = t.PostType
+	post.AddProp(t.PropsKey, map[string]interface{}{
+		"duration": 0,
+		"format":   format,
+		"files": []interface{}{map[string]interface{}{
+			"file_id":  info.Id,
+			"type":     t.Name,
+			"duration": 0,
+			"format":   format,
+			"size":     info.Size,
+		}},
+		"processing": true,
+		"job_ids":    []string{jobID},
+		"source":     clipSourceAttachment,
+	})
+	if err := p.signClipPost(post, t.PropsKey); err != nil {
+		p.API.LogError("Failed to sign converted clip post", "error", err.Error())
+		release()
+		return nil
+	}
+
+	p.conversions.add(jobID, release)
+	time.AfterFunc(conversionConfirmTimeout, func() {
+		p.expireConversion(jobID, info.Id)
+	})
+	return post
+}
+
+// expireConversion releases the reservations of a converted post that was not
+// reported by MessageHasBeenPosted. The file is attached once the post is saved,
+// so a post that was saved after all keeps its reservations.
+func (p *Plugin) expireConversion(jobID, fileID string) {
+	release, ok := p.conversions.take(jobID)
+	if !ok {
+		return
+	}
+
+	info, appErr := p.API.GetFileInfo(fileID)
+	if appErr != nil && appErr.StatusCode != http.StatusNotFound {
+		p.API.LogWarn("Failed to check converted attachment", "file_id", fileID, "error", appErr.Error())
+		return
+	}
+	if info != nil && info.PostId != "" {
+		return
+	}
+	release()
+}
+
+// admitAttachmentClip applies the checks of the clip pipeline that concern the
+// user rather than the file contents: media policies, guest restrictions, rate
+// limits and storage quotas. The returned release func frees the rate limit and
+// storage reservations again, for when the post is not converted.
+func (p *Plugin) admitAttachmentClip(post *model.Post, t *mediaType, info *model.FileInfo) (func(), *clipError) {
+	if clipErr := p.checkMediaPolicy(post.UserId, post.ChannelId, t); clipErr != nil {
+		return nil, clipErr
+	}
+	media := &clipMedia{Type: t, File: &spooledFile{Filename: info.Name, Size: info.Size}, Stored: info}
+	if clipErr := p.checkGuestMedia(post.UserId, []*clipMedia{media}); clipErr != nil {
+		return nil, clipErr
+	}
+
+	releaseRate, clipErr := p.reserveRate(post.UserId, info.Size)
+	if clipErr != nil {
+		return nil, clipErr
+	}
+	releaseStorage, clipErr := p.reserveStorage(post.UserId, post.ChannelId, map[string]int64{t.Name: info.Size})
+	if clipErr != nil {
+		releaseRate()
+		return nil, clipErr
+	}
+	return func() {
+		releaseRate()
+		releaseStorage()
+	}, nil
+}
+
+// enqueueConvertedPostJobs confirms the reservations of a post converted by
+// convertAttachmentPost and queues its probe job, which needs the id of the created
+// post.
+func (p *Plugin) enqueueConvertedPostJobs(post *model.Post) {
+	t := p.getConfiguration().mediaTypes().forPostType(post.Type)
+	if t == nil || len(post.FileIds) != 1 {
+		return
+	}
+	props, ok := post.GetProp(t.PropsKey).(map[string]interface{})
+	if !ok || props["source"] != clipSourceAttachment || props["processing"] != true {
+		return
+	}
+	jobIDs := propStrings(props["job_ids"])
+	if len(jobIDs) != 1 {
+		return
+	}
+	// The post was saved, so its reservations stay.
+	p.conversions.take(jobIDs[0])
+	format, _ := props["format"].(string)
+
+	j := &job{
+		ID:        jobIDs[0],
+		Type:      jobTypeProbe,
+		PostID:    post.Id,
+		FileID:    post.FileIds[0],
+		UserID:    post.UserId,
+		ChannelID: post.ChannelId,
+		PropsKey:  t.PropsKey,
+		Format:    format,
+	}
+	if err := p.enqueueJobs([]*job{j}); err != nil {
+		p.API.LogError("Failed to enqueue jobs for converted post", "post_id", post.Id, "error", err.Error())
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newConvertPlugin(api *plugintest.API) (*Plugin, map[string][]byte) {
+	plugin := &Plugin{signingKey: []byte("test-signing-key"), botUserID: "bot123"}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+
+	plugin.setConfiguration(&configuration{ConvertAttachments: true})
+	return plugin, store
+}
+
+func TestMessageWillBePosted_ConvertAttachment(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     *model.FileInfo
+		postType string
+		propsKey string
+		format   string
+		message  string
+	}{
+		{"voice note", &model.FileInfo{Id: "file123", Extension: "m4a", MimeType: "audio/mp4", Size: 4096}, "custom_voice_clip", "voice_clip", ".m4a", "🎤 Voice message"},
+		{"video", &model.FileInfo{Id: "file123", Extension: "MP4", MimeType: "video/mp4", Size: 4096}, "custom_video_clip", "video_clip", ".mp4", "📹 Video message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin, _ := newConvertPlugin(api)
+			api.On("GetFileInfo", "file123").Return(tt.info, nil)
+
+			post := &model.Post{UserId: "user123", ChannelId: "channel123", FileIds: model.StringArray{"file123"}}
+			converted, reason := plugin.MessageWillBePosted(nil, post)
+			assert.Empty(t, reason)
+			require.NotNil(t, converted)
+			requireGobEncodable(t, converted)
+
+			// The file counts against the storage quota like an uploaded clip.
+			usage, err := plugin.getStorageUsage(userUsageKey("user123"))
+			require.NoError(t, err)
+			assert.Equal(t, int64(4096), usage.Bytes)
+
+			assert.Equal(t, tt.postType, converted.Type)
+			assert.Equal(t, tt.message, converted.Message)
+			props := converted.GetProp(tt.propsKey).(map[string]interface{})
+			assert.Equal(t, tt.format, props["format"])
+			assert.Equal(t, true, props["processing"])
+			assert.Equal(t, "attachment", props["source"])
+			assert.Len(t, props["job_ids"], 1)
+			assert.Len(t, props["files"], 1)
+
+			valid, err := plugin.verifyClipPost(converted, tt.propsKey)
+			require.NoError(t, err)
+			assert.True(t, valid)
+		})
+	}
+}
+
+func TestMessageWillBePosted_NotConverted(t *testing.T) {
+	audio := &model.FileInfo{Id: "file123", Extension: "m4a", MimeType: "audio/mp4", Size: 4096}
+
+	tests := []struct {
+		name string
+		post *model.Post
+		info *model.FileInfo
+	}{
+		{"several files", &model.Post{UserId: "user123", FileIds: model.StringArray{"file123", "file456"}}, nil},
+		{"bot post", &model.Post{UserId: "bot123", FileIds: model.StringArray{"file123"}}, nil},
+		{"other post type", &model.Post{UserId: "user123", Type: model.PostTypeSlackAttachment, FileIds: model.StringArray{"file123"}}, nil},
+		{"image", &model.Post{UserId: "user123", FileIds: model.StringArray{"file123"}}, &model.FileInfo{Id: "file123", Extension: "png", MimeType: "image/png", Size: 4096}},
+		{"format not allowed", &model.Post{UserId: "user123", FileIds: model.StringArray{"file123"}}, &model.FileInfo{Id: "file123", Extension: "flac", MimeType: "audio/flac", Size: 4096}},
+		{"too large", &model.Post{UserId: "user123", FileIds: model.StringArray{"file123"}}, &model.FileInfo{Id: "file123", Extension: "m4a", MimeType: "audio/mp4", Size: 60 * 1024 * 1024}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin, _ := newConvertPlugin(api)
+			if tt.info != nil {
+				api.On("GetFileInfo", "file123").Return(tt.info, nil)
+			}
+
+			converted, reason := plugin.MessageWillBePosted(nil, tt.post)
+			assert.Empty(t, reason)
+			assert.Nil(t, converted)
+		})
+	}
+
+	t.Run("setting off", func(t *testing.T) {
+		api := &plugintest.API{}
+		plugin, _ := newConvertPlugin(api)
+		plugin.setConfiguration(&configuration{})
+		api.On("GetFileInfo", "file123").Return(audio, nil).Maybe()
+
+		converted, _ := plugin.MessageWillBePosted(nil, &model.Post{UserId: "user123", FileIds: model.StringArray{"file123"}})
+		assert.Nil(t, converted)
+		api.AssertNotCalled(t, "GetFileInfo", "file123")
+	})
+
+	// Attachments are stored in plaintext, so with encryption on they stay regular
+	// attachments.
+	t.Run("encryption on", func(t *testing.T) {
+		api := &plugintest.API{}
+		plugin, _ := newConvertPlugin(api)
+		config := &configuration{ConvertAttachments: true, EncryptionMasterKey: testMasterKey}
+		keys, err := config.loadEncryptionKeys()
+		require.NoError(t, err)
+		config.encryption = keys
+		plugin.setConfiguration(config)
+		api.On("GetFileInfo", "file123").Return(audio, nil).Maybe()
+
+		converted, _ := plugin.MessageWillBePosted(nil, &model.Post{UserId: "user123", FileIds: model.StringArray{"file123"}})
+		assert.Nil(t, converted)
+	})
+}
+
+func TestMessageWillBePosted_ConversionRefused(t *testing.T) {
+	video := &model.FileInfo{Id: "file123", Name: "clip.mp4", Extension: "mp4", MimeType: "video/mp4", Size: 2 * 1024 * 1024}
+
+	tests := []struct {
+		name   string
+		userID string
+		config *configuration
+	}{
+		{"media policy", "user123", &configuration{MediaPolicies: `{"video": {"deny": ["user:user123"]}}`}},
+		{"guest", "guest123", &configuration{GuestVoiceClips: true}},
+		{"rate limit", "user123", &configuration{MaxClipsPerHour: 1}},
+		{"storage quota", "user123", &configuration{UserStorageQuota: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("GetUser", "guest123").Return(&model.User{Id: "guest123", Roles: model.SystemGuestRoleId}, nil).Maybe()
+			api.On("HasPermissionTo", tt.userID, model.PermissionManageSystem).Return(false).Maybe()
+			plugin, _ := newConvertPlugin(api)
+			api.On("GetFileInfo", "file123").Return(video, nil)
+
+			tt.config.ConvertAttachments = true
+			policies, err := tt.config.loadMediaPolicies(tt.config.mediaTypes())
+			require.NoError(t, err)
+			tt.config.mediaPolicies = policies
+			plugin.setConfiguration(tt.config)
+
+			// One clip was already sent this hour.
+			_, clipErr := plugin.reserveRate(tt.userID, 1024)
+			require.Nil(t, clipErr)
+
+			// The post stays a regular attachment.
+			converted, reason := plugin.MessageWillBePosted(nil, &model.Post{UserId: tt.userID, ChannelId: "channel123", FileIds: model.StringArray{"file123"}})
+			assert.Empty(t, reason)
+			assert.Nil(t, converted)
+
+			usage, err := plugin.getStorageUsage(userUsageKey(tt.userID))
+			require.NoError(t, err)
+			assert.Zero(t, usage.Bytes)
+		})
+	}
+}
+
+func TestMessageHasBeenPosted_ConvertedPost(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newConvertPlugin(api)
+	api.On("GetFileInfo", "file123").Return(&model.FileInfo{Id: "file123", Extension: "wav", MimeType: "audio/wav", Size: 4096}, nil)
+
+	post, _ := plugin.MessageWillBePosted(nil, &model.Post{UserId: "user123", ChannelId: "channel123", Message: "From my phone", FileIds: model.StringArray{"file123"}})
+	require.NotNil(t, post)
+	assert.Equal(t, "From my phone", post.Message)
+	post.Id = "post123"
+	plugin.MessageHasBeenPosted(nil, post)
+
+	jobID := propStrings(post.GetProp("voice_clip").(map[string]interface{})["job_ids"])[0]
+	j, err := plugin.getJob(jobID)
+	require.NoError(t, err)
+	require.NotNil(t, j)
+	assert.Equal(t, jobTypeProbe, j.Type)
+	assert.Equal(t, "post123", j.PostID)
+	assert.Equal(t, "file123", j.FileID)
+	assert.Equal(t, ".wav", j.Format)
+
+	api.On("GetFile", "file123").Return(testWAV(42), nil)
+	api.On("GetPost", "post123").Return(post, nil)
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(post, nil)
+	api.On("PublishWebSocketEvent", "job_finished", mock.Anything, mock.Anything).Return()
+	require.True(t, plugin.runNextJob())
+
+	props := post.GetProp("voice_clip").(map[string]interface{})
+	assert.Equal(t, 42, props["duration"])
+	assert.Equal(t, false, props["processing"])
+	valid, err := plugin.verifyClipPost(post, "voice_clip")
+	require.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestMessageHasBeenPosted_IgnoresOtherPosts(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newConvertPlugin(api)
+
+	// Clips from the upload endpoint queue their own jobs.
+	post := newSignedClipPost(t, plugin)
+	post.Id = "post123"
+	plugin.MessageHasBeenPosted(nil, post)
+	plugin.MessageHasBeenPosted(nil, &model.Post{Id: "post456", Message: "hello"})
+	api.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestExpireConversion(t *testing.T) {
+	tests := []struct {
+		name      string
+		confirmed bool
+		postID    string
+		kept      bool
+	}{
+		{"post rejected", false, "", false},
+		{"hook missed", false, "post123", true},
+		{"post confirmed", true, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin, _ := newConvertPlugin(api)
+			api.On("GetFileInfo", "file123").Return(&model.FileInfo{Id: "file123", Extension: "m4a", MimeType: "audio/mp4", Size: 4096}, nil).Once()
+
+			post, _ := plugin.MessageWillBePosted(nil, &model.Post{UserId: "user123", ChannelId: "channel123", FileIds: model.StringArray{"file123"}})
+			require.NotNil(t, post)
+			jobID := propStrings(post.GetProp("voice_clip").(map[string]interface{})["job_ids"])[0]
+			if tt.confirmed {
+				post.Id = "post123"
+				plugin.MessageHasBeenPosted(nil, post)
+			}
+
+			api.On("GetFileInfo", "file123").Return(&model.FileInfo{Id: "file123", PostId: tt.postID}, nil).Maybe()
+			plugin.expireConversion(jobID, "file123")
+
+			usage, err := plugin.getStorageUsage(userUsageKey("user123"))
+			require.NoError(t, err)
+			if tt.kept {
+				assert.Equal(t, int64(4096), usage.Bytes)
+			} else {
+				assert.Zero(t, usage.Bytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaBasePath        = "/api/v1/media"
+	encryptionRotatePath = "/api/v1/encryption/rotate"
+
+	// dataKeyPrefix is followed by the channel id in the KV key of a wrapped data key.
+	dataKeyPrefix = "datakey_"
+
+	// dataKeyChannelsKey lists the channels that have a data key, so that keys can
+	// be re-wrapped without scanning the KV store.
+	dataKeyChannelsKey = "encrypted_channels"
+
+	// encryptedExtension is appended to the name of encrypted clip files, so that
+	// they are not taken for media by the file API or attachment validation.
+	encryptedExtension = ".enc"
+
+	// encryptedMagic starts every encrypted clip file, followed by the nonce and the
+	// AES-GCM ciphertext.
+	encryptedMagic = "VCE1"
+)
+
+// masterKey wraps the data keys of channels. Its id is a fingerprint stored with the
+// data keys it wrapped.
+type masterKey struct {
+	ID   string
+	aead cipher.AEAD
+}
+
+// encryptionKeys are the master keys from the configuration: the current key, used
+// for new data keys, and previous keys still accepted while data keys are re-wrapped.
+type encryptionKeys struct {
+	Current  *masterKey
+	Previous []*masterKey
+}
+
+// find returns the master key with the given id, or nil.
+func (k *encryptionKeys) find(id string) *masterKey {
+	if k.Current.ID == id {
+		return k.Current
+	}
+	for _, key := range k.Previous {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// dataKeyRecord is the data key of a channel, wrapped by a master key.
+type dataKeyRecord struct {
+	MasterKeyID string `json:"master_key_id"`
+	WrappedKey  []byte `json:"wrapped_key"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func dataKeyKey(channelID string) string {
+	return dataKeyPrefix + channelID
+}
+
+// parseMasterKey parses a base64-encoded 256-bit key.
+func parseMasterKey(encoded string) (*masterKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.Wrap(err, "master key is not valid base64")
+	}
+	if len(raw) != 32 {
+		return nil, errors.Errorf("master key must be 32 bytes, got %d", len(raw))
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(raw)
+	return &masterKey{ID: hex.EncodeToString(fingerprint[:8]), aead: aead}, nil
+}
+
+// loadEncryptionKeys parses the master key settings, or returns nil when encryption
+// is off.
+func (c *configuration) loadEncryptionKeys() (*encryptionKeys, error) {
+	if strings.TrimSpace(c.EncryptionMasterKey) == "" {
+		return nil, nil
+	}
+
+	current, err := parseMasterKey(c.EncryptionMasterKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := &encryptionKeys{Current: current}
+	for _, encoded := range strings.FieldsFunc(c.EncryptionPreviousMasterKeys, func(r rune) bool {
+		return r == ',' || r == '\n' || r == ' '
+	}) {
+		previous, err := parseMasterKey(encoded)
+		if err != nil {
+			return nil, errors.Wrap(err, "previous master key")
+		}
+		keys.Previous = append(keys.Previous, previous)
+	}
+	return keys, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealData encrypts data with a random nonce, which is prepended to the result.
+func sealData(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	return aead.Seal(nonce, nonce, data, additionalData), nil
+}
+
+// openData decrypts data sealed by sealData.
+func openData(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// wrap encrypts a data key with a master key. The channel id is authenticated with
+// it, so a wrapped key cannot be moved to another channel.
+func (k *masterKey) wrap(channelID string, dataKey []byte) (*dataKeyRecord, error) {
+	wrapped, err := sealData(k.aead, dataKey, []byte(dataKeyKey(channelID)))
+	if err != nil {
+		return nil, err
+	}
+	return &dataKeyRecord{MasterKeyID: k.ID, WrappedKey: wrapped, CreatedAt: time.Now().UnixMilli()}, nil
+}
+
+// unwrap returns the data key of a record.
+func (k *encryptionKeys) unwrap(channelID string, record *dataKeyRecord) ([]byte, error) {
+	master := k.find(record.MasterKeyID)
+	if master == nil {
+		return nil, errors.Errorf("data key of channel %s is wrapped with unknown master key %s", channelID, record.MasterKeyID)
+	}
+	dataKey, err := openData(master.aead, record.WrappedKey, []byte(dataKeyKey(channelID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unwrap data key of channel %s", channelID)
+	}
+	return dataKey, nil
+}
+
+// getDataKey returns the data key of a channel. With create, a key is generated and
+// stored if the channel has none yet.
+func (p *Plugin) getDataKey(keys *encryptionKeys, channelID string, create bool) (cipher.AEAD, error) {
+	key := dataKeyKey(channelID)
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	if data == nil {
+		if !create {
+			return nil, errors.Errorf("channel %s has no data key", channelID)
+		}
+		dataKey := make([]byte, 32)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, errors.Wrap(err, "failed to generate data key")
+		}
+		record, err := keys.Current.wrap(channelID, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(record); err != nil {
+			return nil, err
+		}
+		if err := p.addToIDList(dataKeyChannelsKey, channelID); err != nil {
+			return nil, err
+		}
+
+		// Another node may have stored a key for the channel first; use whichever won.
+		saved, appErr := p.API.KVSetWithOptions(key, data, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: nil,
+		})
+		if appErr != nil {
+			return nil, appErr
+		}
+		if !saved {
+			if data, appErr = p.API.KVGet(key); appErr != nil {
+				return nil, appErr
+			}
+			if data == nil {
+				return nil, errors.Errorf("data key of channel %s is missing", channelID)
+			}
+		}
+	}
+
+	var record dataKeyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse data key of channel %s", channelID)
+	}
+	dataKey, err := keys.unwrap(channelID, &record)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(dataKey)
+}
+
+// encryptClipData encrypts a clip file with the data key of its channel.
+func (p *Plugin) encryptClipData(keys *encryptionKeys, channelID string, data []byte) ([]byte, error) {
+	aead, err := p.getDataKey(keys, channelID, true)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealData(aead, data, []byte(channelID))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(encryptedMagic), sealed...), nil
+}
+
+// sealChunk encrypts a tus chunk or recording segment of an upload started with
+// encryption on, so that media does not sit in the KV store in plaintext until the
+// clip is assembled.
+func (p *Plugin) sealChunk(encrypted bool, channelID string, data []byte) ([]byte, error) {
+	if !encrypted {
+		return data, nil
+	}
+	keys := p.getConfiguration().encryption
+	if keys == nil {
+		return nil, errors.New("no encryption master key is configured")
+	}
+	return p.encryptClipData(keys, channelID, data)
+}
+
+// openChunk returns a function decrypting the chunks sealed by sealChunk, or nil
+// for an upload started with encryption off.
+func (p *Plugin) openChunk(encrypted bool, channelID string) func([]byte) ([]byte, error) {
+	if !encrypted {
+		return nil
+	}
+	return func(data []byte) ([]byte, error) {
+		return p.decryptClipData(channelID, data)
+	}
+}
+
+// maxEncryptedFileSize is the size of the largest encrypted clip file: the largest
+// size limit of a media type plus the magic, nonce and tag added by encryption.
+func (p *Plugin) maxEncryptedFileSize() int64 {
+	var limit int64
+	for _, t := range p.getConfiguration().mediaTypes().all() {
+		limit = max(limit, t.maxFileSizeBytes())
+	}
+	return limit + int64(len(encryptedMagic)+12+16)
+}
+
+// isEncryptedClipData reports whether a file was encrypted by the plugin.
+func isEncryptedClipData(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
+
+// decryptClipData decrypts a clip file of a channel.
+func (p *Plugin) decryptClipData(channelID string, data []byte) ([]byte, error) {
+	if !isEncryptedClipData(data) {
+		return nil, errors.New("file is not encrypted")
+	}
+	keys := p.getConfiguration().encryption
+	if keys == nil {
+		return nil, errors.New("no encryption master key is configured")
+	}
+	aead, err := p.getDataKey(keys, channelID, false)
+	if err != nil {
+		return nil, err
+	}
+	return openData(aead, data[len(encryptedMagic):], []byte(channelID))
+}
+
+// readClipFile returns the content of a clip file, decrypting it if needed.
+func (p *Plugin) readClipFile(fileID, channelID string) ([]byte, error) {
+	data, appErr := p.API.GetFile(fileID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if !isEncryptedClipData(data) {
+		return data, nil
+	}
+	return p.decryptClipData(channelID, data)
+}
+
+// handleMedia serves the decrypted content of an encrypted clip file to members of
+// its channel. Range requests are supported so that players can seek. Guests who
+// may not download originals get playback only.
+func (p *Plugin) handleMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	fileID := strings.TrimPrefix(r.URL.Path, mediaBasePath+"/")
+	if !model.IsValidId(fileID) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Only encrypted clip files are served; everything else is read through the
+	// Mattermost file API. Files that merely look encrypted fail to decrypt, as the
+	// data keys never leave the plugin.
+	info, appErr := p.API.GetFileInfo(fileID)
+	if appErr != nil || info.DeleteAt != 0 || info.ChannelId == "" || !strings.HasSuffix(info.Name, encryptedExtension) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if _, appErr := p.API.GetChannelMember(info.ChannelId, userID); appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			http.Error(w, "No permission to read this file", http.StatusForbidden)
+			return
+		}
+		p.API.LogError("Failed to get channel member", "channel_id", info.ChannelId, "error", appErr.Error())
+		http.Error(w, "Failed to check channel membership", http.StatusInternalServerError)
+		return
+	}
+	if clipErr := p.checkGuestDownload(userID, r); clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	// The plugin API reads files whole, and GCM decrypts a file at once, so the file
+	// is held in memory twice. Files larger than any clip are refused, and reading
+	// counts against the upload memory budget. Players send several range requests
+	// at once, so the per-user upload limit does not apply.
+	if info.Size > p.maxEncryptedFileSize() {
+		p.API.LogWarn("Encrypted clip file is too large to serve", "file_id", info.Id, "size", info.Size)
+		http.Error(w, "File is too large to serve", http.StatusInternalServerError)
+		return
+	}
+	limits := p.getConfiguration().admissionLimits()
+	limits.MaxPerUser = 0
+	ctx, cancel := context.WithTimeout(r.Context(), admissionWait)
+	release, err := p.admission.acquire(ctx, userID, 2*info.Size, limits)
+	cancel()
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(admissionRetryAfter.Seconds())))
+		http.Error(w, "Server is busy, please try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	data, appErr := p.API.GetFile(info.Id)
+	if appErr != nil {
+		p.API.LogError("Failed to read clip file", "file_id", info.Id, "error", appErr.Error())
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	data, err = p.decryptClipData(info.ChannelId, data)
+	if err != nil {
+		p.API.LogError("Failed to decrypt clip file", "file_id", info.Id, "error", err.Error())
+		http.Error(w, "Failed to decrypt file", http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.TrimSuffix(info.Name, encryptedExtension)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, time.UnixMilli(info.CreateAt), bytes.NewReader(data))
+}
+
+// rewrapDataKeys wraps the data keys of every channel with the current master key.
+// Files are not touched, as they are encrypted with the data keys.
+func (p *Plugin) rewrapDataKeys(keys *encryptionKeys) (int, int, error) {
+	channelIDs, err := p.getIDList(dataKeyChannelsKey)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rewrapped, failed int
+	for _, channelID := range channelIDs {
+		changed, err := p.rewrapDataKey(keys, channelID)
+		if err != nil {
+			p.API.LogError("Failed to re-wrap data key", "channel_id", channelID, "error", err.Error())
+			failed++
+		} else if changed {
+			rewrapped++
+		}
+	}
+	return rewrapped, failed, nil
+}
+
+// rewrapDataKey wraps the data key of a channel with the current master key, if it
+// is wrapped with another one.
+func (p *Plugin) rewrapDataKey(keys *encryptionKeys, channelID string) (bool, error) {
+	key := dataKeyKey(channelID)
+	for attempt := 0; attempt < 10; attempt++ {
+		oldData, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return false, appErr
+		}
+		if oldData == nil {
+			return false, nil
+		}
+
+		var record dataKeyRecord
+		if err := json.Unmarshal(oldData, &record); err != nil {
+			return false, errors.Wrap(err, "failed to parse data key")
+		}
+		if record.MasterKeyID == keys.Current.ID {
+			return false, nil
+		}
+
+		dataKey, err := keys.unwrap(channelID, &record)
+		if err != nil {
+			return false, err
+		}
+		rewrapped, err := keys.Current.wrap(channelID, dataKey)
+		if err != nil {
+			return false, err
+		}
+		rewrapped.CreatedAt = record.CreatedAt
+		newData, err := json.Marshal(rewrapped)
+		if err != nil {
+			return false, err
+		}
+
+		saved, appErr := p.API.KVSetWithOptions(key, newData, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: oldData,
+		})
+		if appErr != nil {
+			return false, appErr
+		}
+		if saved {
+			return true, nil
+		}
+	}
+	return false, errors.Errorf("failed to update %s after concurrent modifications", key)
+}
+
+// handleRotateEncryption re-wraps every data key with the current master key.
+// Requires the manage_system permission.
+func (p *Plugin) handleRotateEncryption(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	keys := p.getConfiguration().encryption
+	if keys == nil {
+		http.Error(w, "Encryption is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	rewrapped, failed, err := p.rewrapDataKeys(keys)
+	if err != nil {
+		p.API.LogError("Failed to re-wrap data keys", "error", err.Error())
+		http.Error(w, "Failed to re-wrap data keys", http.StatusInternalServerError)
+		return
+	}
+	p.API.LogInfo("Re-wrapped data keys", "master_key_id", keys.Current.ID, "rewrapped", rewrapped, "failed", failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"master_key_id": keys.Current.ID,
+		"rewrapped":     rewrapped,
+		"failed":        failed,
+	})
+}
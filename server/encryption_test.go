@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testMasterKey      = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	testOtherMasterKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+func newEncryptionPlugin(t *testing.T, api *plugintest.API, masterKey, previousKeys string) (*Plugin, map[string][]byte) {
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	setEncryptionKeys(t, plugin, masterKey, previousKeys)
+	store := mockKVStore(api)
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	return plugin, store
+}
+
+func setEncryptionKeys(t *testing.T, plugin *Plugin, masterKey, previousKeys string) {
+	config := &configuration{EncryptionMasterKey: masterKey, EncryptionPreviousMasterKeys: previousKeys}
+	keys, err := config.loadEncryptionKeys()
+	require.NoError(t, err)
+	config.encryption = keys
+	plugin.setConfiguration(config)
+}
+
+func TestLoadEncryptionKeys(t *testing.T) {
+	keys, err := (&configuration{}).loadEncryptionKeys()
+	require.NoError(t, err)
+	assert.Nil(t, keys)
+
+	keys, err = (&configuration{EncryptionMasterKey: testMasterKey, EncryptionPreviousMasterKeys: testOtherMasterKey + ", " + testMasterKey}).loadEncryptionKeys()
+	require.NoError(t, err)
+	require.Len(t, keys.Previous, 2)
+	assert.Len(t, keys.Current.ID, 16)
+	assert.NotEqual(t, keys.Current.ID, keys.Previous[0].ID)
+	assert.Equal(t, keys.Current.ID, keys.Previous[1].ID)
+
+	_, err = (&configuration{EncryptionMasterKey: "not base64!"}).loadEncryptionKeys()
+	assert.Error(t, err)
+	_, err = (&configuration{EncryptionMasterKey: base64.StdEncoding.EncodeToString([]byte("short"))}).loadEncryptionKeys()
+	assert.EqualError(t, err, "master key must be 32 bytes, got 5")
+	_, err = (&configuration{EncryptionMasterKey: testMasterKey, EncryptionPreviousMasterKeys: "short"}).loadEncryptionKeys()
+	assert.Error(t, err)
+}
+
+func TestEncryptClipData(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newEncryptionPlugin(t, api, testMasterKey, "")
+	keys := plugin.getConfiguration().encryption
+
+	encrypted, err := plugin.encryptClipData(keys, "channel123", testWebM())
+	require.NoError(t, err)
+	assert.True(t, isEncryptedClipData(encrypted))
+	assert.NotContains(t, string(encrypted), string(testWebM()[:32]))
+
+	// The channel keeps its data key.
+	wrapped := store[dataKeyKey("channel123")]
+	require.NotNil(t, wrapped)
+	_, err = plugin.encryptClipData(keys, "channel123", testWebM())
+	require.NoError(t, err)
+	assert.Equal(t, wrapped, store[dataKeyKey("channel123")])
+
+	decrypted, err := plugin.decryptClipData("channel123", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, testWebM(), decrypted)
+
+	// Files cannot be decrypted with the key of another channel.
+	_, err = plugin.encryptClipData(keys, "channel456", testWebM())
+	require.NoError(t, err)
+	_, err = plugin.decryptClipData("channel456", encrypted)
+	assert.Error(t, err)
+
+	// Nor without the master key.
+	setEncryptionKeys(t, plugin, testOtherMasterKey, "")
+	_, err = plugin.decryptClipData("channel123", encrypted)
+	assert.Error(t, err)
+}
+
+func TestHandleUpload_Encrypted(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newEncryptionPlugin(t, api, testMasterKey, "")
+	mockUploadAccess(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	var stored []byte
+	api.On("UploadFile", mock.Anything, "channel123", mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, "voice_clip_") && strings.HasSuffix(name, ".webm.enc")
+	})).Run(func(args mock.Arguments) {
+		stored = args.Get(0).([]byte)
+	}).Return(&model.FileInfo{Id: "file123"}, nil)
+
+	var created *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		created = args.Get(0).(*model.Post)
+	}).Return(&model.Post{Id: "post123"}, nil)
+
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM()))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	require.True(t, isEncryptedClipData(stored))
+	decrypted, err := plugin.decryptClipData("channel123", stored)
+	require.NoError(t, err)
+	assert.Equal(t, testWebM(), decrypted)
+
+	require.NotNil(t, created)
+	props := created.GetProp("voice_clip").(map[string]interface{})
+	assert.Equal(t, true, props["encrypted"])
+	assert.Equal(t, true, props["files"].([]interface{})[0].(map[string]interface{})["encrypted"])
+}
+
+func TestHandleMedia(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newEncryptionPlugin(t, api, testMasterKey, "")
+
+	encrypted, err := plugin.encryptClipData(plugin.getConfiguration().encryption, "channel123", testWebM())
+	require.NoError(t, err)
+
+	fileID := model.NewId()
+	plainID := model.NewId()
+	api.On("GetFileInfo", fileID).Return(&model.FileInfo{Id: fileID, ChannelId: "channel123", Name: "voice_clip_1700000000.webm.enc", CreateAt: 1700000000000}, nil)
+	api.On("GetFileInfo", plainID).Return(&model.FileInfo{Id: plainID, ChannelId: "channel123", Name: "voice_clip_1700000000.webm"}, nil)
+	api.On("GetFile", fileID).Return(encrypted, nil)
+	api.On("GetChannelMember", "channel123", "user123").Return(&model.ChannelMember{ChannelId: "channel123", UserId: "user123"}, nil)
+	api.On("GetChannelMember", "channel123", "user456").Return(nil, model.NewAppError("GetChannelMember", "not_found", nil, "", http.StatusNotFound))
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Roles: model.SystemUserRoleId}, nil)
+
+	get := func(userID, fileID, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, mediaBasePath+"/"+fileID, nil)
+		req.Header.Set("Mattermost-User-Id", userID)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, req)
+		return w
+	}
+
+	w := get("user123", fileID, "")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "video/webm", w.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename=voice_clip_1700000000.webm`, w.Header().Get("Content-Disposition"))
+	body, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, testWebM(), body)
+
+	// Players seek with range requests.
+	w = get("user123", fileID, "bytes=0-3")
+	require.Equal(t, http.StatusPartialContent, w.Result().StatusCode)
+	assert.Equal(t, testWebM()[:4], w.Body.Bytes())
+
+	w = get("user456", fileID, "")
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	// Files that are not encrypted are read through the file API.
+	w = get("user123", plainID, "")
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	w = get("", fileID, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	// Files are decrypted in memory, so files larger than any clip are not read.
+	largeID := model.NewId()
+	api.On("GetFileInfo", largeID).Return(&model.FileInfo{Id: largeID, ChannelId: "channel123", Name: "voice_clip_1700000000.webm.enc", Size: plugin.maxEncryptedFileSize() + 1}, nil)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	w = get("user123", largeID, "")
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	api.AssertNotCalled(t, "GetFile", largeID)
+}
+
+func TestHandleClaim_Encrypted(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newEncryptionPlugin(t, api, testMasterKey, "")
+	plugin.botUserID = "bot123"
+	mockUploadAccess(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("GetFileInfo", "file123").Return(&model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", Name: "recording.webm", Size: 2048}, nil)
+	api.On("GetFile", "file123").Return(testWebM(), nil)
+
+	// The claimed file is stored again encrypted.
+	var stored []byte
+	api.On("UploadFile", mock.Anything, "channel123", mock.MatchedBy(func(name string) bool {
+		return strings.HasSuffix(name, ".webm.enc")
+	})).Run(func(args mock.Arguments) {
+		stored = args.Get(0).([]byte)
+	}).Return(&model.FileInfo{Id: "file456", ChannelId: "channel123"}, nil)
+
+	var created *model.Post
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool { return post.ChannelId == "channel123" })).Run(func(args mock.Arguments) {
+		created = args.Get(0).(*model.Post)
+	}).Return(&model.Post{Id: "post123"}, nil)
+
+	// The plaintext original is deleted through a post in the bot's direct channel.
+	mockFileRemoval(api)
+
+	req := httptest.NewRequest(http.MethodPost, claimPath, strings.NewReader(`{"file_id": "file123", "channel_id": "channel123", "type": "video", "duration": 30}`))
+	req.Header.Set("Mattermost-User-Id", "user123")
+	addSession(t, plugin, req, "channel123", "video")
+	w := httptest.NewRecorder()
+	plugin.handleClaim(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode, w.Body.String())
+
+	require.True(t, isEncryptedClipData(stored))
+	require.NotNil(t, created)
+	assert.Equal(t, model.StringArray{"file456"}, created.FileIds)
+	props := created.GetProp("video_clip").(map[string]interface{})
+	assert.Equal(t, true, props["encrypted"])
+	api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "botdm" && post.UserId == "user123" && len(post.FileIds) == 1 && post.FileIds[0] == "file123"
+	}))
+	api.AssertCalled(t, "DeletePost", "removal_file123")
+}
+
+func TestHandleRotateEncryption(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newEncryptionPlugin(t, api, testMasterKey, "")
+	api.On("HasPermissionTo", "admin123", model.PermissionManageSystem).Return(true)
+	api.On("HasPermissionTo", "user123", model.PermissionManageSystem).Return(false)
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	encrypted, err := plugin.encryptClipData(plugin.getConfiguration().encryption, "channel123", testWebM())
+	require.NoError(t, err)
+	oldKeyID := plugin.getConfiguration().encryption.Current.ID
+
+	rotate := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, encryptionRotatePath, nil)
+		req.Header.Set("Mattermost-User-Id", userID)
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, rotate("user123").Result().StatusCode)
+
+	// The old master key stays available until the data keys are re-wrapped.
+	setEncryptionKeys(t, plugin, testOtherMasterKey, testMasterKey)
+	newKeyID := plugin.getConfiguration().encryption.Current.ID
+
+	w := rotate("admin123")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.JSONEq(t, `{"master_key_id": "`+newKeyID+`", "rewrapped": 1, "failed": 0}`, w.Body.String())
+
+	var record dataKeyRecord
+	require.NoError(t, json.Unmarshal(store[dataKeyKey("channel123")], &record))
+	assert.Equal(t, newKeyID, record.MasterKeyID)
+	assert.NotEqual(t, oldKeyID, record.MasterKeyID)
+
+	// Existing files are still readable once the old master key is removed.
+	setEncryptionKeys(t, plugin, testOtherMasterKey, "")
+	decrypted, err := plugin.decryptClipData("channel123", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, testWebM(), decrypted)
+
+	w = rotate("admin123")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.JSONEq(t, `{"master_key_id": "`+newKeyID+`", "rewrapped": 0, "failed": 0}`, w.Body.String())
+}
+
+func TestRunProbeJob_Encrypted(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newEncryptionPlugin(t, api, testMasterKey, "")
+
+	encrypted, err := plugin.encryptClipData(plugin.getConfiguration().encryption, "channel123", testWebM())
+	require.NoError(t, err)
+	api.On("GetFile", "plain123").Return(testWebM(), nil)
+	api.On("GetFile", "encrypted123").Return(encrypted, nil)
+
+	expected, err := runProbeJob(plugin, &job{FileID: "plain123", ChannelID: "channel123", Format: ".webm"}, func(int) {})
+	require.NoError(t, err)
+	result, err := runProbeJob(plugin, &job{FileID: "encrypted123", ChannelID: "channel123", Format: ".webm"}, func(int) {})
+	require.NoError(t, err)
+	assert.Equal(t, expected, result)
+}
+
+func TestHandleClaim_EncryptedOriginalNotRemoved(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newEncryptionPlugin(t, api, testMasterKey, "")
+	plugin.botUserID = "bot123"
+	mockUploadAccess(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("GetFileInfo", "file123").Return(&model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", Name: "recording.webm", Size: 2048}, nil)
+	api.On("GetFile", "file123").Return(testWebM(), nil)
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file456", ChannelId: "channel123"}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool { return post.ChannelId == "channel123" })).Return(&model.Post{Id: "post123"}, nil)
+
+	// The server does not attach the original to the removal post.
+	api.On("GetDirectChannel", "bot123", "bot123").Return(&model.Channel{Id: "botdm"}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool { return post.ChannelId == "botdm" })).Return(&model.Post{Id: "removal123"}, nil)
+	api.On("DeletePost", mock.AnythingOfType("string")).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, claimPath, strings.NewReader(`{"file_id": "file123", "channel_id": "channel123", "type": "video", "duration": 30}`))
+	req.Header.Set("Mattermost-User-Id", "user123")
+	addSession(t, plugin, req, "channel123", "video")
+	w := httptest.NewRecorder()
+	plugin.handleClaim(w, req)
+
+	// The clip is withdrawn rather than left next to its plaintext original.
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "Failed to remove the unencrypted original file")
+	api.AssertCalled(t, "DeletePost", "post123")
+}
+
+func TestHandleTus_EncryptedChunks(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newEncryptionPlugin(t, api, testMasterKey, "")
+	mockUploadAccess(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	media := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, bytes.Repeat([]byte{0x07}, 4092)...)
+	var stored []byte
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		stored = args.Get(0).([]byte)
+	}).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+	uploadPath := createTusUpload(t, plugin, len(media))
+	require.Equal(t, http.StatusNoContent, patchTusUpload(plugin, uploadPath, 0, media[:2048]).Result().StatusCode)
+
+	chunk := store[tusChunkKey(path.Base(uploadPath), 0)]
+	assert.True(t, isEncryptedClipData(chunk))
+	assert.NotContains(t, string(chunk), string(media[4:64]))
+
+	require.Equal(t, http.StatusNoContent, patchTusUpload(plugin, uploadPath, 2048, media[2048:]).Result().StatusCode)
+	decrypted, err := plugin.decryptClipData("channel123", stored)
+	require.NoError(t, err)
+	assert.Equal(t, media, decrypted)
+}
+
+func TestRecording_EncryptedSegments(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newEncryptionPlugin(t, api, testMasterKey, "")
+	mockUploadAccess(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	media := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, bytes.Repeat([]byte{0x07}, 2044)...)
+	var stored []byte
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		stored = args.Get(0).([]byte)
+	}).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+	id := startRecording(t, plugin)
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/segments?index=0", media))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	segment := store[recordingSegmentKey(id, 0)]
+	assert.True(t, isEncryptedClipData(segment))
+	assert.NotContains(t, string(segment), string(media[4:64]))
+
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/finish?duration=3", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode, w.Body.String())
+	decrypted, err := plugin.decryptClipData("channel123", stored)
+	require.NoError(t, err)
+	assert.Equal(t, media, decrypted)
+}
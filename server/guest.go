@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// guestRestrictions are the limits that apply to guest accounts on top of the
+// limits of each media type.
+type guestRestrictions struct {
+	// VoiceClips and VideoClips allow media types played as audio or video.
+	VoiceClips bool
+	VideoClips bool
+
+	// MaxDuration is in seconds and MaxFileSize in bytes; 0 keeps the media type limit.
+	MaxDuration int
+	MaxFileSize int64
+
+	// Transcripts and Downloads let guests see transcripts and download original files.
+	Transcripts bool
+	Downloads   bool
+}
+
+// guestRestrictions returns the guest settings.
+func (c *configuration) guestRestrictions() guestRestrictions {
+	return guestRestrictions{
+		VoiceClips:  c.GuestVoiceClips,
+		VideoClips:  c.GuestVideoClips,
+		MaxDuration: max(c.GuestMaxDuration, 0),
+		MaxFileSize: int64(max(c.GuestMaxFileSize, 0)) * 1024 * 1024,
+		Transcripts: c.GuestShowTranscripts,
+		Downloads:   c.GuestDownloadOriginals,
+	}
+}
+
+// restricts reports whether guests are treated differently from members at all.
+func (g guestRestrictions) restricts() bool {
+	return !g.VoiceClips || !g.VideoClips || g.MaxDuration > 0 || g.MaxFileSize > 0 || !g.Transcripts || !g.Downloads
+}
+
+// allows reports whether guests may send clips of a media type.
+func (g guestRestrictions) allows(t *mediaType) bool {
+	if t.isVideo() {
+		return g.VideoClips
+	}
+	return g.VoiceClips
+}
+
+// maxDuration returns the duration limit of a media type for guests.
+func (g guestRestrictions) maxDuration(t *mediaType) int {
+	if g.MaxDuration > 0 && g.MaxDuration < t.MaxDuration {
+		return g.MaxDuration
+	}
+	return t.MaxDuration
+}
+
+// guestMaxFileSize returns the size limit of a media type for guests, capped by the
+// server's maximum file size.
+func (p *Plugin) guestMaxFileSize(g guestRestrictions, t *mediaType) int64 {
+	limit := p.maxFileSize(t)
+	if g.MaxFileSize > 0 && g.MaxFileSize < limit {
+		return g.MaxFileSize
+	}
+	return limit
+}
+
+// isGuest reports whether guest restrictions apply to the user. Users are only
+// looked up when the restrictions differ from what members get.
+func (p *Plugin) isGuest(userID string) (bool, *clipError) {
+	if !p.getConfiguration().guestRestrictions().restricts() {
+		return false, nil
+	}
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.API.LogError("Failed to get user", "user_id", userID, "error", appErr.Error())
+		return false, &clipError{Status: http.StatusInternalServerError, Message: "Failed to get user"}
+	}
+	return user.IsGuest(), nil
+}
+
+// checkGuestDownload rejects requests for clip media that are not playback when
+// guests may not download original files. Browsers set Sec-Fetch-Dest to audio or
+// video for media elements only, and scripts in the page cannot set it, so the
+// browser's own download paths are refused. Other clients can send any header, so
+// this is a hurdle for the browser UI, not access control: a guest who can play a
+// clip can always save its bytes.
+func (p *Plugin) checkGuestDownload(userID string, r *http.Request) *clipError {
+	if p.getConfiguration().guestRestrictions().Downloads {
+		return nil
+	}
+	guest, clipErr := p.isGuest(userID)
+	if clipErr != nil || !guest {
+		return clipErr
+	}
+	switch r.Header.Get("Sec-Fetch-Dest") {
+	case "audio", "video":
+		return nil
+	}
+	return &clipError{Status: http.StatusForbidden, Message: "Guests are not allowed to download clips"}
+}
+
+// guestTypeDenied is the error for media guests may not send.
+func guestTypeDenied(t *mediaType) *clipError {
+	return &clipError{Status: http.StatusForbidden, Message: fmt.Sprintf("Guests are not allowed to send %s clips", t.Label), Retryable: true}
+}
+
+// checkGuestMedia checks media sent by a user against the guest restrictions.
+func (p *Plugin) checkGuestMedia(userID string, media []*clipMedia) *clipError {
+	guest, clipErr := p.isGuest(userID)
+	if clipErr != nil || !guest {
+		return clipErr
+	}
+
+	restrictions := p.getConfiguration().guestRestrictions()
+	for _, m := range media {
+		if !restrictions.allows(m.Type) {
+			return guestTypeDenied(m.Type)
+		}
+		if maxFileSize := p.guestMaxFileSize(restrictions, m.Type); m.File != nil && m.File.Size > maxFileSize {
+			return &clipError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("File size exceeds maximum allowed (%d MB)", maxFileSize/(1024*1024))}
+		}
+		if duration, err := strconv.Atoi(m.Duration); err == nil && duration > restrictions.maxDuration(m.Type) {
+			return &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Duration exceeds maximum allowed (%d seconds)", restrictions.maxDuration(m.Type))}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// testGuestConfig lets guests send voice clips of up to 60 seconds and 1 MB only.
+func testGuestConfig() *configuration {
+	return &configuration{
+		GuestVoiceClips:  true,
+		GuestVideoClips:  false,
+		GuestMaxDuration: 60,
+		GuestMaxFileSize: 1,
+	}
+}
+
+func newGuestPlugin(api *plugintest.API, config *configuration) *Plugin {
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(config)
+	api.On("GetUser", "guest123").Return(&model.User{Id: "guest123", Roles: model.SystemGuestRoleId, Locale: "en"}, nil).Maybe()
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Roles: model.SystemUserRoleId, Locale: "en"}, nil).Maybe()
+	return plugin
+}
+
+func TestGuestRestrictions(t *testing.T) {
+	config := &configuration{GuestVoiceClips: true, GuestVideoClips: true, GuestShowTranscripts: true, GuestDownloadOriginals: true}
+	assert.False(t, config.guestRestrictions().restricts())
+
+	restrictions := testGuestConfig().guestRestrictions()
+	assert.True(t, restrictions.restricts())
+
+	registry := config.mediaTypes()
+	assert.True(t, restrictions.allows(registry.get("audio")))
+	assert.False(t, restrictions.allows(registry.get("video")))
+	assert.False(t, restrictions.allows(registry.get("screen")))
+	assert.Equal(t, 60, restrictions.maxDuration(registry.get("audio")))
+
+	// The guest limits only lower the limits of a media type.
+	restrictions.MaxDuration = 3600
+	assert.Equal(t, 300, restrictions.maxDuration(registry.get("audio")))
+}
+
+func TestIsGuest_Unrestricted(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	// With the default settings guests are not looked up.
+	guest, clipErr := plugin.isGuest("guest123")
+	assert.Nil(t, clipErr)
+	assert.False(t, guest)
+	api.AssertNotCalled(t, "GetUser", mock.Anything)
+}
+
+func TestHandleUpload_Guest(t *testing.T) {
+	tests := []struct {
+		name            string
+		field           string
+		size            int
+		duration        string
+		expectedStatus  int
+		expectedMessage string
+	}{
+		{"video", "video", 2048, "", http.StatusForbidden, "Guests are not allowed to send video clips"},
+		{"screen recording", "screen", 2048, "", http.StatusForbidden, "Guests are not allowed to send screen clips"},
+		{"too large", "audio", 2 * 1024 * 1024, "", http.StatusRequestEntityTooLarge, "File size exceeds maximum allowed (1 MB)"},
+		{"too long", "audio", 2048, "90", http.StatusBadRequest, "Duration exceeds maximum allowed (60 seconds)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := newGuestPlugin(api, testGuestConfig())
+			mockUploadAccess(api)
+			mockKVStore(api)
+			api.On("HasPermissionToChannel", "guest123", "channel123", model.PermissionCreatePost).Return(true)
+
+			data := append(testWebM(), make([]byte, tt.size-len(testWebM()))...)
+			fields := map[string]string{"channel_id": "channel123"}
+			if tt.duration != "" {
+				fields["duration"] = tt.duration
+			}
+			req := newUploadRequest(t, fields, tt.field, data)
+			req.Header.Set("Mattermost-User-Id", "guest123")
+			w := httptest.NewRecorder()
+			plugin.ServeHTTP(nil, w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Result().StatusCode)
+			assert.Contains(t, w.Body.String(), tt.expectedMessage)
+			api.AssertNotCalled(t, "UploadFile", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestHandleCreateSession_Guest(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := newGuestPlugin(api, testGuestConfig())
+	mockUploadAccess(api)
+	mockKVStore(api)
+	api.On("HasPermissionToChannel", mock.Anything, "channel123", model.PermissionCreatePost).Return(true)
+
+	createSession := func(userID, mediaType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, sessionsPath, strings.NewReader(`{"channel_id":"channel123","type":"`+mediaType+`"}`))
+		req.Header.Set("Mattermost-User-Id", userID)
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, req)
+		return w
+	}
+
+	w := createSession("guest123", "audio")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var body struct {
+		MaxDuration int   `json:"max_duration"`
+		MaxFileSize int64 `json:"max_file_size"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Equal(t, 60, body.MaxDuration)
+	assert.Equal(t, int64(1024*1024), body.MaxFileSize)
+
+	w = createSession("guest123", "video")
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "Guests are not allowed to send video clips")
+
+	// Members keep the limits of the media type.
+	w = createSession("user123", "video")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Equal(t, 120, body.MaxDuration)
+}
+
+func TestExecuteCommand_Guest(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := newGuestPlugin(api, testGuestConfig())
+	api.On("SendEphemeralPost", "guest123", mock.AnythingOfType("*model.Post")).Return(nil)
+
+	resp, appErr := plugin.ExecuteCommand(nil, &model.CommandArgs{Command: "/video", UserId: "guest123", ChannelId: "channel123"})
+	assert.Nil(t, appErr)
+	assert.NotNil(t, resp)
+	api.AssertCalled(t, "SendEphemeralPost", "guest123", mock.MatchedBy(func(post *model.Post) bool {
+		return post.Message == "🚫 You are not allowed to send video messages."
+	}))
+	api.AssertNotCalled(t, "PublishWebSocketEvent", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestHandleConfig_Guest(t *testing.T) {
+	api := &plugintest.API{}
+	config := testGuestConfig()
+	config.GuestDownloadOriginals = false
+	config.GuestShowTranscripts = true
+	plugin := newGuestPlugin(api, config)
+	mockUploadAccess(api)
+
+	getConfig := func(userID string) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/config", nil)
+		req.Header.Set("Mattermost-User-Id", userID)
+		w := httptest.NewRecorder()
+		plugin.handleConfig(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+	mediaType := func(response map[string]interface{}, name string) map[string]interface{} {
+		for _, t := range response["media_types"].([]interface{}) {
+			if t.(map[string]interface{})["name"] == name {
+				return t.(map[string]interface{})
+			}
+		}
+		return nil
+	}
+
+	response := getConfig("guest123")
+	assert.Equal(t, false, response["can_download"])
+	assert.Equal(t, true, response["can_view_transcripts"])
+	audio := mediaType(response, "audio")
+	assert.Equal(t, true, audio["allowed"])
+	assert.Equal(t, float64(60), audio["max_duration"])
+	assert.Equal(t, float64(1), audio["max_file_size"])
+	video := mediaType(response, "video")
+	assert.Equal(t, false, video["allowed"])
+	assert.Equal(t, "Guests are not allowed to send video clips", video["unavailable_reason"])
+
+	response = getConfig("user123")
+	assert.Equal(t, true, response["can_download"])
+	assert.Equal(t, true, mediaType(response, "video")["allowed"])
+	assert.Equal(t, float64(300), mediaType(response, "audio")["max_duration"])
+}
+
+func TestHandleConfig_GuestLookupFails(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(testGuestConfig())
+	api.On("GetUser", "user123").Return(nil, model.NewAppError("GetUser", "store.error", nil, "", http.StatusInternalServerError))
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	// Guest limits are not known, so members' limits must not be reported instead.
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/config", nil)
+	req.Header.Set("Mattermost-User-Id", "user123")
+	w := httptest.NewRecorder()
+	plugin.handleConfig(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+}
+
+func TestHandleMedia_Guest(t *testing.T) {
+	api := &plugintest.API{}
+	config := testGuestConfig()
+	config.GuestDownloadOriginals = false
+	config.EncryptionMasterKey = testMasterKey
+	keys, err := config.loadEncryptionKeys()
+	require.NoError(t, err)
+	config.encryption = keys
+	plugin := newGuestPlugin(api, config)
+	mockKVStore(api)
+
+	encrypted, err := plugin.encryptClipData(keys, "channel123", testWebM())
+	require.NoError(t, err)
+	fileID := model.NewId()
+	api.On("GetFileInfo", fileID).Return(&model.FileInfo{Id: fileID, ChannelId: "channel123", Name: "voice_clip_1700000000.webm.enc"}, nil)
+	api.On("GetFile", fileID).Return(encrypted, nil)
+	api.On("GetChannelMember", "channel123", mock.Anything).Return(&model.ChannelMember{ChannelId: "channel123"}, nil)
+
+	get := func(userID, dest string) int {
+		req := httptest.NewRequest(http.MethodGet, mediaBasePath+"/"+fileID, nil)
+		req.Header.Set("Mattermost-User-Id", userID)
+		if dest != "" {
+			req.Header.Set("Sec-Fetch-Dest", dest)
+		}
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, req)
+		return w.Result().StatusCode
+	}
+
+	// Guests can play clips but not open or fetch the file itself.
+	assert.Equal(t, http.StatusOK, get("guest123", "audio"))
+	assert.Equal(t, http.StatusOK, get("guest123", "video"))
+	assert.Equal(t, http.StatusForbidden, get("guest123", "document"))
+	assert.Equal(t, http.StatusForbidden, get("guest123", "empty"))
+	assert.Equal(t, http.StatusForbidden, get("guest123", ""))
+
+	assert.Equal(t, http.StatusOK, get("user123", ""))
+	assert.Equal(t, http.StatusOK, get("user123", "document"))
+}
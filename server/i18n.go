@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// defaultLocale is used when neither the user nor the server has a supported locale.
+const defaultLocale = "en"
+
+// templateAnyLocale is the MessageTemplates entry used for locales without their own.
+const templateAnyLocale = "*"
+
+// serverTranslations holds the server-generated texts in the languages the webapp
+// ships, keyed by language and then by message key.
+var serverTranslations = map[string]map[string]string{
+	"en": {
+		"post.audio":                 "🎤 Voice message",
+		"post.video":                 "📹 Video message",
+		"post.screen":                "🖥️ Screen recording",
+		"command.voice.name":         "Voice Message",
+		"command.voice.description":  "Record and send a voice message",
+		"command.voice.autocomplete": "Open voice message recorder",
+		"command.voice.hint":         "🎤 Click the microphone button in the channel header to record a voice message, or wait for the recorder to open automatically.",
+		"command.voice.denied":       "🚫 You are not allowed to send voice messages.",
+		"command.video.name":         "Video Message",
+		"command.video.description":  "Record and send a video message",
+		"command.video.autocomplete": "Open video message recorder",
+		"command.video.hint":         "📹 Click the video button in the channel header to record a video message, or wait for the recorder to open automatically.",
+		"command.video.denied":       "🚫 You are not allowed to send video messages.",
+		"recording.recovered":        "Your recording in ~{channel} was interrupted. We saved what was recorded as a draft.",
+		"recording.send":             "Send",
+		"recording.discard":          "Discard",
+		"recording.sent":             "Your recovered recording was sent.",
+		"recording.discarded":        "Your recovered recording was discarded.",
+		"quota.warning.user":         "You have used {percent}% of your clip storage quota ({used} MB of {quota} MB). Delete clips you no longer need to free up space.",
+		"quota.warning.team":         "This team has used {percent}% of its clip storage quota ({used} MB of {quota} MB). Delete clips you no longer need to free up space.",
+	},
+	"ru": {
+		"post.audio":                 "🎤 Голосовое сообщение",
+		"post.video":                 "📹 Видеосообщение",
+		"post.screen":                "🖥️ Запись экрана",
+		"command.voice.name":         "Голосовое сообщение",
+		"command.voice.description":  "Записать и отправить голосовое сообщение",
+		"command.voice.autocomplete": "Открыть запись голосового сообщения",
+		"command.voice.hint":         "🎤 Нажмите кнопку микрофона в заголовке канала, чтобы записать голосовое сообщение, или дождитесь автоматического открытия записи.",
+		"command.voice.denied":       "🚫 Вам не разрешено отправлять голосовые сообщения.",
+		"command.video.name":         "Видеосообщение",
+		"command.video.description":  "Записать и отправить видеосообщение",
+		"command.video.autocomplete": "Открыть запись видеосообщения",
+		"command.video.hint":         "📹 Нажмите кнопку видео в заголовке канала, чтобы записать видеосообщение, или дождитесь автоматического открытия записи.",
+		"command.video.denied":       "🚫 Вам не разрешено отправлять видеосообщения.",
+		"recording.recovered":        "Ваша запись в ~{channel} была прервана. Записанное сохранено как черновик.",
+		"recording.send":             "Отправить",
+		"recording.discard":          "Удалить",
+		"recording.sent":             "Восстановленная запись отправлена.",
+		"recording.discarded":        "Восстановленная запись удалена.",
+		"quota.warning.user":         "Вы использовали {percent}% своей квоты хранилища клипов ({used} МБ из {quota} МБ). Удалите ненужные клипы, чтобы освободить место.",
+		"quota.warning.team":         "Эта команда использовала {percent}% своей квоты хранилища клипов ({used} МБ из {quota} МБ). Удалите ненужные клипы, чтобы освободить место.",
+	},
+	"de": {
+		"post.audio":                 "🎤 Sprachnachricht",
+		"post.video":                 "📹 Videonachricht",
+		"post.screen":                "🖥️ Bildschirmaufnahme",
+		"command.voice.name":         "Sprachnachricht",
+		"command.voice.description":  "Sprachnachricht aufnehmen und senden",
+		"command.voice.autocomplete": "Sprachnachrichten-Rekorder öffnen",
+		"command.voice.hint":         "🎤 Klicke auf das Mikrofon in der Kanalkopfzeile, um eine Sprachnachricht aufzunehmen, oder warte, bis sich der Rekorder automatisch öffnet.",
+		"command.voice.denied":       "🚫 Du darfst keine Sprachnachrichten senden.",
+		"command.video.name":         "Videonachricht",
+		"command.video.description":  "Videonachricht aufnehmen und senden",
+		"command.video.autocomplete": "Videonachrichten-Rekorder öffnen",
+		"command.video.hint":         "📹 Klicke auf die Video-Schaltfläche in der Kanalkopfzeile, um eine Videonachricht aufzunehmen, oder warte, bis sich der Rekorder automatisch öffnet.",
+		"command.video.denied":       "🚫 Du darfst keine Videonachrichten senden.",
+		"recording.recovered":        "Deine Aufnahme in ~{channel} wurde unterbrochen. Das Aufgenommene wurde als Entwurf gespeichert.",
+		"recording.send":             "Senden",
+		"recording.discard":          "Verwerfen",
+		"recording.sent":             "Deine wiederhergestellte Aufnahme wurde gesendet.",
+		"recording.discarded":        "Deine wiederhergestellte Aufnahme wurde verworfen.",
+		"quota.warning.user":         "Du hast {percent}% deines Clip-Speicherkontingents belegt ({used} MB von {quota} MB). Lösche Clips, die du nicht mehr brauchst, um Platz zu schaffen.",
+		"quota.warning.team":         "Dieses Team hat {percent}% seines Clip-Speicherkontingents belegt ({used} MB von {quota} MB). Lösche Clips, die du nicht mehr brauchst, um Platz zu schaffen.",
+	},
+	"fr": {
+		"post.audio":                 "🎤 Message vocal",
+		"post.video":                 "📹 Message vidéo",
+		"post.screen":                "🖥️ Enregistrement d'écran",
+		"command.voice.name":         "Message vocal",
+		"command.voice.description":  "Enregistrer et envoyer un message vocal",
+		"command.voice.autocomplete": "Ouvrir l'enregistreur de messages vocaux",
+		"command.voice.hint":         "🎤 Cliquez sur le bouton micro dans l'en-tête du canal pour enregistrer un message vocal, ou attendez que l'enregistreur s'ouvre automatiquement.",
+		"command.voice.denied":       "🚫 Vous n'êtes pas autorisé à envoyer des messages vocaux.",
+		"command.video.name":         "Message vidéo",
+		"command.video.description":  "Enregistrer et envoyer un message vidéo",
+		"command.video.autocomplete": "Ouvrir l'enregistreur de messages vidéo",
+		"command.video.hint":         "📹 Cliquez sur le bouton vidéo dans l'en-tête du canal pour enregistrer un message vidéo, ou attendez que l'enregistreur s'ouvre automatiquement.",
+		"command.video.denied":       "🚫 Vous n'êtes pas autorisé à envoyer des messages vidéo.",
+		"recording.recovered":        "Votre enregistrement dans ~{channel} a été interrompu. Ce qui a été enregistré a été sauvegardé comme brouillon.",
+		"recording.send":             "Envoyer",
+		"recording.discard":          "Supprimer",
+		"recording.sent":             "Votre enregistrement récupéré a été envoyé.",
+		"recording.discarded":        "Votre enregistrement récupéré a été supprimé.",
+		"quota.warning.user":         "Vous avez utilisé {percent} % de votre quota de stockage de clips ({used} Mo sur {quota} Mo). Supprimez les clips dont vous n'avez plus besoin pour libérer de l'espace.",
+		"quota.warning.team":         "Cette équipe a utilisé {percent} % de son quota de stockage de clips ({used} Mo sur {quota} Mo). Supprimez les clips dont vous n'avez plus besoin pour libérer de l'espace.",
+	},
+	"es": {
+		"post.audio":                 "🎤 Mensaje de voz",
+		"post.video":                 "📹 Mensaje de video",
+		"post.screen":                "🖥️ Grabación de pantalla",
+		"command.voice.name":         "Mensaje de voz",
+		"command.voice.description":  "Grabar y enviar un mensaje de voz",
+		"command.voice.autocomplete": "Abrir la grabadora de mensajes de voz",
+		"command.voice.hint":         "🎤 Haga clic en el botón del micrófono en el encabezado del canal para grabar un mensaje de voz, o espere a que la grabadora se abra automáticamente.",
+		"command.voice.denied":       "🚫 No tiene permiso para enviar mensajes de voz.",
+		"command.video.name":         "Mensaje de video",
+		"command.video.description":  "Grabar y enviar un mensaje de video",
+		"command.video.autocomplete": "Abrir la grabadora de mensajes de video",
+		"command.video.hint":         "📹 Haga clic en el botón de video en el encabezado del canal para grabar un mensaje de video, o espere a que la grabadora se abra automáticamente.",
+		"command.video.denied":       "🚫 No tiene permiso para enviar mensajes de video.",
+		"recording.recovered":        "Su grabación en ~{channel} se interrumpió. Lo grabado se guardó como borrador.",
+		"recording.send":             "Enviar",
+		"recording.discard":          "Descartar",
+		"recording.sent":             "Su grabación recuperada se envió.",
+		"recording.discarded":        "Su grabación recuperada se descartó.",
+		"quota.warning.user":         "Ha usado el {percent}% de su cuota de almacenamiento de clips ({used} MB de {quota} MB). Elimine los clips que ya no necesite para liberar espacio.",
+		"quota.warning.team":         "Este equipo ha usado el {percent}% de su cuota de almacenamiento de clips ({used} MB de {quota} MB). Elimine los clips que ya no necesite para liberar espacio.",
+	},
+	"pt": {
+		"post.audio":                 "🎤 Mensagem de voz",
+		"post.video":                 "📹 Mensagem de vídeo",
+		"post.screen":                "🖥️ Gravação de tela",
+		"command.voice.name":         "Mensagem de voz",
+		"command.voice.description":  "Gravar e enviar uma mensagem de voz",
+		"command.voice.autocomplete": "Abrir o gravador de mensagens de voz",
+		"command.voice.hint":         "🎤 Clique no botão do microfone no cabeçalho do canal para gravar uma mensagem de voz, ou aguarde o gravador abrir automaticamente.",
+		"command.voice.denied":       "🚫 Você não tem permissão para enviar mensagens de voz.",
+		"command.video.name":         "Mensagem de vídeo",
+		"command.video.description":  "Gravar e enviar uma mensagem de vídeo",
+		"command.video.autocomplete": "Abrir o gravador de mensagens de vídeo",
+		"command.video.hint":         "📹 Clique no botão de vídeo no cabeçalho do canal para gravar uma mensagem de vídeo, ou aguarde o gravador abrir automaticamente.",
+		"command.video.denied":       "🚫 Você não tem permissão para enviar mensagens de vídeo.",
+		"recording.recovered":        "Sua gravação em ~{channel} foi interrompida. O que foi gravado foi salvo como rascunho.",
+		"recording.send":             "Enviar",
+		"recording.discard":          "Descartar",
+		"recording.sent":             "Sua gravação recuperada foi enviada.",
+		"recording.discarded":        "Sua gravação recuperada foi descartada.",
+		"quota.warning.user":         "Você usou {percent}% da sua cota de armazenamento de clipes ({used} MB de {quota} MB). Exclua os clipes de que não precisa mais para liberar espaço.",
+		"quota.warning.team":         "Esta equipe usou {percent}% da sua cota de armazenamento de clipes ({used} MB de {quota} MB). Exclua os clipes de que não precisa mais para liberar espaço.",
+	},
+	"zh": {
+		"post.audio":                 "🎤 语音消息",
+		"post.video":                 "📹 视频消息",
+		"post.screen":                "🖥️ 屏幕录制",
+		"command.voice.name":         "语音消息",
+		"command.voice.description":  "录制并发送语音消息",
+		"command.voice.autocomplete": "打开语音消息录制器",
+		"command.voice.hint":         "🎤 点击频道标题中的麦克风按钮录制语音消息，或等待录制器自动打开。",
+		"command.voice.denied":       "🚫 您无权发送语音消息。",
+		"command.video.name":         "视频消息",
+		"command.video.description":  "录制并发送视频消息",
+		"command.video.autocomplete": "打开视频消息录制器",
+		"command.video.hint":         "📹 点击频道标题中的视频按钮录制视频消息，或等待录制器自动打开。",
+		"command.video.denied":       "🚫 您无权发送视频消息。",
+		"recording.recovered":        "您在 ~{channel} 中的录制已中断。已录制的内容已保存为草稿。",
+		"recording.send":             "发送",
+		"recording.discard":          "丢弃",
+		"recording.sent":             "您恢复的录制已发送。",
+		"recording.discarded":        "您恢复的录制已丢弃。",
+		"quota.warning.user":         "您已使用片段存储配额的 {percent}%（{used} MB / {quota} MB）。请删除不再需要的片段以释放空间。",
+		"quota.warning.team":         "此团队已使用片段存储配额的 {percent}%（{used} MB / {quota} MB）。请删除不再需要的片段以释放空间。",
+	},
+	"ja": {
+		"post.audio":                 "🎤 音声メッセージ",
+		"post.video":                 "📹 ビデオメッセージ",
+		"post.screen":                "🖥️ 画面録画",
+		"command.voice.name":         "音声メッセージ",
+		"command.voice.description":  "音声メッセージを録音して送信",
+		"command.voice.autocomplete": "音声メッセージレコーダーを開く",
+		"command.voice.hint":         "🎤 チャンネルヘッダーのマイクボタンをクリックして音声メッセージを録音するか、レコーダーが自動的に開くまでお待ちください。",
+		"command.voice.denied":       "🚫 音声メッセージを送信する権限がありません。",
+		"command.video.name":         "ビデオメッセージ",
+		"command.video.description":  "ビデオメッセージを録画して送信",
+		"command.video.autocomplete": "ビデオメッセージレコーダーを開く",
+		"command.video.hint":         "📹 チャンネルヘッダーのビデオボタンをクリックしてビデオメッセージを録画するか、レコーダーが自動的に開くまでお待ちください。",
+		"command.video.denied":       "🚫 ビデオメッセージを送信する権限がありません。",
+		"recording.recovered":        "~{channel} での録音が中断されました。録音された内容は下書きとして保存されました。",
+		"recording.send":             "送信",
+		"recording.discard":          "破棄",
+		"recording.sent":             "復元された録音を送信しました。",
+		"recording.discarded":        "復元された録音を破棄しました。",
+		"quota.warning.user":         "クリップのストレージ容量の {percent}% を使用しています（{used} MB / {quota} MB）。不要なクリップを削除して空き容量を確保してください。",
+		"quota.warning.team":         "このチームはクリップのストレージ容量の {percent}% を使用しています（{used} MB / {quota} MB）。不要なクリップを削除して空き容量を確保してください。",
+	},
+	"ko": {
+		"post.audio":                 "🎤 음성 메시지",
+		"post.video":                 "📹 영상 메시지",
+		"post.screen":                "🖥️ 화면 녹화",
+		"command.voice.name":         "음성 메시지",
+		"command.voice.description":  "음성 메시지 녹음 및 전송",
+		"command.voice.autocomplete": "음성 메시지 녹음기 열기",
+		"command.voice.hint":         "🎤 채널 헤더의 마이크 버튼을 클릭하여 음성 메시지를 녹음하거나 녹음기가 자동으로 열릴 때까지 기다리세요.",
+		"command.voice.denied":       "🚫 음성 메시지를 보낼 권한이 없습니다.",
+		"command.video.name":         "영상 메시지",
+		"command.video.description":  "영상 메시지 녹화 및 전송",
+		"command.video.autocomplete": "영상 메시지 녹화기 열기",
+		"command.video.hint":         "📹 채널 헤더의 비디오 버튼을 클릭하여 영상 메시지를 녹화하거나 녹화기가 자동으로 열릴 때까지 기다리세요.",
+		"command.video.denied":       "🚫 영상 메시지를 보낼 권한이 없습니다.",
+		"recording.recovered":        "~{channel}에서의 녹음이 중단되었습니다. 녹음된 내용은 임시 저장되었습니다.",
+		"recording.send":             "보내기",
+		"recording.discard":          "삭제",
+		"recording.sent":             "복구된 녹음을 보냈습니다.",
+		"recording.discarded":        "복구된 녹음을 삭제했습니다.",
+		"quota.warning.user":         "클립 저장 공간 할당량의 {percent}%를 사용했습니다({used} MB / {quota} MB). 더 이상 필요 없는 클립을 삭제하여 공간을 확보하세요.",
+		"quota.warning.team":         "이 팀은 클립 저장 공간 할당량의 {percent}%를 사용했습니다({used} MB / {quota} MB). 더 이상 필요 없는 클립을 삭제하여 공간을 확보하세요.",
+	},
+	"it": {
+		"post.audio":                 "🎤 Messaggio vocale",
+		"post.video":                 "📹 Messaggio video",
+		"post.screen":                "🖥️ Registrazione dello schermo",
+		"command.voice.name":         "Messaggio vocale",
+		"command.voice.description":  "Registra e invia un messaggio vocale",
+		"command.voice.autocomplete": "Apri il registratore di messaggi vocali",
+		"command.voice.hint":         "🎤 Fai clic sul pulsante del microfono nell'intestazione del canale per registrare un messaggio vocale, oppure attendi che il registratore si apra automaticamente.",
+		"command.voice.denied":       "🚫 Non sei autorizzato a inviare messaggi vocali.",
+		"command.video.name":         "Messaggio video",
+		"command.video.description":  "Registra e invia un messaggio video",
+		"command.video.autocomplete": "Apri il registratore di messaggi video",
+		"command.video.hint":         "📹 Fai clic sul pulsante video nell'intestazione del canale per registrare un messaggio video, oppure attendi che il registratore si apra automaticamente.",
+		"command.video.denied":       "🚫 Non sei autorizzato a inviare messaggi video.",
+		"recording.recovered":        "La tua registrazione in ~{channel} è stata interrotta. Quanto registrato è stato salvato come bozza.",
+		"recording.send":             "Invia",
+		"recording.discard":          "Scarta",
+		"recording.sent":             "La tua registrazione recuperata è stata inviata.",
+		"recording.discarded":        "La tua registrazione recuperata è stata scartata.",
+		"quota.warning.user":         "Hai usato il {percent}% della tua quota di archiviazione delle clip ({used} MB su {quota} MB). Elimina le clip che non ti servono più per liberare spazio.",
+		"quota.warning.team":         "Questo team ha usato il {percent}% della sua quota di archiviazione delle clip ({used} MB su {quota} MB). Elimina le clip che non ti servono più per liberare spazio.",
+	},
+	"nl": {
+		"post.audio":                 "🎤 Spraakbericht",
+		"post.video":                 "📹 Videobericht",
+		"post.screen":                "🖥️ Schermopname",
+		"command.voice.name":         "Spraakbericht",
+		"command.voice.description":  "Een spraakbericht opnemen en versturen",
+		"command.voice.autocomplete": "Spraakberichtrecorder openen",
+		"command.voice.hint":         "🎤 Klik op de microfoonknop in de kanaalkop om een spraakbericht op te nemen, of wacht tot de recorder automatisch opent.",
+		"command.voice.denied":       "🚫 Je mag geen spraakberichten versturen.",
+		"command.video.name":         "Videobericht",
+		"command.video.description":  "Een videobericht opnemen en versturen",
+		"command.video.autocomplete": "Videoberichtrecorder openen",
+		"command.video.hint":         "📹 Klik op de videoknop in de kanaalkop om een videobericht op te nemen, of wacht tot de recorder automatisch opent.",
+		"command.video.denied":       "🚫 Je mag geen videoberichten versturen.",
+		"recording.recovered":        "Je opname in ~{channel} is onderbroken. Wat is opgenomen, is als concept opgeslagen.",
+		"recording.send":             "Versturen",
+		"recording.discard":          "Verwijderen",
+		"recording.sent":             "Je herstelde opname is verstuurd.",
+		"recording.discarded":        "Je herstelde opname is verwijderd.",
+		"quota.warning.user":         "Je hebt {percent}% van je opslagquotum voor clips gebruikt ({used} MB van {quota} MB). Verwijder clips die je niet meer nodig hebt om ruimte vrij te maken.",
+		"quota.warning.team":         "Dit team heeft {percent}% van zijn opslagquotum voor clips gebruikt ({used} MB van {quota} MB). Verwijder clips die je niet meer nodig hebt om ruimte vrij te maken.",
+	},
+	"pl": {
+		"post.audio":                 "🎤 Wiadomość głosowa",
+		"post.video":                 "📹 Wiadomość wideo",
+		"post.screen":                "🖥️ Nagranie ekranu",
+		"command.voice.name":         "Wiadomość głosowa",
+		"command.voice.description":  "Nagraj i wyślij wiadomość głosową",
+		"command.voice.autocomplete": "Otwórz rejestrator wiadomości głosowych",
+		"command.voice.hint":         "🎤 Kliknij przycisk mikrofonu w nagłówku kanału, aby nagrać wiadomość głosową, lub poczekaj, aż rejestrator otworzy się automatycznie.",
+		"command.voice.denied":       "🚫 Nie możesz wysyłać wiadomości głosowych.",
+		"command.video.name":         "Wiadomość wideo",
+		"command.video.description":  "Nagraj i wyślij wiadomość wideo",
+		"command.video.autocomplete": "Otwórz rejestrator wiadomości wideo",
+		"command.video.hint":         "📹 Kliknij przycisk wideo w nagłówku kanału, aby nagrać wiadomość wideo, lub poczekaj, aż rejestrator otworzy się automatycznie.",
+		"command.video.denied":       "🚫 Nie możesz wysyłać wiadomości wideo.",
+		"recording.recovered":        "Twoje nagranie w ~{channel} zostało przerwane. Nagrany materiał zapisano jako wersję roboczą.",
+		"recording.send":             "Wyślij",
+		"recording.discard":          "Odrzuć",
+		"recording.sent":             "Odzyskane nagranie zostało wysłane.",
+		"recording.discarded":        "Odzyskane nagranie zostało odrzucone.",
+		"quota.warning.user":         "Wykorzystano {percent}% Twojego limitu miejsca na klipy ({used} MB z {quota} MB). Usuń niepotrzebne klipy, aby zwolnić miejsce.",
+		"quota.warning.team":         "Ten zespół wykorzystał {percent}% swojego limitu miejsca na klipy ({used} MB z {quota} MB). Usuń niepotrzebne klipy, aby zwolnić miejsce.",
+	},
+}
+
+// localeCandidates returns the keys to look up for a Mattermost locale such as
+// "pt-BR": the locale itself, then its language.
+func localeCandidates(locale string) []string {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	candidates := []string{locale}
+	if language, _, found := strings.Cut(locale, "-"); found {
+		candidates = append(candidates, language)
+	}
+	return candidates
+}
+
+// translate returns the text for key in locale, falling back to English.
+func translate(locale, key string) string {
+	for _, candidate := range localeCandidates(locale) {
+		if text, ok := serverTranslations[candidate][key]; ok {
+			return text
+		}
+	}
+	return serverTranslations[defaultLocale][key]
+}
+
+// serverLocale returns the default locale of the server.
+func (p *Plugin) serverLocale() string {
+	if config := p.API.GetConfig(); config != nil && config.LocalizationSettings.DefaultServerLocale != nil && *config.LocalizationSettings.DefaultServerLocale != "" {
+		return *config.LocalizationSettings.DefaultServerLocale
+	}
+	return defaultLocale
+}
+
+// userLocale returns the locale of a user, or the server default.
+func (p *Plugin) userLocale(user *model.User) string {
+	if user != nil && user.Locale != "" {
+		return user.Locale
+	}
+	return p.serverLocale()
+}
+
+// getUserForText loads a user for localized text. Failures only cost the
+// localization, so they are logged and nil is returned.
+func (p *Plugin) getUserForText(userID string) *model.User {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get user", "user_id", userID, "error", appErr.Error())
+		return nil
+	}
+	return user
+}
+
+// loadMessageTemplates parses the MessageTemplates setting: a JSON object mapping a
+// locale, or "*" for any locale, to templates by media type name.
+func (c *configuration) loadMessageTemplates() (map[string]map[string]string, error) {
+	if strings.TrimSpace(c.MessageTemplates) == "" {
+		return nil, nil
+	}
+
+	var templates map[string]map[string]string
+	if err := json.Unmarshal([]byte(c.MessageTemplates), &templates); err != nil {
+		return nil, errors.Wrap(err, "failed to parse message templates")
+	}
+
+	normalized := make(map[string]map[string]string, len(templates))
+	for locale, byType := range templates {
+		normalized[localeCandidates(locale)[0]] = byType
+	}
+	return normalized, nil
+}
+
+// clipMessage returns the post text of a clip without a caption in the author's
+// locale: the admin template for the locale, its language or any locale if there is
+// one, otherwise the built-in translation.
+func (p *Plugin) clipMessage(t *mediaType, author *model.User, duration int) string {
+	config := p.getConfiguration()
+	locale := p.userLocale(author)
+
+	text := ""
+	for _, candidate := range append(localeCandidates(locale), templateAnyLocale) {
+		if template, ok := config.messageTemplates[candidate][t.Name]; ok {
+			text = template
+			break
+		}
+	}
+	if text == "" {
+		if text = translate(locale, "post."+t.Name); text == "" {
+			text = t.Message
+		}
+	}
+
+	authorName := ""
+	if author != nil {
+		authorName = author.Username
+	}
+	return strings.NewReplacer(
+		"{duration}", formatDuration(duration),
+		"{author}", authorName,
+		"{type}", t.Label,
+	).Replace(text)
+}
+
+// formatDuration formats seconds as m:ss, or h:mm:ss from one hour.
+func formatDuration(seconds int) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTranslations_Complete(t *testing.T) {
+	for language, texts := range serverTranslations {
+		for key := range serverTranslations[defaultLocale] {
+			assert.NotEmpty(t, texts[key], "%s is missing %s", language, key)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	assert.Equal(t, "🎤 Голосовое сообщение", translate("ru", "post.audio"))
+	assert.Equal(t, "🎤 Mensagem de voz", translate("pt-BR", "post.audio"))
+	assert.Equal(t, "🎤 语音消息", translate("zh_CN", "post.audio"))
+	assert.Equal(t, "🎤 Voice message", translate("sv", "post.audio"))
+	assert.Equal(t, "", translate("en", "post.podcast"))
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "0:00", formatDuration(0))
+	assert.Equal(t, "0:42", formatDuration(42))
+	assert.Equal(t, "10:05", formatDuration(605))
+	assert.Equal(t, "1:01:01", formatDuration(3661))
+}
+
+func TestClipMessage(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	config := &model.Config{}
+	config.SetDefaults()
+	api.On("GetConfig").Return(config)
+
+	api.On("LoadPluginConfiguration", mock.AnythingOfType("*main.configuration")).Run(func(args mock.Arguments) {
+		c := args.Get(0).(*configuration)
+		c.CustomMediaTypes = `[{"name": "podcast", "player": "audio", "message": "🎙️ Podcast", "max_duration": 60, "max_file_size": 10, "allowed_formats": "mp3"}]`
+		c.MessageTemplates = `{"en": {"audio": "🎤 Voice message ({duration})"}, "de": {"video": "📹 {author} hat ein Video geschickt"}, "*": {"screen": "🖥️ {type} ({duration})"}}`
+	}).Return(nil)
+	require.NoError(t, plugin.OnConfigurationChange())
+
+	mediaTypes := plugin.getConfiguration().mediaTypes()
+	english := &model.User{Username: "alice", Locale: "en"}
+	german := &model.User{Username: "bob", Locale: "de"}
+	russian := &model.User{Username: "ivan", Locale: "ru"}
+
+	tests := []struct {
+		name      string
+		mediaType string
+		author    *model.User
+		duration  int
+		expected  string
+	}{
+		{"template with duration", "audio", english, 42, "🎤 Voice message (0:42)"},
+		{"language without template", "audio", german, 42, "🎤 Sprachnachricht"},
+		{"template with author", "video", german, 10, "📹 bob hat ein Video geschickt"},
+		{"regional locale", "video", &model.User{Username: "carl", Locale: "de-AT"}, 10, "📹 carl hat ein Video geschickt"},
+		{"any locale template", "screen", russian, 125, "🖥️ screen (2:05)"},
+		{"built-in translation", "video", russian, 10, "📹 Видеосообщение"},
+		{"custom type", "podcast", russian, 10, "🎙️ Podcast"},
+		{"unknown author", "video", nil, 10, "📹 Video message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, plugin.clipMessage(mediaTypes.get(tt.mediaType), tt.author, tt.duration))
+		})
+	}
+}
+
+func TestLoadMessageTemplates_Invalid(t *testing.T) {
+	config := &configuration{MessageTemplates: `["not", "an", "object"]`}
+	_, err := config.loadMessageTemplates()
+	assert.Error(t, err)
+}
+
+func TestExecuteCommand_Localized(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Locale: "fr"}, nil)
+	api.On("SendEphemeralPost", "user123", mock.MatchedBy(func(post *model.Post) bool {
+		return post.Message == serverTranslations["fr"]["command.video.hint"]
+	})).Return(nil)
+	api.On("PublishWebSocketEvent", "open_video_recorder", mock.Anything, mock.Anything).Return()
+
+	_, appErr := plugin.ExecuteCommand(nil, &model.CommandArgs{Command: "/video", UserId: "user123", ChannelId: "channel123"})
+	require.Nil(t, appErr)
+	api.AssertExpectations(t)
+}
+
+func TestRegisterCommands_ServerLocale(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	config := &model.Config{}
+	config.SetDefaults()
+	*config.LocalizationSettings.DefaultServerLocale = "es"
+	api.On("GetConfig").Return(config)
+
+	var commands []*model.Command
+	api.On("RegisterCommand", mock.AnythingOfType("*model.Command")).Run(func(args mock.Arguments) {
+		commands = append(commands, args.Get(0).(*model.Command))
+	}).Return(nil)
+
+	require.NoError(t, plugin.registerCommands())
+	require.Len(t, commands, 2)
+	assert.Equal(t, "Grabar y enviar un mensaje de voz", commands[0].Description)
+	assert.Equal(t, "Abrir la grabadora de mensajes de video", commands[1].AutoCompleteDesc)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	idempotencyKeyPrefix = "idem_"
+
+	// maxIdempotencyKeyLength bounds the client-supplied Idempotency-Key header.
+	maxIdempotencyKeyLength = 255
+
+	// idempotencyPendingTTL is how long an in-flight request holds its key without
+	// refreshing it. It only matters if a node dies mid-request; normally the key is
+	// refreshed until it is updated or released.
+	idempotencyPendingTTL = 5 * time.Minute
+
+	idempotencyStatusPending   = "pending"
+	idempotencyStatusCompleted = "completed"
+)
+
+// idempotencyRefreshInterval is how often an in-flight request refreshes its key.
+var idempotencyRefreshInterval = idempotencyPendingTTL / 3
+
+// idempotencyRecord is what is remembered for an Idempotency-Key.
+type idempotencyRecord struct {
+	Status  string   `json:"status"`
+	PostID  string   `json:"post_id,omitempty"`
+	FileID  string   `json:"file_id,omitempty"`
+	FileIDs []string `json:"file_ids,omitempty"`
+	JobIDs  []string `json:"job_ids,omitempty"`
+
+	// Fingerprint identifies the request the key was used for, see uploadFingerprint.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// uploadFingerprint identifies an upload by its author, channel and media, so that
+// a key reused for a different upload is not answered with the earlier result.
+func uploadFingerprint(userID, channelID string, media []*clipMedia) string {
+	parts := []string{userID, channelID}
+	for _, m := range media {
+		parts = append(parts, fmt.Sprintf("%s:%d", m.Type.Name, m.File.Size))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// matches reports whether the record was stored for a request with fingerprint.
+// Records stored before fingerprints were kept match any request.
+func (r *idempotencyRecord) matches(fingerprint string) bool {
+	return r.Fingerprint == "" || r.Fingerprint == fingerprint
+}
+
+// idempotencyKVKey scopes the client key to the user and hashes it to fit the KV key
+// length limit.
+func idempotencyKVKey(userID, key string) string {
+	sum := sha256.Sum256([]byte(userID + ":" + key))
+	return idempotencyKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// claimIdempotencyKey reserves key for the current request. If the key was already
+// used, the stored record is returned instead and the caller must not process the
+// request again.
+func (p *Plugin) claimIdempotencyKey(userID, key string) (*idempotencyRecord, error) {
+	kvKey := idempotencyKVKey(userID, key)
+
+	pending, err := json.Marshal(&idempotencyRecord{Status: idempotencyStatusPending})
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		claimed, appErr := p.API.KVSetWithOptions(kvKey, pending, model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        nil,
+			ExpireInSeconds: int64(idempotencyPendingTTL.Seconds()),
+		})
+		if appErr != nil {
+			return nil, appErr
+		}
+		if claimed {
+			return nil, nil
+		}
+
+		data, appErr := p.API.KVGet(kvKey)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if data == nil {
+			// The previous holder released the key in the meantime.
+			continue
+		}
+
+		var record idempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, errors.Wrap(err, "failed to decode idempotency record")
+		}
+		return &record, nil
+	}
+
+	return nil, errors.New("failed to claim idempotency key")
+}
+
+// holdIdempotencyKey keeps the claim on key from expiring while a slow request is
+// still being processed. The returned function stops refreshing the claim.
+func (p *Plugin) holdIdempotencyKey(userID, key string) (stop func()) {
+	kvKey := idempotencyKVKey(userID, key)
+	pending, err := json.Marshal(&idempotencyRecord{Status: idempotencyStatusPending})
+	if err != nil {
+		p.API.LogWarn("Failed to refresh idempotency key", "user_id", userID, "error", err.Error())
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(idempotencyRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			// The claim is only extended while it is still pending.
+			if _, appErr := p.API.KVSetWithOptions(kvKey, pending, model.PluginKVSetOptions{
+				Atomic:          true,
+				OldValue:        pending,
+				ExpireInSeconds: int64(idempotencyPendingTTL.Seconds()),
+			}); appErr != nil {
+				p.API.LogWarn("Failed to refresh idempotency key", "user_id", userID, "error", appErr.Error())
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// completeIdempotencyKey remembers the result of a successful request for the
+// configured window, along with the fingerprint of the request.
+func (p *Plugin) completeIdempotencyKey(userID, key, fingerprint string, result *clipResult) error {
+	data, err := json.Marshal(&idempotencyRecord{
+		Status:      idempotencyStatusCompleted,
+		PostID:      result.Post.Id,
+		FileID:      result.FileInfo.Id,
+		FileIDs:     result.FileIDs,
+		JobIDs:      result.JobIDs,
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return err
+	}
+
+	window := p.getConfiguration().idempotencyWindow()
+	if appErr := p.API.KVSetWithExpiry(idempotencyKVKey(userID, key), data, int64(window.Seconds())); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// releaseIdempotencyKey forgets a key after a failed request so it can be retried.
+func (p *Plugin) releaseIdempotencyKey(userID, key string) {
+	if appErr := p.API.KVDelete(idempotencyKVKey(userID, key)); appErr != nil {
+		p.API.LogWarn("Failed to release idempotency key", "user_id", userID, "error", appErr.Error())
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleUpload_IdempotencyKey(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil).Once()
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil).Once()
+
+	fields := map[string]string{"channel_id": "channel123", "duration": "5"}
+
+	for i := 0; i < 2; i++ {
+		req := newUploadRequest(t, fields, "audio", testWebM())
+		addSession(t, plugin, req, "channel123", "audio")
+		req.Header.Set("Idempotency-Key", "retry-key")
+		w := httptest.NewRecorder()
+		plugin.handleUpload(w, req)
+
+		resp := w.Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, w.Body.String(), "post123")
+		assert.Equal(t, i == 1, resp.Header.Get("Idempotent-Replayed") == "true")
+	}
+
+	api.AssertNumberOfCalls(t, "UploadFile", 1)
+	api.AssertNumberOfCalls(t, "CreatePost", 1)
+}
+
+func TestHandleUpload_IdempotencyKeyReleasedOnFailure(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(false)
+
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM())
+	addSession(t, plugin, req, "channel123", "audio")
+	req.Header.Set("Idempotency-Key", "retry-key")
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	assert.Empty(t, store)
+}
+
+func TestClaimIdempotencyKey_InProgress(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockKVStore(api)
+
+	record, err := plugin.claimIdempotencyKey("user123", "key")
+	require.NoError(t, err)
+	assert.Nil(t, record)
+
+	record, err = plugin.claimIdempotencyKey("user123", "key")
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	assert.Equal(t, idempotencyStatusPending, record.Status)
+
+	// Keys are scoped per user.
+	record, err = plugin.claimIdempotencyKey("user456", "key")
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestHandleUpload_IdempotencyKeyDifferentUpload(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil).Once()
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil).Once()
+
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", data)
+		addSession(t, plugin, req, "channel123", "audio")
+		req.Header.Set("Idempotency-Key", "retry-key")
+		w := httptest.NewRecorder()
+		plugin.handleUpload(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, upload(testWebM()).Result().StatusCode)
+
+	// Reusing the key for another file is an error, not a replay.
+	w := upload(append(testWebM(), 0x00))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Result().StatusCode)
+	assert.Empty(t, w.Result().Header.Get("Idempotent-Replayed"))
+
+	api.AssertNumberOfCalls(t, "UploadFile", 1)
+	api.AssertNumberOfCalls(t, "CreatePost", 1)
+}
+
+func TestHoldIdempotencyKey(t *testing.T) {
+	interval := idempotencyRefreshInterval
+	idempotencyRefreshInterval = 10 * time.Millisecond
+	defer func() { idempotencyRefreshInterval = interval }()
+
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	// Count the refreshes, which replace the pending record with itself.
+	var lock sync.Mutex
+	refreshes := 0
+	api.On("KVSetWithOptions", idempotencyKVKey("user123", "key"), mock.Anything, mock.MatchedBy(func(options model.PluginKVSetOptions) bool {
+		return options.OldValue != nil
+	})).Run(func(mock.Arguments) {
+		lock.Lock()
+		defer lock.Unlock()
+		refreshes++
+	}).Return(true, nil)
+	mockKVStore(api)
+
+	record, err := plugin.claimIdempotencyKey("user123", "key")
+	require.NoError(t, err)
+	require.Nil(t, record)
+
+	stop := plugin.holdIdempotencyKey("user123", "key")
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return refreshes >= 2
+	}, time.Second, 5*time.Millisecond)
+	stop()
+
+	lock.Lock()
+	stopped := refreshes
+	lock.Unlock()
+	time.Sleep(5 * idempotencyRefreshInterval)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, stopped, refreshes)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// getIDList returns the list of ids stored at key. Lists of ids index the records of
+// a feature, so that jobs do not have to scan the whole KV store for them.
+func (p *Plugin) getIDList(key string) ([]string, error) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	var ids []string
+	if data != nil {
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s", key)
+		}
+	}
+	return ids, nil
+}
+
+// updateIDList atomically applies update to the list of ids stored at key.
+func (p *Plugin) updateIDList(key string, update func(ids []string) []string) error {
+	for attempt := 0; attempt < 10; attempt++ {
+		oldData, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return appErr
+		}
+
+		var ids []string
+		if oldData != nil {
+			if err := json.Unmarshal(oldData, &ids); err != nil {
+				return errors.Wrapf(err, "failed to decode %s", key)
+			}
+		}
+
+		newData, err := json.Marshal(update(ids))
+		if err != nil {
+			return err
+		}
+
+		saved, appErr := p.API.KVSetWithOptions(key, newData, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: oldData,
+		})
+		if appErr != nil {
+			return appErr
+		}
+		if saved {
+			return nil
+		}
+	}
+	return errors.Errorf("failed to update %s after concurrent modifications", key)
+}
+
+// addToIDList adds id to the list at key unless it is already there.
+func (p *Plugin) addToIDList(key, id string) error {
+	return p.updateIDList(key, func(ids []string) []string {
+		for _, existing := range ids {
+			if existing == id {
+				return ids
+			}
+		}
+		return append(ids, id)
+	})
+}
+
+// removeFromIDList removes the given ids from the list at key.
+func (p *Plugin) removeFromIDList(key string, remove ...string) error {
+	if len(remove) == 0 {
+		return nil
+	}
+	removed := make(map[string]bool, len(remove))
+	for _, id := range remove {
+		removed[id] = true
+	}
+	return p.updateIDList(key, func(ids []string) []string {
+		kept := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if !removed[id] {
+				kept = append(kept, id)
+			}
+		}
+		return kept
+	})
+}
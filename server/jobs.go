@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	jobsBasePath = "/api/v1/jobs"
+
+	jobKeyPrefix      = "job_"
+	jobQueueKey       = "jobqueue"
+	jobDeadLetterKey  = "jobdeadletter"
+	jobPollInterval   = 5 * time.Second
+	jobLease          = 5 * time.Minute
+	jobRetryBackoff   = 30 * time.Second
+	jobMaxAttempts    = 3
+	jobRecordExpiry   = 30 * 24 * time.Hour
+	maxDeadLetterSize = 1000
+
+	// postJobsLockTimeout bounds the wait for other jobs of the same post to
+	// update it.
+	postJobsLockTimeout = 30 * time.Second
+
+	jobStatusQueued    = "queued"
+	jobStatusRunning   = "running"
+	jobStatusCompleted = "completed"
+	jobStatusFailed    = "failed"
+
+	// jobTypeProbe reads the real duration from the media container.
+	jobTypeProbe = "probe"
+)
+
+// job is a unit of post-upload processing for a clip. Jobs are stored in the
+// plugin KV store so that any cluster node can pick them up.
+type job struct {
+	ID          string                 `json:"id"`
+	Type        string                 `json:"type"`
+	PostID      string                 `json:"post_id"`
+	FileID      string                 `json:"file_id"`
+	UserID      string                 `json:"user_id"`
+	ChannelID   string                 `json:"channel_id"`
+	PropsKey    string                 `json:"props_key"`
+	Format      string                 `json:"format"`
+	Status      string                 `json:"status"`
+	Progress    int                    `json:"progress"`
+	Attempts    int                    `json:"attempts"`
+	Error       string                 `json:"error,omitempty"`
+	Result      map[string]interface{} `json:"result,omitempty"`
+	CreatedAt   int64                  `json:"created_at"`
+	UpdatedAt   int64                  `json:"updated_at"`
+	NextRunAt   int64                  `json:"next_run_at"`
+	LeaseExpiry int64                  `json:"lease_expiry,omitempty"`
+}
+
+// jobHandler runs one job and returns the values to merge into the clip props.
+// progress may be called to report completion between 0 and 100.
+type jobHandler func(p *Plugin, j *job, progress func(int)) (map[string]interface{}, error)
+
+// jobHandlers maps job types to their implementation.
+var jobHandlers = map[string]jobHandler{
+	jobTypeProbe: runProbeJob,
+}
+
+func jobKey(id string) string {
+	return jobKeyPrefix + id
+}
+
+// jobQueue runs a pool of workers that process queued jobs.
+type jobQueue struct {
+	p      *Plugin
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startJobQueue starts the given number of workers.
+func (p *Plugin) startJobQueue(workers int) *jobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &jobQueue{
+		p:      p,
+		wake:   make(chan struct{}, 1),
+		cancel: cancel,
+	}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+	return q
+}
+
+// Stop stops the workers and waits for running jobs to finish.
+func (q *jobQueue) Stop() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Notify wakes up an idle worker.
+func (q *jobQueue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *jobQueue) work(ctx context.Context) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain the queue before going back to sleep.
+		for ctx.Err() == nil && q.p.runNextJob() {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// enqueueJobs creates queued jobs for a freshly created clip post.
+func (p *Plugin) enqueueJobs(jobs []*job) error {
+	now := model.GetMillis()
+	for _, j := range jobs {
+		j.Status = jobStatusQueued
+		j.CreatedAt = now
+		j.UpdatedAt = now
+		j.NextRunAt = now
+		if err := p.saveJob(j, nil); err != nil {
+			return err
+		}
+	}
+
+	err := p.updateIDList(jobQueueKey, func(ids []string) []string {
+		for _, j := range jobs {
+			ids = append(ids, j.ID)
+		}
+		return ids
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.jobQueue != nil {
+		p.jobQueue.Notify()
+	}
+	return nil
+}
+
+// runNextJob claims and runs one due job. It returns false when there was nothing
+// to do.
+func (p *Plugin) runNextJob() bool {
+	j, err := p.claimJob()
+	if err != nil {
+		p.API.LogError("Failed to claim job", "error", err.Error())
+		return false
+	}
+	if j == nil {
+		return false
+	}
+
+	p.runJob(j)
+	return true
+}
+
+// claimJob takes the lease on the first due job in the queue.
+func (p *Plugin) claimJob() (*job, error) {
+	ids, err := p.getIDList(jobQueueKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := model.GetMillis()
+	for _, id := range ids {
+		j, err := p.getJob(id)
+		if err != nil {
+			p.API.LogWarn("Failed to load job", "job_id", id, "error", err.Error())
+			continue
+		}
+		if j == nil {
+			// The record expired; drop it from the queue.
+			p.dequeueJob(id)
+			continue
+		}
+
+		due := j.Status == jobStatusQueued && j.NextRunAt <= now
+		abandoned := j.Status == jobStatusRunning && j.LeaseExpiry <= now
+		if !due && !abandoned {
+			continue
+		}
+
+		old := *j
+		j.Status = jobStatusRunning
+		j.Attempts++
+		j.UpdatedAt = now
+		j.LeaseExpiry = now + jobLease.Milliseconds()
+		if err := p.saveJob(j, &old); err != nil {
+			if errors.Is(err, errJobConflict) {
+				// Another worker got it first.
+				continue
+			}
+			return nil, err
+		}
+		return j, nil
+	}
+
+	return nil, nil
+}
+
+// runJob executes a claimed job and records the outcome, retrying with backoff and
+// moving the job to the dead-letter list after jobMaxAttempts failures.
+func (p *Plugin) runJob(j *job) {
+	handler, ok := jobHandlers[j.Type]
+	var result map[string]interface{}
+	var err error
+	if ok {
+		result, err = handler(p, j, func(progress int) {
+			p.updateJobProgress(j, progress)
+		})
+	} else {
+		err = errors.Errorf("unknown job type %s", j.Type)
+	}
+
+	old := *j
+	j.UpdatedAt = model.GetMillis()
+	j.LeaseExpiry = 0
+
+	if err == nil {
+		j.Status = jobStatusCompleted
+		j.Progress = 100
+		j.Error = ""
+		j.Result = result
+	} else if j.Attempts >= jobMaxAttempts || !ok {
+		p.API.LogError("Job failed permanently", "job_id", j.ID, "type", j.Type, "error", err.Error())
+		j.Status = jobStatusFailed
+		j.Error = err.Error()
+	} else {
+		p.API.LogWarn("Job failed, will retry", "job_id", j.ID, "type", j.Type, "attempt", j.Attempts, "error", err.Error())
+		j.Status = jobStatusQueued
+		j.Error = err.Error()
+		j.NextRunAt = j.UpdatedAt + jobRetryBackoff.Milliseconds()*int64(math.Pow(2, float64(j.Attempts-1)))
+	}
+
+	if saveErr := p.saveJob(j, &old); saveErr != nil {
+		p.API.LogError("Failed to save job", "job_id", j.ID, "error", saveErr.Error())
+		return
+	}
+	if j.Status == jobStatusQueued {
+		return
+	}
+
+	p.dequeueJob(j.ID)
+	if j.Status == jobStatusFailed {
+		if err := p.updateIDList(jobDeadLetterKey, func(ids []string) []string {
+			ids = append(ids, j.ID)
+			if len(ids) > maxDeadLetterSize {
+				ids = ids[len(ids)-maxDeadLetterSize:]
+			}
+			return ids
+		}); err != nil {
+			p.API.LogError("Failed to dead-letter job", "job_id", j.ID, "error", err.Error())
+		}
+	}
+
+	p.applyJobResult(j)
+
+	p.API.PublishWebSocketEvent("job_finished", map[string]interface{}{
+		"job_id":  j.ID,
+		"type":    j.Type,
+		"post_id": j.PostID,
+		"status":  j.Status,
+	}, &model.WebsocketBroadcast{
+		ChannelId: j.ChannelID,
+	})
+}
+
+// applyJobResult merges the job results into the clip props and clears the
+// processing flag once every job of the post has finished. Jobs of a post can
+// finish at the same time on different servers, so updates are serialized per post
+// and rebuilt from all of the post's job records: whichever update runs last sees
+// every result.
+func (p *Plugin) applyJobResult(j *job) {
+	mutex, err := cluster.NewMutex(p.API, postJobsLockKey(j.PostID))
+	if err != nil {
+		p.API.LogError("Failed to create post lock for job", "job_id", j.ID, "post_id", j.PostID, "error", err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), postJobsLockTimeout)
+	defer cancel()
+	if err := mutex.LockWithContext(ctx); err != nil {
+		p.API.LogError("Failed to lock post for job", "job_id", j.ID, "post_id", j.PostID, "error", err.Error())
+		return
+	}
+	defer mutex.Unlock()
+
+	post, appErr := p.API.GetPost(j.PostID)
+	if appErr != nil {
+		p.API.LogError("Failed to load post for job", "job_id", j.ID, "post_id", j.PostID, "error", appErr.Error())
+		return
+	}
+
+	props, ok := post.GetProp(j.PropsKey).(map[string]interface{})
+	if !ok {
+		return
+	}
+	// Results belong to the file entry of the job; the primary file, which comes
+	// first, also describes the post as a whole. Posts without file entries only
+	// have the primary file.
+	// The list stays a []interface{}, the only slice type gob knows, so that the
+	// post can be sent back over plugin RPC.
+	files := propList(props["files"])
+	if len(files) == 0 {
+		files = []interface{}{map[string]interface{}{"file_id": j.FileID}}
+	} else {
+		props["files"] = files
+	}
+
+	processing := false
+	for _, id := range propStrings(props["job_ids"]) {
+		other := j
+		if id != j.ID {
+			if other, err = p.getJob(id); err != nil || other == nil {
+				continue
+			}
+		}
+		switch other.Status {
+		case jobStatusQueued, jobStatusRunning:
+			processing = true
+		case jobStatusCompleted:
+			mergeJobResult(props, files, other)
+		}
+	}
+	props["processing"] = processing
+
+	post.AddProp(j.PropsKey, props)
+	if err := p.signClipPost(post, j.PropsKey); err != nil {
+		p.API.LogError("Failed to sign post with job result", "job_id", j.ID, "post_id", j.PostID, "error", err.Error())
+		return
+	}
+	if _, appErr := p.API.UpdatePost(post); appErr != nil {
+		p.API.LogError("Failed to update post with job result", "job_id", j.ID, "post_id", j.PostID, "error", appErr.Error())
+	}
+}
+
+// mergeJobResult copies the result of a completed job into the file entry of its
+// file and, for the primary file, into the clip props.
+func mergeJobResult(props map[string]interface{}, files []interface{}, j *job) {
+	for i, item := range files {
+		file, ok := item.(map[string]interface{})
+		if !ok || file["file_id"] != j.FileID {
+			continue
+		}
+		for key, value := range j.Result {
+			file[key] = value
+		}
+		if i > 0 {
+			return
+		}
+		for key, value := range j.Result {
+			props[key] = value
+		}
+		return
+	}
+}
+
+func postJobsLockKey(postID string) string {
+	return "post_jobs_" + postID
+}
+
+// propStrings returns a string list prop, which is a []interface{} once the post
+// has been through JSON.
+func propStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// propList returns a list prop as a []interface{}, the type it has once the post
+// has been through JSON or gob.
+func propList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return v
+	case []map[string]interface{}:
+		values := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			values = append(values, item)
+		}
+		return values
+	}
+	return nil
+}
+
+// propMaps returns a list of objects prop, which is a []interface{} once the post
+// has been through JSON.
+func propMaps(value interface{}) []map[string]interface{} {
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		return v
+	case []interface{}:
+		values := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			if m, ok := item.(map[string]interface{}); ok {
+				values = append(values, m)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (p *Plugin) updateJobProgress(j *job, progress int) {
+	old := *j
+	j.Progress = progress
+	j.UpdatedAt = model.GetMillis()
+	if err := p.saveJob(j, &old); err != nil {
+		p.API.LogWarn("Failed to save job progress", "job_id", j.ID, "error", err.Error())
+		*j = old
+	}
+}
+
+func (p *Plugin) dequeueJob(id string) {
+	err := p.updateIDList(jobQueueKey, func(ids []string) []string {
+		remaining := ids[:0]
+		for _, queued := range ids {
+			if queued != id {
+				remaining = append(remaining, queued)
+			}
+		}
+		return remaining
+	})
+	if err != nil {
+		p.API.LogError("Failed to remove job from queue", "job_id", id, "error", err.Error())
+	}
+}
+
+// handleJob reports the status of a job to users who can read its channel.
+func (p *Plugin) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	j, err := p.getJob(strings.Trim(strings.TrimPrefix(r.URL.Path, jobsBasePath), "/"))
+	if err != nil {
+		p.API.LogError("Failed to load job", "error", err.Error())
+		http.Error(w, "Failed to load job", http.StatusInternalServerError)
+		return
+	}
+	if j == nil || (j.UserID != userID && !p.API.HasPermissionToChannel(userID, j.ChannelID, model.PermissionReadChannel)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         j.ID,
+		"type":       j.Type,
+		"post_id":    j.PostID,
+		"status":     j.Status,
+		"progress":   j.Progress,
+		"attempts":   j.Attempts,
+		"error":      j.Error,
+		"created_at": j.CreatedAt,
+		"updated_at": j.UpdatedAt,
+	})
+}
+
+// errJobConflict is returned when a job changed between read and write.
+var errJobConflict = errors.New("job was modified concurrently")
+
+func (p *Plugin) getJob(id string) (*job, error) {
+	data, appErr := p.API.KVGet(jobKey(id))
+	if appErr != nil {
+		return nil, appErr
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	var j job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, errors.Wrap(err, "failed to decode job")
+	}
+	return &j, nil
+}
+
+// saveJob stores j, atomically replacing old when it is given.
+func (p *Plugin) saveJob(j, old *job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	options := model.PluginKVSetOptions{ExpireInSeconds: int64(jobRecordExpiry.Seconds())}
+	if old != nil {
+		oldData, err := json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		options.Atomic = true
+		options.OldValue = oldData
+	}
+
+	saved, appErr := p.API.KVSetWithOptions(jobKey(j.ID), data, options)
+	if appErr != nil {
+		return appErr
+	}
+	if !saved {
+		return errJobConflict
+	}
+	return nil
+}
+
+// runProbeJob replaces the client-declared duration with the one recorded in the
+// media container, when the container has it.
+func runProbeJob(p *Plugin, j *job, progress func(int)) (map[string]interface{}, error) {
+	data, err := p.readClipFile(j.FileID, j.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	progress(50)
+
+	seconds, ok := probeDuration(data, j.Format)
+	if !ok {
+		return map[string]interface{}{"duration_verified": false}, nil
+	}
+	return map[string]interface{}{
+		"duration":          int(math.Round(seconds)),
+		"duration_verified": true,
+	}, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newProbeJob() *job {
+	return &job{
+		ID:        model.NewId(),
+		Type:      jobTypeProbe,
+		PostID:    "post123",
+		FileID:    "file123",
+		UserID:    "user123",
+		ChannelID: "channel123",
+		PropsKey:  "voice_clip",
+		Format:    ".webm",
+	}
+}
+
+func TestJobs_ProbeUpdatesPost(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	store := mockKVStore(api)
+
+	j := newProbeJob()
+	post := &model.Post{Id: "post123", ChannelId: "channel123", Props: map[string]interface{}{
+		"voice_clip": map[string]interface{}{
+			"duration":   10,
+			"format":     ".webm",
+			"processing": true,
+			"job_ids":    []interface{}{j.ID},
+			"files":      []interface{}{map[string]interface{}{"file_id": "file123", "duration": 10}},
+		},
+	}}
+
+	webm := []byte{0x1A, 0x45, 0xDF, 0xA3, 0x44, 0x89, 0x84, 0x46, 0x1C, 0x40, 0x00} // 10000 ms
+	api.On("GetFile", "file123").Return(webm, nil)
+	api.On("GetPost", "post123").Return(post, nil)
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		requireGobEncodable(t, args.Get(0).(*model.Post))
+	}).Return(post, nil)
+	api.On("PublishWebSocketEvent", "job_finished", mock.Anything, mock.Anything).Return()
+
+	require.NoError(t, plugin.enqueueJobs([]*job{j}))
+	assert.True(t, plugin.runNextJob())
+	assert.False(t, plugin.runNextJob(), "the queue should be empty")
+
+	props := post.GetProp("voice_clip").(map[string]interface{})
+	assert.Equal(t, 10, props["duration"])
+	assert.Equal(t, true, props["duration_verified"])
+	assert.Equal(t, false, props["processing"])
+	file := props["files"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, true, file["duration_verified"])
+
+	saved, err := plugin.getJob(j.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobStatusCompleted, saved.Status)
+	assert.Equal(t, 100, saved.Progress)
+	assert.Equal(t, "[]", string(store[jobQueueKey]))
+
+	api.AssertCalled(t, "PublishWebSocketEvent", "job_finished", map[string]interface{}{
+		"job_id":  j.ID,
+		"type":    jobTypeProbe,
+		"post_id": "post123",
+		"status":  jobStatusCompleted,
+	}, &model.WebsocketBroadcast{ChannelId: "channel123"})
+}
+
+func TestApplyJobResult_ConcurrentJobs(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockKVStore(api)
+
+	audio := newProbeJob()
+	video := newProbeJob()
+	video.FileID = "file456"
+	stored, err := json.Marshal(&model.Post{Id: "post123", ChannelId: "channel123", Props: map[string]interface{}{
+		"voice_clip": map[string]interface{}{
+			"processing": true,
+			"job_ids":    []string{audio.ID, video.ID},
+			"files": []map[string]interface{}{
+				{"file_id": "file123", "duration": 10},
+				{"file_id": "file456", "duration": 20},
+			},
+		},
+	}})
+	require.NoError(t, err)
+
+	// Every GetPost returns a fresh copy of the stored post, as the server does.
+	var lock sync.Mutex
+	api.On("GetPost", "post123").Return(func(string) *model.Post {
+		lock.Lock()
+		defer lock.Unlock()
+		var post model.Post
+		require.NoError(t, json.Unmarshal(stored, &post))
+		return &post
+	}, nil)
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		lock.Lock()
+		defer lock.Unlock()
+		data, err := json.Marshal(post)
+		require.NoError(t, err)
+		stored = data
+		return post
+	}, nil)
+
+	audio.Result = map[string]interface{}{"duration_verified": true}
+	video.Result = map[string]interface{}{"duration_verified": false}
+	for _, j := range []*job{audio, video} {
+		j.Status = jobStatusCompleted
+		require.NoError(t, plugin.saveJob(j, nil))
+	}
+
+	var wg sync.WaitGroup
+	for _, j := range []*job{audio, video} {
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			plugin.applyJobResult(j)
+		}(j)
+	}
+	wg.Wait()
+
+	var post model.Post
+	require.NoError(t, json.Unmarshal(stored, &post))
+	props := post.GetProp("voice_clip").(map[string]interface{})
+	assert.Equal(t, false, props["processing"])
+	assert.Equal(t, true, props["duration_verified"])
+	files := props["files"].([]interface{})
+	assert.Equal(t, true, files[0].(map[string]interface{})["duration_verified"])
+	assert.Equal(t, false, files[1].(map[string]interface{})["duration_verified"])
+}
+
+func TestJobs_RetryThenDeadLetter(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	store := mockKVStore(api)
+
+	j := newProbeJob()
+	post := &model.Post{Id: "post123", Props: map[string]interface{}{
+		"voice_clip": map[string]interface{}{"processing": true},
+	}}
+
+	api.On("GetFile", "file123").Return(nil, model.NewAppError("GetFile", "store.error", nil, "", http.StatusInternalServerError))
+	api.On("GetPost", "post123").Return(post, nil)
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(post, nil)
+	api.On("PublishWebSocketEvent", "job_finished", mock.Anything, mock.Anything).Return()
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	require.NoError(t, plugin.enqueueJobs([]*job{j}))
+	for attempt := 1; attempt <= jobMaxAttempts; attempt++ {
+		require.True(t, plugin.runNextJob(), "attempt %d", attempt)
+
+		saved, err := plugin.getJob(j.ID)
+		require.NoError(t, err)
+		assert.Equal(t, attempt, saved.Attempts)
+		if attempt < jobMaxAttempts {
+			assert.Equal(t, jobStatusQueued, saved.Status)
+			assert.False(t, plugin.runNextJob(), "retries should be delayed")
+
+			// Make the retry due.
+			old := *saved
+			saved.NextRunAt = 0
+			require.NoError(t, plugin.saveJob(saved, &old))
+		} else {
+			assert.Equal(t, jobStatusFailed, saved.Status)
+			assert.NotEmpty(t, saved.Error)
+		}
+	}
+
+	var deadLetter []string
+	require.NoError(t, json.Unmarshal(store[jobDeadLetterKey], &deadLetter))
+	assert.Equal(t, []string{j.ID}, deadLetter)
+	assert.Equal(t, false, post.GetProp("voice_clip").(map[string]interface{})["processing"])
+	api.AssertNumberOfCalls(t, "PublishWebSocketEvent", 1)
+}
+
+func TestJobs_AbandonedLeaseIsReclaimed(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockKVStore(api)
+
+	j := newProbeJob()
+	require.NoError(t, plugin.enqueueJobs([]*job{j}))
+
+	claimed, err := plugin.claimJob()
+	require.NoError(t, err)
+	require.NotNil(t, claimed)
+
+	again, err := plugin.claimJob()
+	require.NoError(t, err)
+	assert.Nil(t, again, "a leased job should not be claimed twice")
+
+	old := *claimed
+	claimed.LeaseExpiry = model.GetMillis() - 1
+	require.NoError(t, plugin.saveJob(claimed, &old))
+
+	again, err = plugin.claimJob()
+	require.NoError(t, err)
+	require.NotNil(t, again)
+	assert.Equal(t, 2, again.Attempts)
+}
+
+func TestHandleJob(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockKVStore(api)
+
+	j := newProbeJob()
+	require.NoError(t, plugin.enqueueJobs([]*job{j}))
+
+	api.On("HasPermissionToChannel", "other123", "channel123", model.PermissionReadChannel).Return(true)
+	api.On("HasPermissionToChannel", "stranger123", "channel123", model.PermissionReadChannel).Return(false)
+
+	tests := []struct {
+		name           string
+		userID         string
+		path           string
+		expectedStatus int
+	}{
+		{"owner", "user123", jobsBasePath + "/" + j.ID, http.StatusOK},
+		{"channel member", "other123", jobsBasePath + "/" + j.ID, http.StatusOK},
+		{"no channel access", "stranger123", jobsBasePath + "/" + j.ID, http.StatusNotFound},
+		{"unknown job", "user123", jobsBasePath + "/unknown", http.StatusNotFound},
+		{"unauthenticated", "", jobsBasePath + "/" + j.ID, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.userID != "" {
+				req.Header.Set("Mattermost-User-Id", tt.userID)
+			}
+			w := httptest.NewRecorder()
+			plugin.ServeHTTP(nil, w, req)
+
+			require.Equal(t, tt.expectedStatus, w.Result().StatusCode)
+			if tt.expectedStatus == http.StatusOK {
+				var body map[string]interface{}
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+				assert.Equal(t, jobStatusQueued, body["status"])
+				assert.Equal(t, "post123", body["post_id"])
+			}
+		})
+	}
+}
+
+func TestApplyJobResult_GobEncodable(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockKVStore(api)
+
+	j := newProbeJob()
+	j.Status = jobStatusCompleted
+	j.Result = map[string]interface{}{"duration_verified": true}
+	require.NoError(t, plugin.saveJob(j, nil))
+
+	// Posts built in the same process still hold the typed list.
+	post := &model.Post{Id: "post123", ChannelId: "channel123", Props: map[string]interface{}{
+		"voice_clip": map[string]interface{}{
+			"processing": true,
+			"job_ids":    []string{j.ID},
+			"files":      []map[string]interface{}{{"file_id": "file123", "duration": 10}},
+		},
+	}}
+	api.On("GetPost", "post123").Return(post, nil)
+	var updated *model.Post
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		updated = args.Get(0).(*model.Post)
+	}).Return(post, nil)
+
+	plugin.applyJobResult(j)
+
+	require.NotNil(t, updated)
+	requireGobEncodable(t, updated)
+	props := updated.GetProp("voice_clip").(map[string]interface{})
+	assert.Equal(t, true, props["files"].([]interface{})[0].(map[string]interface{})["duration_verified"])
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaPlayerAudio = "audio"
+	mediaPlayerVideo = "video"
+)
+
+// mediaTypeNamePattern restricts type names to what can be used as a form field,
+// a props value and part of a post type.
+var mediaTypeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// reservedMediaTypeNames are upload form fields that cannot name a media type.
+var reservedMediaTypeNames = map[string]bool{
+	"channel_id": true,
+	"duration":   true,
+	"message":    true,
+	"root_id":    true,
+	"file_ids":   true,
+	"file":       true,
+}
+
+// mediaType describes a kind of clip: its limits, accepted formats and how it is
+// posted. Upload paths look up the type of each media file instead of branching on
+// audio or video.
+type mediaType struct {
+	// Name identifies the type in upload form fields, session and tus "type" values
+	// and the "type" of file entries in clip props.
+	Name string `json:"name"`
+
+	// Label names the type in messages, e.g. "Your voice recording".
+	Label string `json:"label"`
+
+	// Player is how clients play the media, "audio" or "video".
+	Player string `json:"player"`
+
+	PostType string `json:"post_type"`
+	PropsKey string `json:"props_key"`
+
+	// Message is the post text of clips without a caption.
+	Message string `json:"message"`
+
+	// MaxDuration is in seconds and MaxFileSize in MB.
+	MaxDuration int `json:"max_duration"`
+	MaxFileSize int `json:"max_file_size"`
+
+	// AllowedFormats is a comma-separated list of file extensions.
+	AllowedFormats string `json:"allowed_formats"`
+
+	// Priority picks the primary media of a clip with several files, which decides
+	// the post type. A recording session allows media of its own type and of types
+	// with a lower priority.
+	Priority int `json:"priority"`
+}
+
+// isVideo reports whether the media has a video track.
+func (t *mediaType) isVideo() bool {
+	return t.Player == mediaPlayerVideo
+}
+
+// maxFileSizeBytes returns the configured size limit in bytes.
+func (t *mediaType) maxFileSizeBytes() int64 {
+	return int64(t.MaxFileSize) * 1024 * 1024
+}
+
+// allows reports whether a recording session of this type covers media of type other.
+func (t *mediaType) allows(other *mediaType) bool {
+	return other.Name == t.Name || other.Priority < t.Priority
+}
+
+// allowedExtensions returns the allowed formats as a set of ".ext" extensions.
+func (t *mediaType) allowedExtensions() map[string]bool {
+	extensions := make(map[string]bool)
+	for _, ext := range strings.Split(t.AllowedFormats, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext != "" {
+			extensions["."+ext] = true
+		}
+	}
+	return extensions
+}
+
+// mediaTypeRegistry holds the media types known to the plugin, in priority order.
+type mediaTypeRegistry struct {
+	types      []*mediaType
+	byName     map[string]*mediaType
+	byPostType map[string]*mediaType
+}
+
+func newMediaTypeRegistry(types []*mediaType) *mediaTypeRegistry {
+	sorted := make([]*mediaType, len(types))
+	copy(sorted, types)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	r := &mediaTypeRegistry{types: sorted, byName: make(map[string]*mediaType), byPostType: make(map[string]*mediaType)}
+	for _, t := range sorted {
+		r.byName[t.Name] = t
+		r.byPostType[t.PostType] = t
+	}
+	return r
+}
+
+// get returns the media type with the given name, or nil.
+func (r *mediaTypeRegistry) get(name string) *mediaType {
+	return r.byName[name]
+}
+
+// forPostType returns the media type whose clips have the given post type, or nil.
+func (r *mediaTypeRegistry) forPostType(postType string) *mediaType {
+	return r.byPostType[postType]
+}
+
+// all returns every media type, in priority order.
+func (r *mediaTypeRegistry) all() []*mediaType {
+	return r.types
+}
+
+// names returns the names of every media type, in priority order.
+func (r *mediaTypeRegistry) names() []string {
+	names := make([]string, len(r.types))
+	for i, t := range r.types {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// builtinMediaTypes returns the audio, video and screen types with their limits from
+// the plugin settings.
+func (c *configuration) builtinMediaTypes() []*mediaType {
+	return []*mediaType{
+		{
+			Name:           "audio",
+			Label:          "voice",
+			Player:         mediaPlayerAudio,
+			PostType:       "custom_voice_clip",
+			PropsKey:       "voice_clip",
+			Message:        "🎤 Voice message",
+			MaxDuration:    positiveOr(c.MaxDuration, 300),     // Default 5 minutes for audio
+			MaxFileSize:    positiveOr(c.MaxAudioFileSize, 50), // Default 50 MB for audio
+			AllowedFormats: stringOr(c.AllowedAudioFormats, "webm,ogg,mp4,m4a,mp3,aac,wav"),
+			Priority:       0,
+		},
+		{
+			Name:           "video",
+			Label:          "video",
+			Player:         mediaPlayerVideo,
+			PostType:       "custom_video_clip",
+			PropsKey:       "video_clip",
+			Message:        "📹 Video message",
+			MaxDuration:    positiveOr(c.MaxVideoDuration, 120), // Default 2 minutes for video
+			MaxFileSize:    positiveOr(c.MaxVideoFileSize, 100), // Default 100 MB for video
+			AllowedFormats: stringOr(c.AllowedVideoFormats, "webm,mp4,mov"),
+			Priority:       10,
+		},
+		{
+			Name:           "screen",
+			Label:          "screen",
+			Player:         mediaPlayerVideo,
+			PostType:       "custom_screen_clip",
+			PropsKey:       "screen_clip",
+			Message:        "🖥️ Screen recording",
+			MaxDuration:    positiveOr(c.MaxScreenDuration, 600), // Default 10 minutes for screen recordings
+			MaxFileSize:    positiveOr(c.MaxScreenFileSize, 250), // Default 250 MB for screen recordings
+			AllowedFormats: stringOr(c.AllowedScreenFormats, "webm,mp4"),
+			Priority:       20,
+		},
+	}
+}
+
+// loadMediaTypes builds the registry from the built-in types and the types defined
+// in the CustomMediaTypes setting.
+func (c *configuration) loadMediaTypes() (*mediaTypeRegistry, error) {
+	types := c.builtinMediaTypes()
+	if strings.TrimSpace(c.CustomMediaTypes) == "" {
+		return newMediaTypeRegistry(types), nil
+	}
+
+	var custom []*mediaType
+	if err := json.Unmarshal([]byte(c.CustomMediaTypes), &custom); err != nil {
+		return nil, errors.Wrap(err, "failed to parse custom media types")
+	}
+
+	names := make(map[string]bool)
+	postTypes := make(map[string]bool)
+	propsKeys := make(map[string]bool)
+	for _, t := range types {
+		names[t.Name] = true
+		postTypes[t.PostType] = true
+		propsKeys[t.PropsKey] = true
+	}
+
+	for _, t := range custom {
+		if t == nil || !mediaTypeNamePattern.MatchString(t.Name) || reservedMediaTypeNames[t.Name] {
+			return nil, errors.New("media type names must be lowercase letters, digits and underscores")
+		}
+		if t.Label == "" {
+			t.Label = t.Name
+		}
+		if t.PostType == "" {
+			t.PostType = "custom_" + t.Name + "_clip"
+		}
+		if t.PropsKey == "" {
+			t.PropsKey = t.Name + "_clip"
+		}
+		if t.Message == "" {
+			t.Message = "📎 Media message"
+		}
+
+		switch {
+		case names[t.Name]:
+			return nil, errors.Errorf("media type %q is defined twice", t.Name)
+		case t.Player != mediaPlayerAudio && t.Player != mediaPlayerVideo:
+			return nil, errors.Errorf("media type %q: player must be audio or video", t.Name)
+		case !strings.HasPrefix(t.PostType, "custom_") || postTypes[t.PostType]:
+			return nil, errors.Errorf("media type %q: post_type must be a unique type starting with custom_", t.Name)
+		case propsKeys[t.PropsKey]:
+			return nil, errors.Errorf("media type %q: props_key is already used", t.Name)
+		case t.MaxDuration <= 0 || t.MaxFileSize <= 0:
+			return nil, errors.Errorf("media type %q: max_duration and max_file_size must be positive", t.Name)
+		case len(t.allowedExtensions()) == 0:
+			return nil, errors.Errorf("media type %q: allowed_formats is required", t.Name)
+		}
+
+		names[t.Name] = true
+		postTypes[t.PostType] = true
+		propsKeys[t.PropsKey] = true
+		types = append(types, t)
+	}
+
+	return newMediaTypeRegistry(types), nil
+}
+
+// mediaTypes returns the registry of the configuration, or the built-in types for a
+// configuration that was not loaded through OnConfigurationChange.
+func (c *configuration) mediaTypes() *mediaTypeRegistry {
+	if c.registry != nil {
+		return c.registry
+	}
+	return newMediaTypeRegistry(c.builtinMediaTypes())
+}
+
+func positiveOr(value, fallback int) int {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func stringOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// getMediaType looks up a media type by the name sent by a client, defaulting to
+// audio.
+func (p *Plugin) getMediaType(name string) (*mediaType, *clipError) {
+	if name == "" {
+		name = "audio"
+	}
+	t := p.getConfiguration().mediaTypes().get(name)
+	if t == nil {
+		return nil, &clipError{Status: http.StatusBadRequest, Message: "Unknown media type"}
+	}
+	return t, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMediaTypes_Builtin(t *testing.T) {
+	config := &configuration{MaxScreenDuration: 900, AllowedScreenFormats: "webm"}
+	registry, err := config.loadMediaTypes()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"audio", "video", "screen"}, registry.names())
+
+	audio := registry.get("audio")
+	require.NotNil(t, audio)
+	assert.Equal(t, "custom_voice_clip", audio.PostType)
+	assert.Equal(t, 300, audio.MaxDuration)
+	assert.Equal(t, int64(50*1024*1024), audio.maxFileSizeBytes())
+
+	screen := registry.get("screen")
+	require.NotNil(t, screen)
+	assert.Equal(t, "custom_screen_clip", screen.PostType)
+	assert.Equal(t, "screen_clip", screen.PropsKey)
+	assert.Equal(t, 900, screen.MaxDuration)
+	assert.Equal(t, 250, screen.MaxFileSize)
+	assert.True(t, screen.isVideo())
+	assert.Equal(t, map[string]bool{".webm": true}, screen.allowedExtensions())
+
+	assert.True(t, screen.allows(registry.get("video")))
+	assert.True(t, screen.allows(audio))
+	assert.False(t, audio.allows(screen))
+}
+
+func TestLoadMediaTypes_Custom(t *testing.T) {
+	config := &configuration{CustomMediaTypes: `[{"name": "podcast", "player": "audio", "max_duration": 3600, "max_file_size": 200, "allowed_formats": "mp3,ogg", "priority": 5}]`}
+	registry, err := config.loadMediaTypes()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"audio", "podcast", "video", "screen"}, registry.names())
+
+	podcast := registry.get("podcast")
+	require.NotNil(t, podcast)
+	assert.Equal(t, "custom_podcast_clip", podcast.PostType)
+	assert.Equal(t, "podcast_clip", podcast.PropsKey)
+	assert.Equal(t, "podcast", podcast.Label)
+	assert.False(t, podcast.isVideo())
+}
+
+func TestLoadMediaTypes_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		custom string
+	}{
+		{"malformed json", `{"name": "podcast"}`},
+		{"bad name", `[{"name": "Pod Cast", "player": "audio", "max_duration": 60, "max_file_size": 10, "allowed_formats": "mp3"}]`},
+		{"reserved name", `[{"name": "channel_id", "player": "audio", "max_duration": 60, "max_file_size": 10, "allowed_formats": "mp3"}]`},
+		{"builtin name", `[{"name": "video", "player": "video", "max_duration": 60, "max_file_size": 10, "allowed_formats": "mp4"}]`},
+		{"unknown player", `[{"name": "podcast", "player": "radio", "max_duration": 60, "max_file_size": 10, "allowed_formats": "mp3"}]`},
+		{"builtin post type", `[{"name": "podcast", "player": "audio", "post_type": "custom_voice_clip", "max_duration": 60, "max_file_size": 10, "allowed_formats": "mp3"}]`},
+		{"post type prefix", `[{"name": "podcast", "player": "audio", "post_type": "podcast", "max_duration": 60, "max_file_size": 10, "allowed_formats": "mp3"}]`},
+		{"builtin props key", `[{"name": "podcast", "player": "audio", "props_key": "voice_clip", "max_duration": 60, "max_file_size": 10, "allowed_formats": "mp3"}]`},
+		{"no limits", `[{"name": "podcast", "player": "audio", "allowed_formats": "mp3"}]`},
+		{"no formats", `[{"name": "podcast", "player": "audio", "max_duration": 60, "max_file_size": 10}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &configuration{CustomMediaTypes: tt.custom}
+			_, err := config.loadMediaTypes()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHandleUpload_ScreenClip(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, "screen_clip_")
+	})).Return(&model.FileInfo{Id: "file123"}, nil)
+
+	var created *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		created = args.Get(0).(*model.Post)
+	}).Return(&model.Post{Id: "post123"}, nil)
+
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "240"}, "screen", testWebM())
+	addSession(t, plugin, req, "channel123", "screen")
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	require.NotNil(t, created)
+	assert.Equal(t, "custom_screen_clip", created.Type)
+	assert.Equal(t, "🖥️ Screen recording", created.Message)
+	props := created.GetProp("screen_clip").(map[string]interface{})
+	assert.Equal(t, 240, props["duration"])
+}
+
+func TestHandleUpload_CustomMediaType(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("LoadPluginConfiguration", mock.AnythingOfType("*main.configuration")).Run(func(args mock.Arguments) {
+		config := args.Get(0).(*configuration)
+		config.RequireRecordingSession = true
+		config.CustomMediaTypes = `[{"name": "podcast", "player": "audio", "message": "🎙️ Podcast", "max_duration": 60, "max_file_size": 10, "allowed_formats": "webm"}]`
+	}).Return(nil)
+	require.NoError(t, plugin.OnConfigurationChange())
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, "podcast_clip_")
+	})).Return(&model.FileInfo{Id: "file123"}, nil)
+
+	var created *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		created = args.Get(0).(*model.Post)
+	}).Return(&model.Post{Id: "post123"}, nil)
+
+	// Over the limit of the custom type.
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "90"}, "podcast", testWebM())
+	addSession(t, plugin, req, "channel123", "podcast")
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "Duration exceeds maximum allowed (60 seconds)")
+
+	req = newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "30"}, "podcast", testWebM())
+	addSession(t, plugin, req, "channel123", "podcast")
+	w = httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	require.NotNil(t, created)
+	assert.Equal(t, "custom_podcast_clip", created.Type)
+	assert.Equal(t, "🎙️ Podcast", created.Message)
+	assert.NotNil(t, created.GetProp("podcast_clip"))
+}
+
+func TestCreateSession_MediaType(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{signingKey: []byte("test-signing-key")}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	req := httptest.NewRequest(http.MethodPost, sessionsPath, strings.NewReader(`{"channel_id": "channel123", "type": "screen"}`))
+	req.Header.Set("Mattermost-User-Id", "user123")
+	w := httptest.NewRecorder()
+	plugin.handleCreateSession(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), `"max_duration":600`)
+
+	req = httptest.NewRequest(http.MethodPost, sessionsPath, strings.NewReader(`{"channel_id": "channel123", "type": "hologram"}`))
+	req.Header.Set("Mattermost-User-Id", "user123")
+	w = httptest.NewRecorder()
+	plugin.handleCreateSession(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "Unknown media type")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// stripMetadata removes tags such as title, artist, encoder, device or location from
+// a media file. Tags are dropped where the container allows it and overwritten with
+// padding where removing them would move the media data. It reports whether the
+// file was changed; unsupported formats are returned as is.
+func stripMetadata(data []byte, extension string) ([]byte, bool) {
+	switch strings.ToLower(extension) {
+	case ".mp3":
+		return stripMP3Metadata(data)
+	case ".wav":
+		return stripWAVMetadata(data)
+	case ".mp4", ".m4a", ".mov":
+		return stripMP4Metadata(data)
+	case ".webm":
+		return stripWebMMetadata(data)
+	}
+	return data, false
+}
+
+// stripMP3Metadata drops the ID3v2 tag at the start and the ID3v1 tag at the end.
+func stripMP3Metadata(data []byte) ([]byte, bool) {
+	stripped := data
+	if len(stripped) >= 10 && string(stripped[0:3]) == "ID3" {
+		// The tag size is a syncsafe integer that excludes the header and footer.
+		size := int(stripped[6]&0x7F)<<21 | int(stripped[7]&0x7F)<<14 | int(stripped[8]&0x7F)<<7 | int(stripped[9]&0x7F)
+		size += 10
+		if stripped[5]&0x10 != 0 {
+			size += 10
+		}
+		if size > len(stripped) {
+			return data, false
+		}
+		stripped = stripped[size:]
+	}
+	if len(stripped) >= 128 && string(stripped[len(stripped)-128:len(stripped)-125]) == "TAG" {
+		stripped = stripped[:len(stripped)-128]
+	}
+	return stripped, len(stripped) != len(data)
+}
+
+// stripWAVMetadata drops LIST and ID3 chunks and fixes the RIFF size.
+func stripWAVMetadata(data []byte) ([]byte, bool) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return data, false
+	}
+
+	stripped := append([]byte{}, data[:12]...)
+	changed := false
+	offset := 12
+	for offset+8 <= len(data) {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		// Chunks are padded to an even size.
+		end := offset + 8 + size + size%2
+		if end > len(data) {
+			break
+		}
+		switch id {
+		case "LIST", "id3 ", "ID3 ":
+			changed = true
+		default:
+			stripped = append(stripped, data[offset:end]...)
+		}
+		offset = end
+	}
+	if !changed {
+		return data, false
+	}
+
+	stripped = append(stripped, data[offset:]...)
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, true
+}
+
+// stripMP4Metadata turns udta and meta boxes into free boxes of the same size. The
+// boxes are not removed because the sample tables hold absolute offsets into the file.
+func stripMP4Metadata(data []byte) ([]byte, bool) {
+	if len(data) < 8 || string(data[4:8]) != "ftyp" {
+		return data, false
+	}
+	stripped := append([]byte{}, data...)
+	if !freeMP4MetadataBoxes(stripped) {
+		return data, false
+	}
+	return stripped, true
+}
+
+// freeMP4MetadataBoxes walks the boxes in data, descending into moov and trak, and
+// reports whether any metadata box was freed.
+func freeMP4MetadataBoxes(data []byte) bool {
+	changed := false
+	for offset := 0; offset+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		header := 8
+		switch size {
+		case 0:
+			size = len(data) - offset
+		case 1:
+			if offset+16 > len(data) {
+				return changed
+			}
+			largeSize := binary.BigEndian.Uint64(data[offset+8 : offset+16])
+			if largeSize > uint64(len(data)-offset) {
+				return changed
+			}
+			size = int(largeSize)
+			header = 16
+		}
+		if size < header || offset+size > len(data) {
+			return changed
+		}
+
+		box := data[offset : offset+size]
+		switch string(box[4:8]) {
+		case "moov", "trak":
+			if freeMP4MetadataBoxes(box[header:]) {
+				changed = true
+			}
+		case "udta", "meta":
+			copy(box[4:8], "free")
+			for i := header; i < len(box); i++ {
+				box[i] = 0
+			}
+			changed = true
+		}
+		offset += size
+	}
+	return changed
+}
+
+// WebM element ids used when stripping metadata.
+var (
+	webmEBMLID    = []byte{0x1A, 0x45, 0xDF, 0xA3}
+	webmSegmentID = []byte{0x18, 0x53, 0x80, 0x67}
+	webmTagsID    = []byte{0x12, 0x54, 0xC3, 0x67}
+)
+
+// webmVoidID is the id of the Void element, which players skip.
+const webmVoidID = 0xEC
+
+// stripWebMMetadata overwrites Tags elements in the segment with Void elements of
+// the same size. Files written by MediaRecorder use clusters of unknown size, so the
+// walk stops at the first element it cannot skip.
+func stripWebMMetadata(data []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(data, webmEBMLID) {
+		return data, false
+	}
+
+	stripped := append([]byte{}, data...)
+	changed := false
+	for offset := 0; offset < len(stripped); {
+		id, bodyStart, bodyEnd, ok := readWebMElement(stripped, offset)
+		if !ok {
+			break
+		}
+		if bytes.Equal(id, webmSegmentID) {
+			for child := bodyStart; child < bodyEnd; {
+				childID, _, childEnd, ok := readWebMElement(stripped[:bodyEnd], child)
+				if !ok {
+					break
+				}
+				if bytes.Equal(childID, webmTagsID) && writeWebMVoid(stripped[child:childEnd]) {
+					changed = true
+				}
+				child = childEnd
+			}
+		}
+		offset = bodyEnd
+	}
+
+	if !changed {
+		return data, false
+	}
+	return stripped, true
+}
+
+// readWebMElement reads the element header at offset and returns its id and the
+// bounds of its body. Elements of unknown size are only accepted when they extend to
+// the end of data, i.e. for the segment.
+func readWebMElement(data []byte, offset int) ([]byte, int, int, bool) {
+	idLength, _, ok := readEBMLVint(data[offset:])
+	if !ok || idLength > 4 {
+		return nil, 0, 0, false
+	}
+	sizeLength, size, ok := readEBMLVint(data[offset+idLength:])
+	if !ok {
+		return nil, 0, 0, false
+	}
+
+	bodyStart := offset + idLength + sizeLength
+	unknown := size == (uint64(1)<<(7*sizeLength))-1
+	if unknown {
+		if !bytes.Equal(data[offset:offset+idLength], webmSegmentID) {
+			return nil, 0, 0, false
+		}
+		return data[offset : offset+idLength], bodyStart, len(data), true
+	}
+	if size > uint64(len(data)-bodyStart) {
+		return nil, 0, 0, false
+	}
+	return data[offset : offset+idLength], bodyStart, bodyStart + int(size), true
+}
+
+// readEBMLVint reads a variable-length integer and returns its length and value
+// without the length marker.
+func readEBMLVint(data []byte) (int, uint64, bool) {
+	if len(data) < 1 || data[0] == 0 {
+		return 0, 0, false
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(data) < length {
+		return 0, 0, false
+	}
+
+	value := uint64(data[0] & (0xFF >> length))
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return length, value, true
+}
+
+// writeWebMVoid overwrites element with a Void element of the same length, using an
+// 8-byte size so that any element of at least 9 bytes can be replaced.
+func writeWebMVoid(element []byte) bool {
+	if len(element) < 9 {
+		return false
+	}
+	element[0] = webmVoidID
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(element)-9))
+	size[0] = 0x01
+	copy(element[1:9], size[:])
+	for i := 9; i < len(element); i++ {
+		element[i] = 0
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mp4Box returns an MP4 box of the given type around body.
+func mp4Box(boxType string, body ...[]byte) []byte {
+	content := bytes.Join(body, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	box = append(box, boxType...)
+	return append(box, content...)
+}
+
+func TestStripMetadata_MP3(t *testing.T) {
+	frame := append([]byte{0xFF, 0xFB, 0x90, 0x64}, make([]byte, 412)...)
+	tag := append([]byte("ID3\x03\x00\x00\x00\x00\x00\x0a"), []byte("TIT2title!")...)
+	v1 := append([]byte("TAG"), bytes.Repeat([]byte("x"), 125)...)
+
+	stripped, changed := stripMetadata(bytes.Join([][]byte{tag, frame, v1}, nil), ".mp3")
+	assert.True(t, changed)
+	assert.Equal(t, frame, stripped)
+
+	_, changed = stripMetadata(frame, ".MP3")
+	assert.False(t, changed)
+}
+
+func TestStripMetadata_WAV(t *testing.T) {
+	fmtChunk := append([]byte("fmt \x10\x00\x00\x00"), make([]byte, 16)...)
+	list := []byte("LIST\x09\x00\x00\x00INFOIART\x00\x00") // odd size, padded
+	dataChunk := append([]byte("data\x04\x00\x00\x00"), 1, 2, 3, 4)
+
+	wav := func(chunks ...[]byte) []byte {
+		body := append([]byte("WAVE"), bytes.Join(chunks, nil)...)
+		header := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+		return append(header, body...)
+	}
+
+	stripped, changed := stripMetadata(wav(fmtChunk, list, dataChunk), ".wav")
+	assert.True(t, changed)
+	assert.Equal(t, wav(fmtChunk, dataChunk), stripped)
+
+	_, changed = stripMetadata(wav(fmtChunk, dataChunk), ".wav")
+	assert.False(t, changed)
+}
+
+func TestStripMetadata_MP4(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	mvhd := mp4Box("mvhd", make([]byte, 100))
+	udta := mp4Box("udta", mp4Box("\xa9xyz", []byte("+52.5200+013.4050/")))
+	trak := mp4Box("trak", mp4Box("tkhd", make([]byte, 84)), mp4Box("meta", []byte("handler")))
+	mdat := mp4Box("mdat", []byte("media data"))
+	original := bytes.Join([][]byte{ftyp, mp4Box("moov", mvhd, trak, udta), mdat}, nil)
+
+	stripped, changed := stripMetadata(original, ".m4a")
+	require.True(t, changed)
+	assert.Len(t, stripped, len(original))
+	assert.NotContains(t, string(stripped), "+52.5200")
+	assert.NotContains(t, string(stripped), "handler")
+	assert.NotContains(t, string(stripped), "udta")
+	assert.True(t, bytes.HasSuffix(stripped, mdat), "media data must not move")
+	assert.Contains(t, string(original), "udta", "the input must not be modified")
+
+	_, changed = stripMetadata(bytes.Join([][]byte{ftyp, mp4Box("moov", mvhd), mdat}, nil), ".mp4")
+	assert.False(t, changed)
+}
+
+func TestStripMetadata_WebM(t *testing.T) {
+	header := []byte{0x1A, 0x45, 0xDF, 0xA3, 0x84, 0x42, 0x86, 0x81, 0x01}
+	info := []byte{0x15, 0x49, 0xA9, 0x66, 0x83, 0x2A, 0xD7, 0xB1}
+	tags := append([]byte{0x12, 0x54, 0xC3, 0x67, 0x90}, []byte("ENCODER=phone123")...)
+	// MediaRecorder writes the segment and clusters with unknown sizes.
+	segment := []byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	cluster := []byte{0x1F, 0x43, 0xB6, 0x75, 0xFF, 0xE7, 0x81, 0x00}
+	original := bytes.Join([][]byte{header, segment, info, tags, cluster}, nil)
+
+	stripped, changed := stripMetadata(original, ".webm")
+	require.True(t, changed)
+	assert.Len(t, stripped, len(original))
+	assert.NotContains(t, string(stripped), "phone123")
+	assert.True(t, bytes.HasSuffix(stripped, cluster))
+
+	void := stripped[len(header)+len(segment)+len(info):]
+	assert.Equal(t, byte(0xEC), void[0])
+	length, size, ok := readEBMLVint(void[1:])
+	require.True(t, ok)
+	assert.Equal(t, 8, length)
+	assert.Equal(t, uint64(len(tags)-9), size)
+
+	_, changed = stripMetadata(bytes.Join([][]byte{header, segment, info, cluster}, nil), ".webm")
+	assert.False(t, changed)
+}
+
+func TestStripMetadata_Unsupported(t *testing.T) {
+	data := []byte("OggS\x00\x02 vorbis comments")
+	stripped, changed := stripMetadata(data, ".ogg")
+	assert.False(t, changed)
+	assert.Equal(t, data, stripped)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// uploadedFilesKey lists the files uploaded by the plugin whose post has not
+	// been created yet. Only these files are ever treated as orphaned, so files
+	// users upload themselves are never touched.
+	uploadedFilesKey = "uploaded_files"
+
+	// orphanedFilesKey lists files whose cleanup failed, so the reconciliation job
+	// has to try again.
+	orphanedFilesKey = "orphaned_files"
+
+	// pluginFileCreator is the creator Mattermost records for files uploaded
+	// through the plugin API.
+	pluginFileCreator = "nouser"
+
+	// fileRemovalPostType marks the posts used to delete files, so that post hooks
+	// leave them alone.
+	fileRemovalPostType = "custom_voice_clips_file_removal"
+
+	// orphanGracePeriod is how old an unattached clip file must be before the
+	// reconciliation job treats it as orphaned.
+	orphanGracePeriod = time.Hour
+
+	// orphanScanWindow is how long the reconciliation job keeps reporting an
+	// orphaned file before it stops tracking it.
+	orphanScanWindow = 7 * 24 * time.Hour
+
+	orphanActionReport = "report"
+	orphanActionDelete = "delete"
+)
+
+// trackUploadedFile records a file uploaded by the plugin until its post exists.
+func (p *Plugin) trackUploadedFile(fileID string) {
+	if err := p.addToIDList(uploadedFilesKey, fileID); err != nil {
+		p.API.LogWarn("Failed to track uploaded file", "file_id", fileID, "error", err.Error())
+	}
+}
+
+// untrackUploadedFiles forgets files that are attached to a post or deleted.
+func (p *Plugin) untrackUploadedFiles(fileIDs ...string) {
+	if err := p.removeFromIDList(uploadedFilesKey, fileIDs...); err != nil {
+		p.API.LogWarn("Failed to untrack uploaded files", "error", err.Error())
+	}
+}
+
+// discardUploadedFile cleans up a file whose post could not be created. If that
+// fails too, the file is remembered for the reconciliation job.
+func (p *Plugin) discardUploadedFile(info *model.FileInfo) {
+	err := p.deleteFile(info)
+	if err == nil {
+		p.untrackUploadedFiles(info.Id)
+		return
+	}
+
+	p.API.LogWarn("Failed to clean up orphaned file, will retry later", "file_id", info.Id, "error", err.Error())
+	if err := p.addToIDList(orphanedFilesKey, info.Id); err != nil {
+		p.API.LogError("Failed to record orphaned file", "file_id", info.Id, "error", err.Error())
+	}
+}
+
+// deleteFile soft-deletes a file that is not attached to any post. The plugin API
+// has no call for this, so the file is attached to a post in the bot's own direct
+// channel, which nobody else can see, and that post is then deleted together with
+// its files. Mattermost only attaches files to posts of their creator, so files
+// uploaded by users are attached to a post in their name. It fails unless the file
+// was attached to the post.
+func (p *Plugin) deleteFile(info *model.FileInfo) error {
+	if p.botUserID == "" {
+		return errors.New("bot user is not available")
+	}
+
+	channel, appErr := p.API.GetDirectChannel(p.botUserID, p.botUserID)
+	if appErr != nil {
+		return appErr
+	}
+
+	authorID := p.botUserID
+	if info.CreatorId != "" && info.CreatorId != pluginFileCreator {
+		authorID = info.CreatorId
+	}
+	post, appErr := p.API.CreatePost(&model.Post{
+		UserId:    authorID,
+		ChannelId: channel.Id,
+		Type:      fileRemovalPostType,
+		Message:   "Removing orphaned clip file.",
+		FileIds:   []string{info.Id},
+	})
+	if appErr != nil {
+		return appErr
+	}
+	attached := false
+	for _, fileID := range post.FileIds {
+		attached = attached || fileID == info.Id
+	}
+	if appErr := p.API.DeletePost(post.Id); appErr != nil {
+		return appErr
+	}
+	if !attached {
+		return errors.Errorf("file %s could not be attached for removal", info.Id)
+	}
+	return nil
+}
+
+// reconcileOrphanedFiles finds clip files that never made it into a post and reports
+// or deletes them depending on the configuration. It runs as a cluster-wide job and
+// only looks at the files the plugin uploaded itself.
+func (p *Plugin) reconcileOrphanedFiles() {
+	deleteOrphans := p.getConfiguration().OrphanedFileAction == orphanActionDelete
+
+	// Retry the cleanups that failed at upload time.
+	ids, err := p.getIDList(orphanedFilesKey)
+	if err != nil {
+		p.API.LogError("Failed to list orphaned files", "error", err.Error())
+	}
+	var done []string
+	for _, fileID := range ids {
+		info, appErr := p.API.GetFileInfo(fileID)
+		if appErr != nil && appErr.StatusCode != http.StatusNotFound {
+			continue
+		}
+		if appErr == nil && info.PostId == "" && info.DeleteAt == 0 {
+			if err := p.deleteFile(info); err != nil {
+				p.API.LogWarn("Failed to clean up orphaned file", "file_id", fileID, "error", err.Error())
+				continue
+			}
+		}
+		done = append(done, fileID)
+	}
+	if err := p.removeFromIDList(orphanedFilesKey, done...); err != nil {
+		p.API.LogWarn("Failed to update orphaned files", "error", err.Error())
+	}
+
+	ids, err = p.getIDList(uploadedFilesKey)
+	if err != nil {
+		p.API.LogError("Failed to list uploaded files", "error", err.Error())
+		return
+	}
+	cutoff := model.GetMillisForTime(time.Now().Add(-orphanGracePeriod))
+	expired := model.GetMillisForTime(time.Now().Add(-orphanScanWindow))
+
+	var orphans []string
+	done = nil
+	for _, fileID := range ids {
+		info, appErr := p.API.GetFileInfo(fileID)
+		if appErr != nil {
+			if appErr.StatusCode == http.StatusNotFound {
+				done = append(done, fileID)
+			}
+			continue
+		}
+		if info.PostId != "" || info.DeleteAt != 0 {
+			done = append(done, fileID)
+			continue
+		}
+		if info.CreateAt > cutoff {
+			continue
+		}
+
+		if deleteOrphans {
+			err := p.deleteFile(info)
+			if err == nil {
+				done = append(done, fileID)
+				continue
+			}
+			p.API.LogWarn("Failed to delete orphaned file", "file_id", info.Id, "error", err.Error())
+		}
+		orphans = append(orphans, info.Id)
+		if info.CreateAt < expired {
+			done = append(done, fileID)
+		}
+	}
+	if err := p.removeFromIDList(uploadedFilesKey, done...); err != nil {
+		p.API.LogWarn("Failed to update uploaded files", "error", err.Error())
+	}
+
+	if len(orphans) > 0 {
+		p.API.LogWarn("Found clip files not attached to any post", "count", len(orphans), "file_ids", strings.Join(orphans, ","))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleUpload_RetriesTransientErrors(t *testing.T) {
+	retryBackoff = 0
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, model.NewAppError("CreatePost", "store.error", nil, "", http.StatusInternalServerError)).Once()
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil).Once()
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM())
+	addSession(t, plugin, req, "channel123", "audio")
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	api.AssertNumberOfCalls(t, "CreatePost", 2)
+}
+
+func TestHandleUpload_DiscardsFileWhenPostFails(t *testing.T) {
+	retryBackoff = 0
+	api := &plugintest.API{}
+	plugin := &Plugin{botUserID: "bot123"}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123", CreatorId: pluginFileCreator}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "channel123"
+	})).Return(nil, model.NewAppError("CreatePost", "api.post.create_post.forbidden", nil, "", http.StatusForbidden))
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything).Return()
+	mockFileRemoval(api)
+
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM())
+	addSession(t, plugin, req, "channel123", "audio")
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.Type == fileRemovalPostType && post.UserId == "bot123" && post.FileIds[0] == "file123"
+	}))
+	api.AssertCalled(t, "DeletePost", "removal_file123")
+	assert.Equal(t, "[]", string(store[uploadedFilesKey]))
+}
+
+// mockFileRemoval stubs the bot's direct channel and the posts that deleteFile uses
+// to remove files, attaching every file to them.
+func mockFileRemoval(api *plugintest.API) {
+	api.On("GetDirectChannel", "bot123", "bot123").Return(&model.Channel{Id: "botdm"}, nil).Maybe()
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.Type == fileRemovalPostType
+	})).Return(func(post *model.Post) *model.Post {
+		created := post.Clone()
+		created.Id = "removal_" + post.FileIds[0]
+		return created
+	}, nil).Maybe()
+	api.On("DeletePost", mock.AnythingOfType("string")).Return(nil).Maybe()
+}
+
+func TestDeleteFile(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{botUserID: "bot123"}
+	plugin.SetAPI(api)
+	mockFileRemoval(api)
+
+	// Files of users are attached to a post in their name.
+	require.NoError(t, plugin.deleteFile(&model.FileInfo{Id: "file123", CreatorId: "user123"}))
+	api.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "botdm" && post.UserId == "user123" && post.FileIds[0] == "file123"
+	}))
+	api.AssertCalled(t, "DeletePost", "removal_file123")
+}
+
+func TestDeleteFile_NotAttached(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{botUserID: "bot123"}
+	plugin.SetAPI(api)
+
+	// The server drops files the author does not own from the post.
+	api.On("GetDirectChannel", "bot123", "bot123").Return(&model.Channel{Id: "botdm"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "removal123"}, nil)
+	api.On("DeletePost", "removal123").Return(nil)
+
+	err := plugin.deleteFile(&model.FileInfo{Id: "file123", CreatorId: "user123"})
+	assert.EqualError(t, err, "file file123 could not be attached for removal")
+	api.AssertCalled(t, "DeletePost", "removal123")
+}
+
+func newReconcilePlugin(t *testing.T, api *plugintest.API, config *configuration) (*Plugin, map[string][]byte) {
+	plugin := &Plugin{botUserID: "bot123"}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(config)
+	store := mockKVStore(api)
+
+	old := model.GetMillisForTime(time.Now().Add(-2 * time.Hour))
+	api.On("GetFileInfo", "orphan").Return(&model.FileInfo{Id: "orphan", CreatorId: pluginFileCreator, CreateAt: old}, nil)
+	api.On("GetFileInfo", "attached").Return(&model.FileInfo{Id: "attached", CreatorId: pluginFileCreator, CreateAt: old, PostId: "post"}, nil)
+	api.On("GetFileInfo", "recent").Return(&model.FileInfo{Id: "recent", CreatorId: pluginFileCreator, CreateAt: model.GetMillis()}, nil)
+	api.On("GetFileInfo", "gone").Return(nil, model.NewAppError("GetFileInfo", "not_found", nil, "", http.StatusNotFound))
+	require.NoError(t, plugin.updateIDList(uploadedFilesKey, func([]string) []string {
+		return []string{"orphan", "attached", "recent", "gone"}
+	}))
+	return plugin, store
+}
+
+func TestReconcileOrphanedFiles_Report(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newReconcilePlugin(t, api, &configuration{})
+	api.On("LogWarn", "Found clip files not attached to any post", "count", 1, "file_ids", "orphan").Return()
+
+	plugin.reconcileOrphanedFiles()
+
+	api.AssertExpectations(t)
+	api.AssertNotCalled(t, "DeletePost", mock.Anything)
+	assert.Equal(t, `["orphan","recent"]`, string(store[uploadedFilesKey]))
+}
+
+func TestReconcileOrphanedFiles_Delete(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newReconcilePlugin(t, api, &configuration{OrphanedFileAction: orphanActionDelete})
+	mockFileRemoval(api)
+
+	// A cleanup that failed at upload time is retried.
+	api.On("GetFileInfo", "failed").Return(&model.FileInfo{Id: "failed", CreatorId: "user123", CreateAt: model.GetMillis()}, nil)
+	require.NoError(t, plugin.addToIDList(orphanedFilesKey, "failed"))
+
+	plugin.reconcileOrphanedFiles()
+
+	api.AssertCalled(t, "DeletePost", "removal_orphan")
+	api.AssertCalled(t, "DeletePost", "removal_failed")
+	api.AssertNotCalled(t, "DeletePost", "removal_recent")
+	assert.Equal(t, `["recent"]`, string(store[uploadedFilesKey]))
+	assert.Equal(t, "[]", string(store[orphanedFilesKey]))
+}
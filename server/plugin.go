@@ -3,11 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
-	"mime/multipart"
 	"net/http"
-	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,8 +11,13 @@ import (
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
 )
 
+// pluginID is the plugin id from plugin.json, used to build plugin URLs.
+const pluginID = "com.mattermost.voice-clips"
+
 // Plugin implements the interface expected by the Mattermost server to communicate between the server and plugin processes.
 type Plugin struct {
 	plugin.MattermostPlugin
@@ -29,15 +30,59 @@ type Plugin struct {
 	configuration *configuration
 
 	client *pluginapi.Client
+
+	// botUserID is the user id of the plugin bot used for direct messages.
+	botUserID string
+
+	// recoveryJob turns abandoned recordings into drafts.
+	recoveryJob *cluster.Job
+
+	// reconcileJob finds clip files that are not attached to any post.
+	reconcileJob *cluster.Job
+
+	// admission caps concurrent uploads and the memory they hold.
+	admission admissionController
+
+	// jobQueue runs post-upload processing jobs.
+	jobQueue *jobQueue
+
+	// conversions holds the reservations of converted posts until they are saved.
+	conversions pendingConversions
+
+	// signingKeyLock synchronizes access to signingKey.
+	signingKeyLock sync.Mutex
+
+	// signingKey is the cached HMAC key. Consult getSigningKey for usage.
+	signingKey []byte
 }
 
 // ServeHTTP demonstrates a plugin that handles HTTP requests
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
-	case "/api/v1/upload":
+	switch path := r.URL.Path; {
+	case path == "/api/v1/upload":
 		p.handleUpload(w, r)
-	case "/api/v1/config":
+	case path == "/api/v1/config":
 		p.handleConfig(w, r)
+	case path == "/api/v1/stats":
+		p.handleStats(w, r)
+	case path == claimPath:
+		p.handleClaim(w, r)
+	case path == usagePath:
+		p.handleUsage(w, r)
+	case path == quarantinePath:
+		p.handleQuarantine(w, r)
+	case strings.HasPrefix(path, mediaBasePath+"/"):
+		p.handleMedia(w, r)
+	case path == encryptionRotatePath:
+		p.handleRotateEncryption(w, r)
+	case path == sessionsPath:
+		p.handleCreateSession(w, r)
+	case path == tusBasePath || strings.HasPrefix(path, tusBasePath+"/"):
+		p.handleTus(w, r)
+	case path == recordingsBasePath || strings.HasPrefix(path, recordingsBasePath+"/"):
+		p.handleRecordings(w, r)
+	case strings.HasPrefix(path, jobsBasePath+"/"):
+		p.handleJob(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -56,242 +101,315 @@ func (p *Plugin) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form
-	err := r.ParseMultipartForm(32 << 20) // 32 MB max
-	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	// A retried request is answered with the original response instead of posting
+	// twice, once its body has been checked to be the same upload.
+	posted := false
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
 		return
 	}
-
-	channelID := r.FormValue("channel_id")
-	if channelID == "" {
-		http.Error(w, "channel_id is required", http.StatusBadRequest)
-		return
+	var replay *idempotencyRecord
+	if idempotencyKey != "" {
+		record, err := p.claimIdempotencyKey(userID, idempotencyKey)
+		if err != nil {
+			p.API.LogError("Failed to check idempotency key", "error", err.Error())
+			http.Error(w, "Failed to check idempotency key", http.StatusInternalServerError)
+			return
+		}
+		if record != nil && record.Status != idempotencyStatusCompleted {
+			http.Error(w, "A request with this Idempotency-Key is already in progress", http.StatusConflict)
+			return
+		}
+		replay = record
+
+		if replay == nil {
+			// Keep the key while the upload is received, and release it on failure
+			// so that the client can retry.
+			stop := p.holdIdempotencyKey(userID, idempotencyKey)
+			defer func() {
+				stop()
+				if !posted {
+					p.releaseIdempotencyKey(userID, idempotencyKey)
+				}
+			}()
+		}
 	}
 
-	// Determine if this is audio or video
-	mediaType := r.FormValue("type")
-	isVideo := mediaType == "video"
-
-	// Get the file from form
-	var file multipart.File
-	var handler *multipart.FileHeader
-
-	if isVideo {
-		file, handler, err = r.FormFile("video")
-	} else {
-		file, handler, err = r.FormFile("audio")
+	// Check the recording session before reading the body. The limits it carries
+	// are checked once the form has been parsed.
+	config := p.getConfiguration()
+	var session *recordingSession
+	if config.RequireRecordingSession && replay == nil {
+		var clipErr *clipError
+		if session, clipErr = p.verifySession(r.Header.Get(sessionHeader), userID); clipErr != nil {
+			writeClipError(w, clipErr)
+			return
+		}
 	}
 
-	if err != nil {
-		http.Error(w, "Failed to get media file", http.StatusBadRequest)
-		return
+	// Reject oversized requests before reading them. Each media part is also limited
+	// to the maximum of its media type while being spooled to disk.
+	mediaTypes := config.mediaTypes()
+	var maxFileSize int64
+	for _, t := range mediaTypes.all() {
+		if limit := p.maxFileSize(t); limit > maxFileSize {
+			maxFileSize = limit
+		}
 	}
-	defer file.Close()
+	maxRequestSize := maxFileSize*maxClipMedia + multipartOverhead
 
-	// Read file data
-	data, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+	release, ok := p.admitUpload(w, r, userID, expectedUploadSize(r, maxRequestSize))
+	if !ok {
 		return
 	}
+	defer release()
 
-	// Validate file size using config
-	config := p.getConfiguration()
-	var maxFileSize int64
-	if isVideo {
-		maxFileSize = int64(config.MaxVideoFileSize) * 1024 * 1024
-		if maxFileSize == 0 {
-			maxFileSize = 100 * 1024 * 1024 // Default 100 MB for video
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	form, err := readUploadForm(r, func(field string) (int64, bool) {
+		if t := mediaTypes.get(field); t != nil {
+			return p.maxFileSize(t), true
 		}
-	} else {
-		maxFileSize = int64(config.MaxAudioFileSize) * 1024 * 1024
-		if maxFileSize == 0 {
-			maxFileSize = 50 * 1024 * 1024 // Default 50 MB for audio
+		return 0, false
+	})
+	if err != nil {
+		if isRequestTooLarge(err) {
+			http.Error(w, fmt.Sprintf("File size exceeds maximum allowed (%d MB)", maxFileSize/(1024*1024)), http.StatusRequestEntityTooLarge)
+			return
 		}
-	}
-	if int64(len(data)) > maxFileSize {
-		http.Error(w, fmt.Sprintf("File size exceeds maximum allowed (%d MB)", maxFileSize/(1024*1024)), http.StatusRequestEntityTooLarge)
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
+	defer form.Close()
 
-	// Validate minimum file size (at least 1 KB to prevent empty files)
-	if len(data) < 1024 {
-		http.Error(w, "File is too small or empty", http.StatusBadRequest)
+	channelID := form.Value("channel_id")
+	if channelID == "" {
+		http.Error(w, "channel_id is required", http.StatusBadRequest)
 		return
 	}
 
-	// Determine file extension and mime type based on format
-	extension := filepath.Ext(handler.Filename)
-	if extension == "" {
-		if isVideo {
-			extension = ".webm"
-		} else {
-			extension = ".webm"
+	// Every media part, named after its media type, becomes a file of the post.
+	// Repeated duration fields apply to the media parts in order.
+	durations := form.Values["duration"]
+	media := make([]*clipMedia, 0, len(form.Files))
+	for _, file := range form.Files {
+		m := &clipMedia{Type: mediaTypes.get(file.Field), File: file.spooledFile}
+		if len(media) < len(durations) {
+			m.Duration = durations[len(media)]
 		}
+		media = append(media, m)
 	}
 
-	// Validate file extension using config
-	var allowedFormats string
-	if isVideo {
-		allowedFormats = config.AllowedVideoFormats
-		if allowedFormats == "" {
-			allowedFormats = "webm,mp4,mov"
-		}
-	} else {
-		allowedFormats = config.AllowedAudioFormats
-		if allowedFormats == "" {
-			allowedFormats = "webm,ogg,mp4,m4a,mp3,aac,wav"
+	fingerprint := uploadFingerprint(userID, channelID, media)
+	if replay != nil {
+		if !replay.matches(fingerprint) {
+			http.Error(w, "Idempotency-Key was already used for a different upload", http.StatusUnprocessableEntity)
+			return
 		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"post_id":  replay.PostID,
+			"file_id":  replay.FileID,
+			"file_ids": replay.FileIDs,
+			"job_ids":  replay.JobIDs,
+		})
+		return
 	}
 
-	// Parse allowed formats from config
-	allowedList := strings.Split(allowedFormats, ",")
-	allowedExtensions := make(map[string]bool)
-	for _, ext := range allowedList {
-		ext = strings.TrimSpace(ext)
-		if ext != "" {
-			allowedExtensions["."+ext] = true
+	if session != nil {
+		if clipErr := session.checkMedia(channelID, media); clipErr != nil {
+			writeClipError(w, clipErr)
+			return
 		}
-	}
 
-	if !allowedExtensions[strings.ToLower(extension)] {
-		if isVideo {
-			http.Error(w, fmt.Sprintf("Invalid video file format. Allowed: %s", allowedFormats), http.StatusBadRequest)
-		} else {
-			http.Error(w, fmt.Sprintf("Invalid audio file format. Allowed: %s", allowedFormats), http.StatusBadRequest)
+		// A session can be used for one post only; release it on failure so that
+		// the client can retry.
+		claimed, err := p.claimSession(session)
+		if err != nil {
+			p.API.LogError("Failed to claim recording session", "error", err.Error())
+			http.Error(w, "Failed to verify recording session", http.StatusInternalServerError)
+			return
 		}
-		return
-	}
-
-	// Validate MIME type from file header (magic numbers)
-	if !isValidMediaFile(data, extension, isVideo) {
-		http.Error(w, "File content does not match expected format", http.StatusBadRequest)
-		return
+		if !claimed {
+			http.Error(w, "Recording session has already been used", http.StatusConflict)
+			return
+		}
+		defer func() {
+			if posted {
+				p.completeSession(session)
+			} else {
+				p.releaseSession(session)
+			}
+		}()
 	}
 
-	// Validate channel access
-	if !p.API.HasPermissionToChannel(userID, channelID, model.PermissionCreatePost) {
-		http.Error(w, "No permission to post in this channel", http.StatusForbidden)
+	result, clipErr := p.createClip(&clipRequest{
+		UserID:    userID,
+		ChannelID: channelID,
+		Media:     media,
+		FileIDs:   form.List("file_ids"),
+		Message:   form.Value("message"),
+		RootID:    form.Value("root_id"),
+	})
+	if clipErr != nil {
+		writeClipError(w, clipErr)
 		return
 	}
+	posted = true
 
-	// Validate duration
-	durationStr := r.FormValue("duration")
-	duration := 0
-	if durationStr != "" {
-		var parseErr error
-		duration, parseErr = strconv.Atoi(durationStr)
-		if parseErr != nil {
-			p.API.LogWarn("Invalid duration format", "duration", durationStr, "error", parseErr.Error())
-			duration = 0
-		}
-		// Validate against max duration from config (separate for audio and video)
-		var maxDuration int
-		if isVideo {
-			maxDuration = config.MaxVideoDuration
-			if maxDuration == 0 {
-				maxDuration = 120 // Default 2 minutes for video
-			}
-		} else {
-			maxDuration = config.MaxDuration
-			if maxDuration == 0 {
-				maxDuration = 300 // Default 5 minutes for audio
-			}
-		}
-		if duration > maxDuration {
-			http.Error(w, fmt.Sprintf("Duration exceeds maximum allowed (%d seconds)", maxDuration), http.StatusBadRequest)
-			return
+	if idempotencyKey != "" {
+		if err := p.completeIdempotencyKey(userID, idempotencyKey, fingerprint, result); err != nil {
+			p.API.LogError("Failed to store idempotency key", "error", err.Error())
 		}
 	}
 
-	// Generate filename with timestamp
-	timestamp := time.Now().Unix()
-	var filename string
-	if isVideo {
-		filename = fmt.Sprintf("video_clip_%d%s", timestamp, extension)
-	} else {
-		filename = fmt.Sprintf("voice_clip_%d%s", timestamp, extension)
+	// Return success response
+	response := map[string]interface{}{
+		"post_id":  result.Post.Id,
+		"file_id":  result.FileInfo.Id,
+		"file_ids": result.FileIDs,
+		"job_ids":  result.JobIDs,
 	}
 
-	// Upload file to Mattermost
-	fileInfo, appErr := p.API.UploadFile(data, channelID, filename)
-	if appErr != nil {
-		p.API.LogError("Failed to upload file", "error", appErr.Error())
-		http.Error(w, "Failed to upload file: "+appErr.Error(), http.StatusInternalServerError)
-		return
-	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
 
-	// Create post with the media file
-	var post *model.Post
-	if isVideo {
-		post = &model.Post{
-			UserId:    userID,
-			ChannelId: channelID,
-			Message:   "📹 Video message",
-			FileIds:   []string{fileInfo.Id},
-			Type:      "custom_video_clip",
-			Props: map[string]interface{}{
-				"video_clip": map[string]interface{}{
-					"duration": duration,
-					"format":   extension,
-				},
-			},
-		}
-	} else {
-		post = &model.Post{
-			UserId:    userID,
-			ChannelId: channelID,
-			Message:   "🎤 Voice message",
-			FileIds:   []string{fileInfo.Id},
-			Type:      "custom_voice_clip",
-			Props: map[string]interface{}{
-				"voice_clip": map[string]interface{}{
-					"duration": duration,
-					"format":   extension,
-				},
-			},
-		}
+// handleStats returns upload admission counters to system admins
+func (p *Plugin) handleStats(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
 	}
-
-	createdPost, appErr := p.API.CreatePost(post)
-	if appErr != nil {
-		p.API.LogError("Failed to create post", "error", appErr.Error())
-		http.Error(w, "Failed to create post: "+appErr.Error(), http.StatusInternalServerError)
+	if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	// Return success response
 	response := map[string]interface{}{
-		"post_id": createdPost.Id,
-		"file_id": fileInfo.Id,
+		"uploads": p.admission.Stats(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(response)
 }
 
+// ServeMetrics exposes upload admission metrics in the Prometheus format
+func (p *Plugin) ServeMetrics(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	writeAdmissionMetrics(w, p.admission.Stats())
+}
+
 // handleConfig returns plugin configuration
 func (p *Plugin) handleConfig(w http.ResponseWriter, r *http.Request) {
 	config := p.getConfiguration()
+	mediaTypes := config.mediaTypes()
+	userID := r.Header.Get("Mattermost-User-Id")
+
+	// Guests see their own limits and what they may do with clips of others.
+	guest := false
+	if userID != "" {
+		var clipErr *clipError
+		if guest, clipErr = p.isGuest(userID); clipErr != nil {
+			writeClipError(w, clipErr)
+			return
+		}
+	}
+	restrictions := config.guestRestrictions()
+
+	types := make([]map[string]interface{}, 0, len(mediaTypes.all()))
+	for _, t := range mediaTypes.all() {
+		maxDuration, maxFileSize := t.MaxDuration, p.maxFileSize(t)
+		if guest {
+			maxDuration, maxFileSize = restrictions.maxDuration(t), p.guestMaxFileSize(restrictions, t)
+		}
+		types = append(types, map[string]interface{}{
+			"name":            t.Name,
+			"label":           t.Label,
+			"player":          t.Player,
+			"post_type":       t.PostType,
+			"props_key":       t.PropsKey,
+			"max_duration":    maxDuration,
+			"max_file_size":   maxFileSize / (1024 * 1024),
+			"allowed_formats": t.AllowedFormats,
+		})
+	}
 
 	response := map[string]interface{}{
 		// Audio settings
 		"max_duration":        config.MaxDuration,
 		"audio_format":        config.AudioFormat,
 		"enable_waveform":     config.EnableWaveform,
-		"max_audio_file_size": config.MaxAudioFileSize,
+		"max_audio_file_size": p.maxFileSize(mediaTypes.get("audio")) / (1024 * 1024),
 		"audio_bitrate":       config.AudioBitrate,
 
 		// Video settings
 		"max_video_duration":  config.MaxVideoDuration,
 		"video_format":        config.VideoFormat,
-		"max_video_file_size": config.MaxVideoFileSize,
+		"max_video_file_size": p.maxFileSize(mediaTypes.get("video")) / (1024 * 1024),
 		"video_bitrate":       config.VideoBitrate,
 
 		// Allowed formats
 		"allowed_audio_formats": config.AllowedAudioFormats,
 		"allowed_video_formats": config.AllowedVideoFormats,
+
+		// Every media type, including screen recordings and custom types
+		"media_types": types,
+
+		// Availability
+		"recording_available": true,
+
+		// Playback
+		"can_view_transcripts": !guest || restrictions.Transcripts,
+		"can_download":         !guest || restrictions.Downloads,
+	}
+
+	// Report whether recording is possible, in the given channel when there is one.
+	clipErr := p.checkFileAttachments()
+	if channelID := r.URL.Query().Get("channel_id"); clipErr == nil && channelID != "" && userID != "" {
+		clipErr = p.checkUploadAccess(userID, channelID)
+	}
+	if clipErr != nil {
+		response["recording_available"] = false
+		response["unavailable_reason"] = clipErr.Message
+	}
+
+	// Report which media types the user may post, so that clients can hide the
+	// recorders of the others.
+	if userID != "" {
+		subject := p.newPolicySubject(userID, r.URL.Query().Get("channel_id"))
+		for i, t := range mediaTypes.all() {
+			if guest && !restrictions.allows(t) {
+				types[i]["allowed"] = false
+				types[i]["unavailable_reason"] = guestTypeDenied(t).Message
+				continue
+			}
+			allowed, err := subject.allows(config.mediaPolicy(t))
+			if err != nil {
+				p.API.LogWarn("Failed to check media policy", "user_id", userID, "media_type", t.Name, "error", err.Error())
+				continue
+			}
+			types[i]["allowed"] = allowed
+			if !allowed {
+				types[i]["unavailable_reason"] = mediaPolicyDenied(t).Message
+			}
+		}
+	}
+
+	// Report storage usage when quotas are enforced, for the team of the channel
+	// when there is one.
+	if userID != "" && (config.userStorageQuota() > 0 || config.teamStorageQuota() > 0) {
+		teamID := ""
+		if channelID := r.URL.Query().Get("channel_id"); channelID != "" {
+			teamID, _ = p.channelTeamID(channelID)
+		}
+		if usage, err := p.storageUsageResponse(userID, teamID); err != nil {
+			p.API.LogWarn("Failed to get storage usage", "user_id", userID, "error", err.Error())
+		} else {
+			response["storage_usage"] = usage
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -302,24 +420,51 @@ func (p *Plugin) handleConfig(w http.ResponseWriter, r *http.Request) {
 func (p *Plugin) OnActivate() error {
 	p.client = pluginapi.NewClient(p.API, p.Driver)
 
+	botUserID, err := p.API.EnsureBotUser(&model.Bot{
+		Username:    "voice-clips",
+		DisplayName: "Voice Clips",
+		Description: "Sends notifications from the Voice & Video Clips plugin.",
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to ensure bot user")
+	}
+	p.botUserID = botUserID
+
 	// Register slash commands
 	if err := p.registerCommands(); err != nil {
 		return err
 	}
 
+	job, err := cluster.Schedule(p.API, "recording_recovery", cluster.MakeWaitForInterval(time.Minute), p.recoverAbandonedRecordings)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule recording recovery job")
+	}
+	p.recoveryJob = job
+
+	job, err = cluster.Schedule(p.API, "orphan_reconciliation", cluster.MakeWaitForInterval(time.Hour), p.reconcileOrphanedFiles)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule orphaned file reconciliation job")
+	}
+	p.reconcileJob = job
+
+	p.jobQueue = p.startJobQueue(p.getConfiguration().jobWorkers())
+
 	p.API.LogInfo("Voice Clips plugin activated")
 	return nil
 }
 
-// registerCommands registers /voice and /video slash commands
+// registerCommands registers /voice and /video slash commands. Commands are shared
+// by all users, so their descriptions use the server's default locale.
 func (p *Plugin) registerCommands() error {
+	locale := p.serverLocale()
+
 	// Register /voice command
 	if err := p.API.RegisterCommand(&model.Command{
 		Trigger:          "voice",
-		DisplayName:      "Voice Message",
-		Description:      "Record and send a voice message",
+		DisplayName:      translate(locale, "command.voice.name"),
+		Description:      translate(locale, "command.voice.description"),
 		AutoComplete:     true,
-		AutoCompleteDesc: "Open voice message recorder",
+		AutoCompleteDesc: translate(locale, "command.voice.autocomplete"),
 		AutoCompleteHint: "",
 	}); err != nil {
 		return err
@@ -328,22 +473,33 @@ func (p *Plugin) registerCommands() error {
 	// Register /video command
 	return p.API.RegisterCommand(&model.Command{
 		Trigger:          "video",
-		DisplayName:      "Video Message",
-		Description:      "Record and send a video message",
+		DisplayName:      translate(locale, "command.video.name"),
+		Description:      translate(locale, "command.video.description"),
 		AutoComplete:     true,
-		AutoCompleteDesc: "Open video message recorder",
+		AutoCompleteDesc: translate(locale, "command.video.autocomplete"),
 		AutoCompleteHint: "",
 	})
 }
 
 // ExecuteCommand handles the /voice and /video commands
 func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	locale := p.userLocale(p.getUserForText(args.UserId))
+
+	if message := p.commandPolicyMessage(args, locale); message != "" {
+		p.API.SendEphemeralPost(args.UserId, &model.Post{
+			UserId:    args.UserId,
+			ChannelId: args.ChannelId,
+			Message:   message,
+		})
+		return &model.CommandResponse{}, nil
+	}
+
 	switch args.Command {
 	case "/voice":
 		post := &model.Post{
 			UserId:    args.UserId,
 			ChannelId: args.ChannelId,
-			Message:   "🎤 Click the microphone button in the channel header to record a voice message, or wait for the recorder to open automatically.",
+			Message:   translate(locale, "command.voice.hint"),
 		}
 		p.API.SendEphemeralPost(args.UserId, post)
 
@@ -357,7 +513,7 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		post := &model.Post{
 			UserId:    args.UserId,
 			ChannelId: args.ChannelId,
-			Message:   "📹 Click the video button in the channel header to record a video message, or wait for the recorder to open automatically.",
+			Message:   translate(locale, "command.video.hint"),
 		}
 		p.API.SendEphemeralPost(args.UserId, post)
 
@@ -373,6 +529,20 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 
 // OnDeactivate is called when the plugin is deactivated
 func (p *Plugin) OnDeactivate() error {
+	if p.recoveryJob != nil {
+		if err := p.recoveryJob.Close(); err != nil {
+			p.API.LogWarn("Failed to close recording recovery job", "error", err.Error())
+		}
+	}
+	if p.reconcileJob != nil {
+		if err := p.reconcileJob.Close(); err != nil {
+			p.API.LogWarn("Failed to close orphaned file reconciliation job", "error", err.Error())
+		}
+	}
+	if p.jobQueue != nil {
+		p.jobQueue.Stop()
+	}
+
 	p.API.LogInfo("Voice Clips plugin deactivated")
 	return nil
 }
@@ -2,16 +2,21 @@ package main
 
 import (
 	"bytes"
+	"encoding/gob"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIsValidMediaFile(t *testing.T) {
@@ -112,6 +117,7 @@ func TestIsValidMediaFile(t *testing.T) {
 func TestHandleConfig(t *testing.T) {
 	// Setup
 	api := &plugintest.API{}
+	mockUploadAccess(api)
 	plugin := &Plugin{}
 	plugin.SetAPI(api)
 
@@ -145,6 +151,7 @@ func TestHandleUpload_MethodNotAllowed(t *testing.T) {
 	api := &plugintest.API{}
 	plugin := &Plugin{}
 	plugin.SetAPI(api)
+	mockUploadAccess(api)
 
 	// Create GET request (should fail)
 	req := httptest.NewRequest("GET", "/api/v1/upload", nil)
@@ -163,6 +170,7 @@ func TestHandleUpload_Unauthorized(t *testing.T) {
 	api := &plugintest.API{}
 	plugin := &Plugin{}
 	plugin.SetAPI(api)
+	mockUploadAccess(api)
 
 	// Create request without user ID
 	req := httptest.NewRequest("POST", "/api/v1/upload", nil)
@@ -181,6 +189,7 @@ func TestHandleUpload_MissingChannelID(t *testing.T) {
 	api := &plugintest.API{}
 	plugin := &Plugin{}
 	plugin.SetAPI(api)
+	mockUploadAccess(api)
 
 	// Create multipart request without channel_id
 	body := &bytes.Buffer{}
@@ -207,6 +216,7 @@ func TestExecuteCommand_Voice(t *testing.T) {
 	plugin.SetAPI(api)
 
 	// Mock expectations
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Locale: "en"}, nil)
 	api.On("SendEphemeralPost", "user123", mock.AnythingOfType("*model.Post")).Return(nil)
 	api.On("PublishWebSocketEvent", "open_voice_recorder", mock.Anything, mock.Anything).Return()
 
@@ -255,3 +265,130 @@ func TestGetConfiguration_Default(t *testing.T) {
 	assert.Equal(t, "webm", config.AudioFormat)
 	assert.Equal(t, true, config.EnableWaveform)
 }
+
+// mockKVStore wires the KV methods of api to an in-memory map. Expiry is ignored.
+func mockKVStore(api *plugintest.API) map[string][]byte {
+	store := make(map[string][]byte)
+	var lock sync.Mutex
+
+	api.On("KVGet", mock.AnythingOfType("string")).Return(func(key string) []byte {
+		lock.Lock()
+		defer lock.Unlock()
+		return store[key]
+	}, nil).Maybe()
+	api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Return(func(key string, value []byte) *model.AppError {
+		lock.Lock()
+		defer lock.Unlock()
+		store[key] = value
+		return nil
+	}).Maybe()
+	api.On("KVSetWithExpiry", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("int64")).Return(func(key string, value []byte, _ int64) *model.AppError {
+		lock.Lock()
+		defer lock.Unlock()
+		store[key] = value
+		return nil
+	}).Maybe()
+	api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(func(key string, value []byte, options model.PluginKVSetOptions) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if options.Atomic && !bytes.Equal(store[key], options.OldValue) {
+			return false
+		}
+		if value == nil {
+			delete(store, key)
+		} else {
+			store[key] = value
+		}
+		return true
+	}, nil).Maybe()
+	api.On("KVDelete", mock.AnythingOfType("string")).Return(func(key string) *model.AppError {
+		lock.Lock()
+		defer lock.Unlock()
+		delete(store, key)
+		return nil
+	}).Maybe()
+
+	return store
+}
+
+// mockUploadAccess stubs the server config, channel lookup, upload_file permission
+// and author lookup used by every upload with permissive defaults. Register more
+// specific expectations before calling it to override them.
+func mockUploadAccess(api *plugintest.API) {
+	config := &model.Config{}
+	config.SetDefaults()
+
+	api.On("GetConfig").Return(config).Maybe()
+	api.On("GetChannel", mock.AnythingOfType("string")).Return(func(channelID string) *model.Channel {
+		return &model.Channel{Id: channelID}
+	}, nil).Maybe()
+	api.On("HasPermissionToChannel", mock.AnythingOfType("string"), mock.AnythingOfType("string"), model.PermissionUploadFile).Return(true).Maybe()
+	api.On("GetUser", mock.AnythingOfType("string")).Return(func(userID string) *model.User {
+		return &model.User{Id: userID, Username: "alice", Locale: "en"}
+	}, nil).Maybe()
+}
+
+// kvKeysWithPrefix returns the keys in a mockKVStore map that start with prefix.
+func kvKeysWithPrefix(store map[string][]byte, prefix string) []string {
+	var keys []string
+	for key := range store {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// addSession signs a recording session for user123 and adds it to req. The session
+// started long enough ago to cover any test duration.
+func addSession(t *testing.T, plugin *Plugin, req *http.Request, channelID, mediaType string) {
+	if plugin.signingKey == nil {
+		plugin.signingKey = []byte("test-signing-key")
+	}
+
+	token, err := plugin.encodeSession(&recordingSession{
+		ID:          model.NewId(),
+		UserID:      "user123",
+		ChannelID:   channelID,
+		Type:        mediaType,
+		MaxDuration: 300,
+		MaxFileSize: 100 * 1024 * 1024,
+		IssuedAt:    time.Now().Add(-5 * time.Minute).UnixMilli(),
+		ExpiresAt:   time.Now().Add(time.Hour).UnixMilli(),
+	})
+	require.NoError(t, err)
+	req.Header.Set(sessionHeader, token)
+}
+
+// newUploadRequest builds a multipart upload request for user123.
+func newUploadRequest(t *testing.T, fields map[string]string, fileField string, data []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if fileField != "" {
+		part, err := writer.CreateFormFile(fileField, "clip.webm")
+		require.NoError(t, err)
+		_, err = part.Write(data)
+		require.NoError(t, err)
+	}
+	for key, value := range fields {
+		require.NoError(t, writer.WriteField(key, value))
+	}
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Mattermost-User-Id", "user123")
+	return req
+}
+
+// requireGobEncodable checks that a post can cross plugin RPC, which encodes posts
+// with gob. The plugintest mocks never encode them, so props of a type gob does not
+// know would otherwise only fail on a real server.
+func requireGobEncodable(t *testing.T, post *model.Post) {
+	require.NoError(t, gob.NewEncoder(io.Discard).Encode(post))
+}
+
+// testWebM returns a minimal payload with a WebM signature that passes validation.
+func testWebM() []byte {
+	return append([]byte{0x1A, 0x45, 0xDF, 0xA3}, bytes.Repeat([]byte{0x00}, 2044)...)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// Kinds of media policy rules, written as "<kind>:<value>".
+const (
+	policyRuleSystemRole  = "system_role"
+	policyRuleTeamRole    = "team_role"
+	policyRuleChannelRole = "channel_role"
+	policyRuleGroup       = "group"
+	policyRuleUser        = "user"
+)
+
+// policyRule matches users by a role, group or user id.
+type policyRule struct {
+	Kind  string
+	Value string
+}
+
+// mediaPolicy restricts who may post clips of a media type. Deny rules win; with
+// allow rules, only users matching one of them may post.
+type mediaPolicy struct {
+	Allow []policyRule
+	Deny  []policyRule
+}
+
+// parsePolicyRules parses rules such as "team_role:team_admin" or "group:<id>".
+func parsePolicyRules(rules []string) ([]policyRule, error) {
+	parsed := make([]policyRule, 0, len(rules))
+	for _, rule := range rules {
+		kind, value, _ := strings.Cut(strings.TrimSpace(rule), ":")
+		value = strings.TrimSpace(value)
+		switch kind {
+		case policyRuleSystemRole, policyRuleTeamRole, policyRuleChannelRole, policyRuleGroup, policyRuleUser:
+		default:
+			return nil, errors.Errorf("rule %q must start with system_role:, team_role:, channel_role:, group: or user:", rule)
+		}
+		if value == "" {
+			return nil, errors.Errorf("rule %q has no value", rule)
+		}
+		parsed = append(parsed, policyRule{Kind: kind, Value: value})
+	}
+	return parsed, nil
+}
+
+// loadMediaPolicies parses the MediaPolicies setting: a JSON object mapping a media
+// type name to its "allow" and "deny" rules.
+func (c *configuration) loadMediaPolicies(registry *mediaTypeRegistry) (map[string]*mediaPolicy, error) {
+	if strings.TrimSpace(c.MediaPolicies) == "" {
+		return nil, nil
+	}
+
+	var raw map[string]struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	if err := json.Unmarshal([]byte(c.MediaPolicies), &raw); err != nil {
+		return nil, errors.Wrap(err, "failed to parse media policies")
+	}
+
+	policies := make(map[string]*mediaPolicy, len(raw))
+	for name, rules := range raw {
+		if registry.get(name) == nil {
+			return nil, errors.Errorf("media policy for unknown media type %q", name)
+		}
+		allow, err := parsePolicyRules(rules.Allow)
+		if err != nil {
+			return nil, errors.Wrapf(err, "media type %q", name)
+		}
+		deny, err := parsePolicyRules(rules.Deny)
+		if err != nil {
+			return nil, errors.Wrapf(err, "media type %q", name)
+		}
+		policies[name] = &mediaPolicy{Allow: allow, Deny: deny}
+	}
+	return policies, nil
+}
+
+// policySubject is a user in a channel, with the roles and groups that policy rules
+// look at. They are fetched on first use, so that a check only calls the APIs its
+// rules need.
+type policySubject struct {
+	p         *Plugin
+	userID    string
+	channelID string
+
+	// values holds the roles or group ids of the user, by rule kind.
+	values map[string]map[string]bool
+}
+
+func (p *Plugin) newPolicySubject(userID, channelID string) *policySubject {
+	return &policySubject{p: p, userID: userID, channelID: channelID, values: make(map[string]map[string]bool)}
+}
+
+// matches reports whether the user matches rule.
+func (s *policySubject) matches(rule policyRule) (bool, error) {
+	if rule.Kind == policyRuleUser {
+		return rule.Value == s.userID, nil
+	}
+	values, ok := s.values[rule.Kind]
+	if !ok {
+		var err error
+		if values, err = s.load(rule.Kind); err != nil {
+			return false, err
+		}
+		s.values[rule.Kind] = values
+	}
+	return values[rule.Value], nil
+}
+
+// load fetches the roles or group ids of the user for a rule kind. Users that are
+// not members of the team or channel have no roles there; neither do direct and
+// group messages, which belong to no team, or checks without a channel.
+func (s *policySubject) load(kind string) (map[string]bool, error) {
+	values := make(map[string]bool)
+	if s.channelID == "" && (kind == policyRuleTeamRole || kind == policyRuleChannelRole) {
+		return values, nil
+	}
+	switch kind {
+	case policyRuleSystemRole:
+		user, appErr := s.p.API.GetUser(s.userID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		for _, role := range strings.Fields(user.Roles) {
+			values[role] = true
+		}
+
+	case policyRuleTeamRole:
+		teamID, err := s.p.channelTeamID(s.channelID)
+		if err != nil {
+			return nil, err
+		}
+		if teamID == "" {
+			return values, nil
+		}
+		member, appErr := s.p.API.GetTeamMember(teamID, s.userID)
+		if appErr != nil {
+			if appErr.StatusCode == http.StatusNotFound {
+				return values, nil
+			}
+			return nil, appErr
+		}
+		for _, role := range strings.Fields(member.Roles) {
+			values[role] = true
+		}
+
+	case policyRuleChannelRole:
+		member, appErr := s.p.API.GetChannelMember(s.channelID, s.userID)
+		if appErr != nil {
+			if appErr.StatusCode == http.StatusNotFound {
+				return values, nil
+			}
+			return nil, appErr
+		}
+		for _, role := range strings.Fields(member.Roles) {
+			values[role] = true
+		}
+
+	case policyRuleGroup:
+		groups, appErr := s.p.API.GetGroupsForUser(s.userID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		for _, group := range groups {
+			values[group.Id] = true
+		}
+	}
+	return values, nil
+}
+
+// allows reports whether policy lets the user post clips.
+func (s *policySubject) allows(policy *mediaPolicy) (bool, error) {
+	if policy == nil {
+		return true, nil
+	}
+	for _, rule := range policy.Deny {
+		matched, err := s.matches(rule)
+		if err != nil || matched {
+			return false, err
+		}
+	}
+	if len(policy.Allow) == 0 {
+		return true, nil
+	}
+	for _, rule := range policy.Allow {
+		matched, err := s.matches(rule)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// mediaPolicy returns the policy of a media type, or nil if anyone may post it.
+func (c *configuration) mediaPolicy(t *mediaType) *mediaPolicy {
+	return c.mediaPolicies[t.Name]
+}
+
+// checkMediaPolicy checks that the user may post clips of each media type in the
+// channel.
+func (p *Plugin) checkMediaPolicy(userID, channelID string, types ...*mediaType) *clipError {
+	config := p.getConfiguration()
+	subject := p.newPolicySubject(userID, channelID)
+	for _, t := range types {
+		allowed, err := subject.allows(config.mediaPolicy(t))
+		if err != nil {
+			p.API.LogError("Failed to check media policy", "user_id", userID, "media_type", t.Name, "error", err.Error())
+			return &clipError{Status: http.StatusInternalServerError, Message: "Failed to check media permissions"}
+		}
+		if !allowed {
+			return mediaPolicyDenied(t)
+		}
+	}
+	return nil
+}
+
+// mediaPolicyDenied is the error for media a policy does not allow the user to post.
+func mediaPolicyDenied(t *mediaType) *clipError {
+	return &clipError{Status: http.StatusForbidden, Message: fmt.Sprintf("You are not allowed to send %s clips", t.Label), Retryable: true}
+}
+
+// commandMediaTypes maps slash commands to the media type they record.
+var commandMediaTypes = map[string]string{
+	"/voice": "audio",
+	"/video": "video",
+}
+
+// commandPolicyMessage returns the message shown to a user whose slash command is
+// denied by the guest restrictions or a media policy, or "" if the command is allowed.
+func (p *Plugin) commandPolicyMessage(args *model.CommandArgs, locale string) string {
+	config := p.getConfiguration()
+	t := config.mediaTypes().get(commandMediaTypes[args.Command])
+	if t == nil {
+		return ""
+	}
+	guest, clipErr := p.isGuest(args.UserId)
+	if clipErr == nil && guest && !config.guestRestrictions().allows(t) {
+		clipErr = guestTypeDenied(t)
+	}
+	if clipErr == nil {
+		clipErr = p.checkMediaPolicy(args.UserId, args.ChannelId, t)
+	}
+	if clipErr == nil {
+		return ""
+	}
+	if clipErr.Status != http.StatusForbidden {
+		return clipErr.Message
+	}
+	return translate(locale, "command."+strings.TrimPrefix(args.Command, "/")+".denied")
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testMediaPolicies = `{
+	"video": {
+		"allow": ["group:group1", "team_role:team_admin", "channel_role:channel_admin", "user:user5"],
+		"deny": ["system_role:system_guest"]
+	}
+}`
+
+func newPolicyPlugin(t *testing.T, api *plugintest.API, policies string) *Plugin {
+	config := &configuration{MediaPolicies: policies}
+	loaded, err := config.loadMediaPolicies(config.mediaTypes())
+	require.NoError(t, err)
+	config.mediaPolicies = loaded
+
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(config)
+	return plugin
+}
+
+// mockPolicyUsers sets up the roles and groups of the users in policy tests.
+func mockPolicyUsers(api *plugintest.API) {
+	notFound := model.NewAppError("GetMember", "not_found", nil, "", http.StatusNotFound)
+	users := []struct {
+		id           string
+		systemRoles  string
+		teamRoles    string
+		channelRoles string
+		groups       []*model.Group
+	}{
+		{"user1", "system_user", "team_user", "channel_user", []*model.Group{{Id: "group1"}}},
+		{"user2", "system_user", "team_user team_admin", "channel_user", nil},
+		{"user3", "system_user", "team_user", "channel_user", []*model.Group{{Id: "group2"}}},
+		{"user4", "system_guest", "team_guest", "channel_guest", []*model.Group{{Id: "group1"}}},
+		{"user5", "system_user", "", "", nil},
+		{"user6", "system_user", "team_user", "channel_user channel_admin", nil},
+	}
+	for _, u := range users {
+		api.On("GetUser", u.id).Return(&model.User{Id: u.id, Roles: u.systemRoles, Locale: "en"}, nil).Maybe()
+		api.On("GetGroupsForUser", u.id).Return(u.groups, nil).Maybe()
+		if u.teamRoles == "" {
+			api.On("GetTeamMember", "team123", u.id).Return(nil, notFound).Maybe()
+			api.On("GetChannelMember", "channel123", u.id).Return(nil, notFound).Maybe()
+			continue
+		}
+		api.On("GetTeamMember", "team123", u.id).Return(&model.TeamMember{TeamId: "team123", UserId: u.id, Roles: u.teamRoles}, nil).Maybe()
+		api.On("GetChannelMember", "channel123", u.id).Return(&model.ChannelMember{ChannelId: "channel123", UserId: u.id, Roles: u.channelRoles}, nil).Maybe()
+	}
+	api.On("GetChannel", "channel123").Return(&model.Channel{Id: "channel123", TeamId: "team123"}, nil).Maybe()
+	api.On("GetChannel", "dm123").Return(&model.Channel{Id: "dm123", Type: model.ChannelTypeDirect}, nil).Maybe()
+	api.On("GetChannelMember", "dm123", mock.Anything).Return(&model.ChannelMember{Roles: "channel_user"}, nil).Maybe()
+}
+
+func TestLoadMediaPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies string
+		err      string
+	}{
+		{"empty", "", ""},
+		{"valid", testMediaPolicies, ""},
+		{"invalid json", `{"video": [`, "failed to parse media policies"},
+		{"unknown type", `{"podcast": {"deny": ["user:user1"]}}`, `media policy for unknown media type "podcast"`},
+		{"unknown rule", `{"video": {"allow": ["role:team_admin"]}}`, `must start with system_role:`},
+		{"empty value", `{"audio": {"deny": ["group:"]}}`, `has no value`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &configuration{MediaPolicies: tt.policies}
+			policies, err := config.loadMediaPolicies(config.mediaTypes())
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.policies != "" {
+				assert.Len(t, policies["video"].Allow, 4)
+				assert.Equal(t, []policyRule{{Kind: policyRuleSystemRole, Value: "system_guest"}}, policies["video"].Deny)
+			}
+		})
+	}
+}
+
+func TestCheckMediaPolicy(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := newPolicyPlugin(t, api, testMediaPolicies)
+	mockPolicyUsers(api)
+	video := plugin.getConfiguration().mediaTypes().get("video")
+	audio := plugin.getConfiguration().mediaTypes().get("audio")
+
+	tests := []struct {
+		name      string
+		userID    string
+		channelID string
+		allowed   bool
+	}{
+		{"member of allowed group", "user1", "channel123", true},
+		{"team admin", "user2", "channel123", true},
+		{"no matching rule", "user3", "channel123", false},
+		{"denied guest in allowed group", "user4", "channel123", false},
+		{"allowed user id", "user5", "channel123", true},
+		{"channel admin", "user6", "channel123", true},
+		{"team admin outside a team", "user2", "dm123", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clipErr := plugin.checkMediaPolicy(tt.userID, tt.channelID, audio, video)
+			if tt.allowed {
+				assert.Nil(t, clipErr)
+				return
+			}
+			require.NotNil(t, clipErr)
+			assert.Equal(t, http.StatusForbidden, clipErr.Status)
+			assert.Equal(t, "You are not allowed to send video clips", clipErr.Message)
+		})
+	}
+
+	// Types without a policy are allowed without looking the user up.
+	checker := &plugintest.API{}
+	plugin.SetAPI(checker)
+	assert.Nil(t, plugin.checkMediaPolicy("user3", "channel123", audio))
+	checker.AssertExpectations(t)
+}
+
+func TestCheckMediaPolicy_Error(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := newPolicyPlugin(t, api, testMediaPolicies)
+	api.On("GetUser", "user1").Return(nil, model.NewAppError("GetUser", "app_error", nil, "", http.StatusInternalServerError))
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	clipErr := plugin.checkMediaPolicy("user1", "channel123", plugin.getConfiguration().mediaTypes().get("video"))
+	require.NotNil(t, clipErr)
+	assert.Equal(t, http.StatusInternalServerError, clipErr.Status)
+	assert.Equal(t, "Failed to check media permissions", clipErr.Message)
+}
+
+func TestHandleCreateSession_MediaPolicy(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := newPolicyPlugin(t, api, testMediaPolicies)
+	mockPolicyUsers(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+	api.On("HasPermissionToChannel", "user3", "channel123", model.PermissionCreatePost).Return(true)
+
+	for _, tt := range []struct {
+		mediaType      string
+		expectedStatus int
+	}{
+		{"audio", http.StatusOK},
+		{"video", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, sessionsPath, strings.NewReader(`{"channel_id":"channel123","type":"`+tt.mediaType+`"}`))
+		req.Header.Set("Mattermost-User-Id", "user3")
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, req)
+		assert.Equal(t, tt.expectedStatus, w.Result().StatusCode, tt.mediaType)
+	}
+}
+
+func TestHandleUpload_MediaPolicy(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := newPolicyPlugin(t, api, testMediaPolicies)
+	mockPolicyUsers(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+	plugin.getConfiguration().RequireRecordingSession = false
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Roles: "system_user"}, nil)
+	api.On("GetGroupsForUser", "user123").Return([]*model.Group{}, nil)
+	api.On("GetTeamMember", "team123", "user123").Return(&model.TeamMember{Roles: "team_user"}, nil)
+	api.On("GetChannelMember", "channel123", "user123").Return(&model.ChannelMember{Roles: "channel_user"}, nil)
+
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123"}, "video", testWebM())
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "You are not allowed to send video clips")
+	api.AssertNotCalled(t, "UploadFile", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestExecuteCommand_MediaPolicy(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := newPolicyPlugin(t, api, testMediaPolicies)
+	mockPolicyUsers(api)
+	api.On("GetUser", "user7").Return(&model.User{Id: "user7", Roles: "system_user", Locale: "de"}, nil)
+	api.On("GetGroupsForUser", "user7").Return([]*model.Group{}, nil)
+	api.On("GetTeamMember", "team123", "user7").Return(&model.TeamMember{Roles: "team_user"}, nil)
+	api.On("GetChannelMember", "channel123", "user7").Return(&model.ChannelMember{Roles: "channel_user"}, nil)
+	api.On("SendEphemeralPost", "user7", mock.AnythingOfType("*model.Post")).Return(nil)
+	api.On("PublishWebSocketEvent", "open_voice_recorder", mock.Anything, mock.Anything).Return()
+
+	resp, appErr := plugin.ExecuteCommand(nil, &model.CommandArgs{Command: "/video", UserId: "user7", ChannelId: "channel123"})
+	assert.Nil(t, appErr)
+	assert.NotNil(t, resp)
+	api.AssertCalled(t, "SendEphemeralPost", "user7", mock.MatchedBy(func(post *model.Post) bool {
+		return post.Message == "🚫 Du darfst keine Videonachrichten senden."
+	}))
+	api.AssertNotCalled(t, "PublishWebSocketEvent", "open_video_recorder", mock.Anything, mock.Anything)
+
+	// Voice has no policy.
+	_, appErr = plugin.ExecuteCommand(nil, &model.CommandArgs{Command: "/voice", UserId: "user7", ChannelId: "channel123"})
+	assert.Nil(t, appErr)
+	api.AssertCalled(t, "PublishWebSocketEvent", "open_voice_recorder", mock.Anything, mock.Anything)
+}
+
+func TestHandleConfig_MediaPolicy(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := newPolicyPlugin(t, api, testMediaPolicies)
+	mockPolicyUsers(api)
+	mockUploadAccess(api)
+	api.On("HasPermissionToChannel", mock.Anything, "channel123", model.PermissionCreatePost).Return(true)
+
+	getTypes := func(userID, query string) map[string]map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/config"+query, nil)
+		req.Header.Set("Mattermost-User-Id", userID)
+		w := httptest.NewRecorder()
+		plugin.handleConfig(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var response struct {
+			MediaTypes []map[string]interface{} `json:"media_types"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		types := make(map[string]map[string]interface{})
+		for _, t := range response.MediaTypes {
+			types[t["name"].(string)] = t
+		}
+		return types
+	}
+
+	types := getTypes("user3", "?channel_id=channel123")
+	assert.Equal(t, true, types["audio"]["allowed"])
+	assert.Equal(t, false, types["video"]["allowed"])
+	assert.Equal(t, "You are not allowed to send video clips", types["video"]["unavailable_reason"])
+
+	types = getTypes("user2", "?channel_id=channel123")
+	assert.Equal(t, true, types["video"]["allowed"])
+
+	// Without a channel, team and channel roles do not apply.
+	types = getTypes("user2", "")
+	assert.Equal(t, false, types["video"]["allowed"])
+}
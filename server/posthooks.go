@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+const (
+	forgedClipActionReject    = "reject"
+	forgedClipActionDowngrade = "downgrade"
+)
+
+// MessageWillBePosted rejects clip posts that were not created by the plugin, since
+// any API client could otherwise post a clip type with props pointing at any file.
+// Depending on ForgedClipAction the post is either rejected or posted as a regular
+// post without the clip type and props. With ConvertAttachments, regular posts with a
+// single audio or video file are turned into clip posts.
+func (p *Plugin) MessageWillBePosted(c *plugin.Context, post *model.Post) (*model.Post, string) {
+	config := p.getConfiguration()
+	mediaType := config.mediaTypes().forPostType(post.Type)
+	if mediaType == nil {
+		if config.ConvertAttachments {
+			if converted := p.convertAttachmentPost(post); converted != nil {
+				return converted, ""
+			}
+		}
+		return nil, ""
+	}
+
+	valid, err := p.verifyClipPost(post, mediaType.PropsKey)
+	if err != nil {
+		p.API.LogError("Failed to verify clip post", "user_id", post.UserId, "error", err.Error())
+		return nil, "Failed to verify clip post"
+	}
+	if valid {
+		return nil, ""
+	}
+
+	p.API.LogWarn("Blocked clip post not created by the plugin", "user_id", post.UserId, "channel_id", post.ChannelId, "type", post.Type)
+	if config.forgedClipAction() == forgedClipActionDowngrade {
+		return downgradeClipPost(post, mediaType), ""
+	}
+	return nil, "Clip posts can only be created through the Voice Clips plugin"
+}
+
+// downgradeClipPost turns a clip post into a regular post, keeping its text and files.
+func downgradeClipPost(post *model.Post, mediaType *mediaType) *model.Post {
+	post.Type = model.PostTypeDefault
+	post.DelProp(mediaType.PropsKey)
+	post.DelProp(clipSignatureProp)
+	return post
+}
+
+// MessageHasBeenPosted queues the processing of posts converted from attachments.
+func (p *Plugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post) {
+	p.enqueueConvertedPostJobs(post)
+}
+
+// MessageHasBeenDeleted frees the storage quota used by deleted clips.
+func (p *Plugin) MessageHasBeenDeleted(c *plugin.Context, post *model.Post) {
+	p.freeClipStorage(post)
+}
+
+// MessageWillBeUpdated keeps edits of clip posts to the caption. Changes to the post
+// type, files or clip props would leave a broken player, so they are only accepted
+// when the plugin re-signed the post, as job results do.
+func (p *Plugin) MessageWillBeUpdated(c *plugin.Context, newPost, oldPost *model.Post) (*model.Post, string) {
+	mediaTypes := p.getConfiguration().mediaTypes()
+	oldType := mediaTypes.forPostType(oldPost.Type)
+	newType := mediaTypes.forPostType(newPost.Type)
+	if oldType == nil && newType == nil {
+		return nil, ""
+	}
+
+	if newType != nil {
+		valid, err := p.verifyClipPost(newPost, newType.PropsKey)
+		if err != nil {
+			p.API.LogError("Failed to verify clip post", "post_id", newPost.Id, "error", err.Error())
+			return nil, "Failed to verify clip post"
+		}
+		if valid {
+			return nil, ""
+		}
+	}
+
+	if oldType == nil {
+		p.API.LogWarn("Blocked change of a post into a clip post", "post_id", newPost.Id, "user_id", newPost.UserId, "type", newPost.Type)
+		return nil, "Clip posts can only be created through the Voice Clips plugin"
+	}
+
+	// Clips posted before signing was added have no signature, so a caption edit is
+	// recognized by comparing the protected parts with the stored post.
+	if newType == oldType {
+		unchanged, err := clipUnchanged(oldPost, newPost, oldType.PropsKey)
+		if err != nil {
+			p.API.LogError("Failed to compare clip post", "post_id", newPost.Id, "error", err.Error())
+			return nil, "Failed to verify clip post"
+		}
+		if unchanged {
+			return nil, ""
+		}
+	}
+
+	p.API.LogWarn("Blocked edit of clip media", "post_id", newPost.Id, "user_id", newPost.UserId)
+	return nil, "Only the caption of a clip post can be edited"
+}
+
+// clipUnchanged reports whether an edit kept the signed parts and signature of a clip post.
+func clipUnchanged(oldPost, newPost *model.Post, propsKey string) (bool, error) {
+	oldData, err := clipSignatureData(oldPost, propsKey)
+	if err != nil {
+		return false, err
+	}
+	newData, err := clipSignatureData(newPost, propsKey)
+	if err != nil {
+		return false, err
+	}
+	oldSignature, _ := oldPost.GetProp(clipSignatureProp).(string)
+	newSignature, _ := newPost.GetProp(clipSignatureProp).(string)
+	return bytes.Equal(oldData, newData) && oldSignature == newSignature, nil
+}
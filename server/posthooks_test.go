@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newSignedClipPost(t *testing.T, plugin *Plugin) *model.Post {
+	post := &model.Post{
+		UserId:    "user123",
+		ChannelId: "channel123",
+		Type:      "custom_voice_clip",
+		Message:   "🎤 Voice message",
+		FileIds:   model.StringArray{"file123"},
+	}
+	post.AddProp("voice_clip", map[string]interface{}{
+		"file_id":  "file123",
+		"duration": 10,
+		"format":   ".webm",
+	})
+	require.NoError(t, plugin.signClipPost(post, "voice_clip"))
+	return post
+}
+
+func TestMessageWillBePosted(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(post *model.Post)
+		rejected bool
+	}{
+		{"signed", func(post *model.Post) {}, false},
+		{"edited caption", func(post *model.Post) { post.Message = "Listen to this" }, false},
+		{"unsigned", func(post *model.Post) { post.DelProp(clipSignatureProp) }, true},
+		{"malformed signature", func(post *model.Post) { post.AddProp(clipSignatureProp, "not base64!") }, true},
+		{"tampered props", func(post *model.Post) {
+			post.AddProp("voice_clip", map[string]interface{}{"file_id": "file123", "duration": 1, "format": ".webm"})
+		}, true},
+		{"tampered file ids", func(post *model.Post) { post.FileIds = model.StringArray{"other"} }, true},
+		{"other channel", func(post *model.Post) { post.ChannelId = "channel456" }, true},
+		{"other author", func(post *model.Post) { post.UserId = "user456" }, true},
+		{"other type", func(post *model.Post) { post.Type = "custom_video_clip" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{signingKey: []byte("test-signing-key")}
+			plugin.SetAPI(api)
+			api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+			post := newSignedClipPost(t, plugin)
+			tt.modify(post)
+
+			replacement, reason := plugin.MessageWillBePosted(nil, post)
+			assert.Nil(t, replacement)
+			if tt.rejected {
+				assert.Equal(t, "Clip posts can only be created through the Voice Clips plugin", reason)
+			} else {
+				assert.Empty(t, reason)
+			}
+		})
+	}
+}
+
+func TestMessageWillBePosted_Downgrade(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{signingKey: []byte("test-signing-key")}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(&configuration{ForgedClipAction: "downgrade"})
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+	post := newSignedClipPost(t, plugin)
+	post.FileIds = model.StringArray{"file123", "file456"}
+
+	replacement, reason := plugin.MessageWillBePosted(nil, post)
+	assert.Empty(t, reason)
+	require.NotNil(t, replacement)
+	assert.Equal(t, model.PostTypeDefault, replacement.Type)
+	assert.Nil(t, replacement.GetProp("voice_clip"))
+	assert.Nil(t, replacement.GetProp(clipSignatureProp))
+	assert.Equal(t, "🎤 Voice message", replacement.Message)
+	assert.Equal(t, model.StringArray{"file123", "file456"}, replacement.FileIds)
+}
+
+func TestMessageWillBePosted_NotAClip(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{signingKey: []byte("test-signing-key")}
+	plugin.SetAPI(api)
+
+	replacement, reason := plugin.MessageWillBePosted(nil, &model.Post{Message: "hello", Props: map[string]interface{}{"voice_clip": "anything"}})
+	assert.Nil(t, replacement)
+	assert.Empty(t, reason)
+}
+
+func TestMessageWillBePosted_CreatedClip(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.Anything).Return(&model.FileInfo{Id: "file123"}, nil)
+
+	var created *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		created = args.Get(0).(*model.Post)
+	}).Return(&model.Post{Id: "post123"}, nil)
+
+	req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "10"}, "audio", testWebM())
+	addSession(t, plugin, req, "channel123", "audio")
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.NotNil(t, created)
+
+	// The server hands the hook a post decoded from JSON.
+	data, err := json.Marshal(created)
+	require.NoError(t, err)
+	var decoded model.Post
+	require.NoError(t, json.Unmarshal(data, &decoded))
+
+	replacement, reason := plugin.MessageWillBePosted(nil, &decoded)
+	assert.Nil(t, replacement)
+	assert.Empty(t, reason)
+}
+
+func TestMessageWillBeUpdated(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(t *testing.T, plugin *Plugin, post *model.Post)
+		expected string
+	}{
+		{"caption edit", func(t *testing.T, plugin *Plugin, post *model.Post) {
+			post.Message = "Listen to this"
+		}, ""},
+		{"type change", func(t *testing.T, plugin *Plugin, post *model.Post) {
+			post.Type = model.PostTypeDefault
+		}, "Only the caption of a clip post can be edited"},
+		{"other clip type", func(t *testing.T, plugin *Plugin, post *model.Post) {
+			post.Type = "custom_video_clip"
+		}, "Only the caption of a clip post can be edited"},
+		{"dropped files", func(t *testing.T, plugin *Plugin, post *model.Post) {
+			post.FileIds = nil
+		}, "Only the caption of a clip post can be edited"},
+		{"changed props", func(t *testing.T, plugin *Plugin, post *model.Post) {
+			post.AddProp("voice_clip", map[string]interface{}{"duration": "broken"})
+		}, "Only the caption of a clip post can be edited"},
+		{"removed props", func(t *testing.T, plugin *Plugin, post *model.Post) {
+			post.DelProp("voice_clip")
+		}, "Only the caption of a clip post can be edited"},
+		{"re-signed by the plugin", func(t *testing.T, plugin *Plugin, post *model.Post) {
+			post.AddProp("voice_clip", map[string]interface{}{"file_id": "file123", "duration": 10, "format": ".webm", "transcript": "Hello"})
+			require.NoError(t, plugin.signClipPost(post, "voice_clip"))
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{signingKey: []byte("test-signing-key")}
+			plugin.SetAPI(api)
+			api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+			oldPost := newSignedClipPost(t, plugin)
+			oldPost.Id = "post123"
+			newPost := oldPost.Clone()
+			tt.modify(t, plugin, newPost)
+
+			replacement, reason := plugin.MessageWillBeUpdated(nil, newPost, oldPost)
+			assert.Nil(t, replacement)
+			assert.Equal(t, tt.expected, reason)
+		})
+	}
+}
+
+func TestMessageWillBeUpdated_UnsignedClip(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{signingKey: []byte("test-signing-key")}
+	plugin.SetAPI(api)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+	// A clip posted before signing was added.
+	oldPost := newSignedClipPost(t, plugin)
+	oldPost.DelProp(clipSignatureProp)
+
+	newPost := oldPost.Clone()
+	newPost.Message = "Listen to this"
+	_, reason := plugin.MessageWillBeUpdated(nil, newPost, oldPost)
+	assert.Empty(t, reason)
+
+	newPost = oldPost.Clone()
+	newPost.FileIds = model.StringArray{"other"}
+	_, reason = plugin.MessageWillBeUpdated(nil, newPost, oldPost)
+	assert.Equal(t, "Only the caption of a clip post can be edited", reason)
+}
+
+func TestMessageWillBeUpdated_RegularPost(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{signingKey: []byte("test-signing-key")}
+	plugin.SetAPI(api)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+	oldPost := &model.Post{Id: "post123", UserId: "bot123", Message: "Your recording was interrupted."}
+	oldPost.AddProp("attachments", []*model.SlackAttachment{{Text: "draft"}})
+
+	newPost := oldPost.Clone()
+	newPost.Message = "Your recording was sent."
+	newPost.DelProp("attachments")
+	_, reason := plugin.MessageWillBeUpdated(nil, newPost, oldPost)
+	assert.Empty(t, reason)
+
+	newPost = oldPost.Clone()
+	newPost.Type = "custom_voice_clip"
+	newPost.AddProp("voice_clip", map[string]interface{}{"file_id": "file123"})
+	_, reason = plugin.MessageWillBeUpdated(nil, newPost, oldPost)
+	assert.Equal(t, "Clip posts can only be created through the Voice Clips plugin", reason)
+}
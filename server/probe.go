@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+// probeDuration reads the media duration in seconds from the container headers.
+// It returns false when the format is not supported or the duration is not
+// recorded in the file, as is the case for WebM files written by MediaRecorder.
+func probeDuration(data []byte, extension string) (float64, bool) {
+	switch strings.ToLower(extension) {
+	case ".wav":
+		return probeWAVDuration(data)
+	case ".ogg":
+		return probeOggDuration(data)
+	case ".mp4", ".m4a", ".mov":
+		return probeMP4Duration(data)
+	case ".webm":
+		return probeWebMDuration(data)
+	}
+	return 0, false
+}
+
+// probeWAVDuration divides the size of the data chunk by the byte rate from the
+// fmt chunk.
+func probeWAVDuration(data []byte) (float64, bool) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return 0, false
+	}
+
+	var byteRate uint32
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		body := offset + 8
+
+		switch id {
+		case "fmt ":
+			if body+12 > len(data) {
+				return 0, false
+			}
+			byteRate = binary.LittleEndian.Uint32(data[body+8 : body+12])
+		case "data":
+			if byteRate == 0 {
+				return 0, false
+			}
+			return float64(size) / float64(byteRate), true
+		}
+
+		// Chunks are padded to an even size.
+		offset = body + size + size%2
+	}
+	return 0, false
+}
+
+// probeOggDuration divides the granule position of the last page by the sample
+// rate of the first stream. Opus always uses a 48 kHz granule clock.
+func probeOggDuration(data []byte) (float64, bool) {
+	const pageHeaderLen = 27
+	if len(data) < pageHeaderLen || string(data[0:4]) != "OggS" {
+		return 0, false
+	}
+
+	// The first packet starts after the segment table of the first page.
+	segments := int(data[26])
+	if len(data) < pageHeaderLen+segments {
+		return 0, false
+	}
+	packet := data[pageHeaderLen+segments:]
+
+	var sampleRate float64
+	switch {
+	case bytes.HasPrefix(packet, []byte("OpusHead")):
+		sampleRate = 48000
+	case len(packet) >= 16 && bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		sampleRate = float64(binary.LittleEndian.Uint32(packet[12:16]))
+	default:
+		return 0, false
+	}
+
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last < 0 || last+14 > len(data) || sampleRate == 0 {
+		return 0, false
+	}
+	granule := int64(binary.LittleEndian.Uint64(data[last+6 : last+14]))
+	if granule <= 0 {
+		return 0, false
+	}
+	return float64(granule) / sampleRate, true
+}
+
+// probeMP4Duration reads the timescale and duration from the movie header box.
+func probeMP4Duration(data []byte) (float64, bool) {
+	index := bytes.Index(data, []byte("mvhd"))
+	if index < 4 {
+		return 0, false
+	}
+	box := data[index+4:]
+	if len(box) < 1 {
+		return 0, false
+	}
+
+	var timescale uint32
+	var duration uint64
+	if box[0] == 1 {
+		// version(1) flags(3) creation(8) modification(8) timescale(4) duration(8)
+		if len(box) < 32 {
+			return 0, false
+		}
+		timescale = binary.BigEndian.Uint32(box[20:24])
+		duration = binary.BigEndian.Uint64(box[24:32])
+	} else {
+		// version(1) flags(3) creation(4) modification(4) timescale(4) duration(4)
+		if len(box) < 20 {
+			return 0, false
+		}
+		timescale = binary.BigEndian.Uint32(box[12:16])
+		duration = uint64(binary.BigEndian.Uint32(box[16:20]))
+	}
+
+	if timescale == 0 || duration == 0 || duration == math.MaxUint32 || duration == math.MaxUint64 {
+		return 0, false
+	}
+	return float64(duration) / float64(timescale), true
+}
+
+// probeWebMDuration reads the Duration element of the segment Info, scaled by its
+// TimecodeScale.
+func probeWebMDuration(data []byte) (float64, bool) {
+	if len(data) < 4 || !bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		return 0, false
+	}
+
+	// The Info element is near the start of the file; don't scan cluster data.
+	header := data
+	if len(header) > 64*1024 {
+		header = header[:64*1024]
+	}
+
+	timecodeScale := 1000000.0
+	if index := bytes.Index(header, []byte{0x2A, 0xD7, 0xB1}); index >= 0 {
+		if value, ok := readEBMLUint(header[index+3:]); ok && value > 0 {
+			timecodeScale = float64(value)
+		}
+	}
+
+	index := bytes.Index(header, []byte{0x44, 0x89})
+	if index < 0 || index+3 > len(header) {
+		return 0, false
+	}
+
+	var duration float64
+	switch size := header[index+2]; size {
+	case 0x84:
+		if index+7 > len(header) {
+			return 0, false
+		}
+		duration = float64(math.Float32frombits(binary.BigEndian.Uint32(header[index+3 : index+7])))
+	case 0x88:
+		if index+11 > len(header) {
+			return 0, false
+		}
+		duration = math.Float64frombits(binary.BigEndian.Uint64(header[index+3 : index+11]))
+	default:
+		return 0, false
+	}
+
+	if duration <= 0 || math.IsNaN(duration) || math.IsInf(duration, 0) {
+		return 0, false
+	}
+	return duration * timecodeScale / 1e9, true
+}
+
+// readEBMLUint reads a one-byte-length EBML unsigned integer element body.
+func readEBMLUint(data []byte) (uint64, bool) {
+	if len(data) < 1 || data[0]&0x80 == 0 {
+		return 0, false
+	}
+	size := int(data[0] & 0x7F)
+	if size == 0 || size > 8 || len(data) < 1+size {
+		return 0, false
+	}
+
+	var value uint64
+	for _, b := range data[1 : 1+size] {
+		value = value<<8 | uint64(b)
+	}
+	return value, true
+}
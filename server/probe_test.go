@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeDuration(t *testing.T) {
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00")
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint32(fmtChunk[8:12], 16000) // byte rate
+	wav = append(wav, fmtChunk...)
+	wav = append(wav, []byte("data")...)
+	wav = binary.LittleEndian.AppendUint32(wav, 48000)
+
+	opus := []byte("OggS\x00\x02")
+	opus = binary.LittleEndian.AppendUint64(opus, 0)
+	opus = append(opus, make([]byte, 12)...)
+	opus = append(opus, 0x01, 0x13)
+	opus = append(opus, []byte("OpusHead")...)
+	opus = append(opus, make([]byte, 11)...)
+	opus = append(opus, []byte("OggS\x00\x04")...)
+	opus = binary.LittleEndian.AppendUint64(opus, 48000*7)
+
+	mp4 := []byte("\x00\x00\x00\x6cmvhd\x00\x00\x00\x00")
+	mp4 = append(mp4, make([]byte, 8)...)
+	mp4 = binary.BigEndian.AppendUint32(mp4, 1000)
+	mp4 = binary.BigEndian.AppendUint32(mp4, 12500)
+
+	webm := []byte{0x1A, 0x45, 0xDF, 0xA3, 0x2A, 0xD7, 0xB1, 0x83, 0x0F, 0x42, 0x40, 0x44, 0x89, 0x88}
+	webm = binary.BigEndian.AppendUint64(webm, math.Float64bits(4200))
+
+	tests := []struct {
+		name      string
+		data      []byte
+		extension string
+		expected  float64
+		ok        bool
+	}{
+		{"wav", wav, ".wav", 3, true},
+		{"ogg opus", opus, ".ogg", 7, true},
+		{"mp4", mp4, ".m4a", 12.5, true},
+		{"webm", webm, ".WEBM", 4.2, true},
+		{"webm without duration", testWebM(), ".webm", 0, false},
+		{"unsupported format", wav, ".mp3", 0, false},
+		{"truncated wav", wav[:20], ".wav", 0, false},
+		{"truncated ogg", opus[:27], ".ogg", 0, false},
+		{"truncated mp4", mp4[:20], ".mp4", 0, false},
+		{"truncated webm", webm[:16], ".webm", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			duration, ok := probeDuration(tt.data, tt.extension)
+			assert.Equal(t, tt.ok, ok)
+			assert.InDelta(t, tt.expected, duration, 0.001)
+		})
+	}
+
+	// Files cut off at any point are rejected without reading past the end.
+	for _, tt := range tests {
+		for i := range tt.data {
+			assert.NotPanics(t, func() { probeDuration(tt.data[:i], tt.extension) }, "%s cut at %d", tt.name, i)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	usagePath = "/api/v1/usage"
+
+	userUsageKeyPrefix = "usage_user_"
+	teamUsageKeyPrefix = "usage_team_"
+
+	// quotaWarningPercent is the share of a quota at which the user is warned.
+	quotaWarningPercent = 80
+)
+
+// errQuotaExceeded aborts a usage update that would go over the quota.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// storageUsage is the clip storage used by a user or team, stored in the KV store.
+type storageUsage struct {
+	Bytes int64 `json:"bytes"`
+
+	// ByType splits the bytes by media type name.
+	ByType map[string]int64 `json:"by_type,omitempty"`
+
+	// Warned is set once the owner was warned about nearing the quota, and cleared
+	// when usage drops below the warning level again.
+	Warned bool `json:"warned,omitempty"`
+}
+
+func userUsageKey(userID string) string {
+	return userUsageKeyPrefix + userID
+}
+
+func teamUsageKey(teamID string) string {
+	return teamUsageKeyPrefix + teamID
+}
+
+// userStorageQuota returns the clip storage quota per user in bytes, 0 if unlimited.
+func (c *configuration) userStorageQuota() int64 {
+	return int64(max(c.UserStorageQuota, 0)) * 1024 * 1024
+}
+
+// teamStorageQuota returns the clip storage quota per team in bytes, 0 if unlimited.
+func (c *configuration) teamStorageQuota() int64 {
+	return int64(max(c.TeamStorageQuota, 0)) * 1024 * 1024
+}
+
+// nearQuota reports whether bytes reached the warning level of quota.
+func nearQuota(bytes, quota int64) bool {
+	return quota > 0 && bytes*100 >= quota*quotaWarningPercent
+}
+
+// getStorageUsage returns the usage stored at key.
+func (p *Plugin) getStorageUsage(key string) (*storageUsage, error) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, appErr
+	}
+	usage := &storageUsage{}
+	if data != nil {
+		if err := json.Unmarshal(data, usage); err != nil {
+			return nil, errors.Wrap(err, "failed to decode storage usage")
+		}
+	}
+	return usage, nil
+}
+
+// updateStorageUsage atomically applies update to the usage stored at key and
+// returns the result. An error from update aborts without saving.
+func (p *Plugin) updateStorageUsage(key string, update func(usage *storageUsage) error) (*storageUsage, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		oldData, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return nil, appErr
+		}
+
+		usage := &storageUsage{}
+		if oldData != nil {
+			if err := json.Unmarshal(oldData, usage); err != nil {
+				return nil, errors.Wrap(err, "failed to decode storage usage")
+			}
+		}
+		if err := update(usage); err != nil {
+			return nil, err
+		}
+
+		newData, err := json.Marshal(usage)
+		if err != nil {
+			return nil, err
+		}
+		saved, appErr := p.API.KVSetWithOptions(key, newData, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: oldData,
+		})
+		if appErr != nil {
+			return nil, appErr
+		}
+		if saved {
+			return usage, nil
+		}
+	}
+	return nil, errors.Errorf("failed to update %s after concurrent modifications", key)
+}
+
+// addStorageUsage adds the bytes by media type to the usage at key, failing with
+// errQuotaExceeded if the total would go over a non-zero quota. Negative sizes free
+// storage. It reports whether the usage has just reached the warning level.
+func (p *Plugin) addStorageUsage(key string, sizes map[string]int64, quota int64) (bool, error) {
+	warn := false
+	_, err := p.updateStorageUsage(key, func(usage *storageUsage) error {
+		var total int64
+		for _, size := range sizes {
+			total += size
+		}
+		if total > 0 && quota > 0 && usage.Bytes+total > quota {
+			return errQuotaExceeded
+		}
+
+		usage.Bytes = max(usage.Bytes+total, 0)
+		if usage.ByType == nil {
+			usage.ByType = make(map[string]int64)
+		}
+		for name, size := range sizes {
+			usage.ByType[name] = max(usage.ByType[name]+size, 0)
+		}
+
+		warn = false
+		if nearQuota(usage.Bytes, quota) {
+			warn = !usage.Warned
+			usage.Warned = true
+		} else {
+			usage.Warned = false
+		}
+		return nil
+	})
+	return warn, err
+}
+
+// channelTeamID returns the team of a channel, or "" for direct and group messages.
+func (p *Plugin) channelTeamID(channelID string) (string, error) {
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return "", appErr
+	}
+	return channel.TeamId, nil
+}
+
+// reserveStorage counts the media sizes against the storage of the user and of the
+// team of the channel, rejecting the clip if either quota would be exceeded. The
+// returned release func frees the storage again, for when the clip is not posted.
+func (p *Plugin) reserveStorage(userID, channelID string, sizes map[string]int64) (func(), *clipError) {
+	config := p.getConfiguration()
+	teamID, err := p.channelTeamID(channelID)
+	if err != nil {
+		p.API.LogError("Failed to get channel for storage quota", "channel_id", channelID, "error", err.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to check storage quota"}
+	}
+
+	freed := make(map[string]int64, len(sizes))
+	for name, size := range sizes {
+		freed[name] = -size
+	}
+
+	userWarn, err := p.addStorageUsage(userUsageKey(userID), sizes, config.userStorageQuota())
+	if errors.Is(err, errQuotaExceeded) {
+		return nil, &clipError{Status: http.StatusForbidden, Message: fmt.Sprintf("Storage quota exceeded (%d MB)", config.UserStorageQuota), Retryable: true}
+	}
+	if err != nil {
+		p.API.LogError("Failed to update storage usage", "user_id", userID, "error", err.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to check storage quota"}
+	}
+
+	teamWarn := false
+	if teamID != "" {
+		teamWarn, err = p.addStorageUsage(teamUsageKey(teamID), sizes, config.teamStorageQuota())
+		if err != nil {
+			p.freeStorage(userUsageKey(userID), freed, config.userStorageQuota())
+			if errors.Is(err, errQuotaExceeded) {
+				return nil, &clipError{Status: http.StatusForbidden, Message: fmt.Sprintf("Team storage quota exceeded (%d MB)", config.TeamStorageQuota), Retryable: true}
+			}
+			p.API.LogError("Failed to update storage usage", "team_id", teamID, "error", err.Error())
+			return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to check storage quota"}
+		}
+	}
+
+	if userWarn {
+		p.sendQuotaWarning(userID, "quota.warning.user", userUsageKey(userID), config.userStorageQuota())
+	}
+	if teamWarn {
+		p.sendQuotaWarning(userID, "quota.warning.team", teamUsageKey(teamID), config.teamStorageQuota())
+	}
+
+	return func() {
+		p.freeStorage(userUsageKey(userID), freed, config.userStorageQuota())
+		if teamID != "" {
+			p.freeStorage(teamUsageKey(teamID), freed, config.teamStorageQuota())
+		}
+	}, nil
+}
+
+// freeStorage subtracts freed storage from the usage at key, logging failures.
+func (p *Plugin) freeStorage(key string, freed map[string]int64, quota int64) {
+	if _, err := p.addStorageUsage(key, freed, quota); err != nil {
+		p.API.LogWarn("Failed to free storage usage", "key", key, "error", err.Error())
+	}
+}
+
+// sendQuotaWarning tells the user through a bot direct message, in their locale,
+// that a quota is almost used up.
+func (p *Plugin) sendQuotaWarning(userID, messageKey, key string, quota int64) {
+	if p.botUserID == "" {
+		return
+	}
+	usage, err := p.getStorageUsage(key)
+	if err != nil {
+		p.API.LogWarn("Failed to get storage usage for warning", "key", key, "error", err.Error())
+		return
+	}
+	channel, appErr := p.API.GetDirectChannel(userID, p.botUserID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get direct channel for quota warning", "user_id", userID, "error", appErr.Error())
+		return
+	}
+
+	post := &model.Post{
+		UserId:    p.botUserID,
+		ChannelId: channel.Id,
+		Message: strings.NewReplacer(
+			"{percent}", strconv.FormatInt(usage.Bytes*100/quota, 10),
+			"{used}", strconv.FormatInt(usage.Bytes/(1024*1024), 10),
+			"{quota}", strconv.FormatInt(quota/(1024*1024), 10),
+		).Replace(translate(p.userLocale(p.getUserForText(userID)), messageKey)),
+	}
+	if _, appErr := p.API.CreatePost(post); appErr != nil {
+		p.API.LogWarn("Failed to send quota warning", "user_id", userID, "error", appErr.Error())
+	}
+}
+
+// clipStorageSizes returns the bytes of the media files of a clip post by media type.
+// Files attached through file_ids are not counted; neither are files of posts
+// converted from regular attachments before conversions were counted, which have
+// no recorded size.
+func (p *Plugin) clipStorageSizes(post *model.Post, propsKey string) map[string]int64 {
+	props, ok := post.GetProp(propsKey).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	converted := props["source"] == clipSourceAttachment
+
+	sizes := make(map[string]int64)
+	for _, file := range propMaps(props["files"]) {
+		name, _ := file["type"].(string)
+		if name == "" || name == "file" {
+			continue
+		}
+		size, ok := propInt64(file["size"])
+		if !ok && converted {
+			continue
+		}
+		if !ok {
+			// Clips posted before sizes were recorded.
+			fileID, _ := file["file_id"].(string)
+			info, appErr := p.API.GetFileInfo(fileID)
+			if appErr != nil {
+				p.API.LogWarn("Failed to get size of deleted clip file", "file_id", fileID, "error", appErr.Error())
+				continue
+			}
+			size = info.Size
+		}
+		sizes[name] += size
+	}
+	return sizes
+}
+
+// propInt64 returns a number prop, which is a float64 once the post has been
+// through JSON.
+func propInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// freeClipStorage subtracts the media files of a deleted clip post from the usage of
+// its author and team.
+func (p *Plugin) freeClipStorage(post *model.Post) {
+	config := p.getConfiguration()
+	mediaType := config.mediaTypes().forPostType(post.Type)
+	if mediaType == nil {
+		return
+	}
+	sizes := p.clipStorageSizes(post, mediaType.PropsKey)
+	if len(sizes) == 0 {
+		return
+	}
+
+	freed := make(map[string]int64, len(sizes))
+	for name, size := range sizes {
+		freed[name] = -size
+	}
+	p.freeStorage(userUsageKey(post.UserId), freed, config.userStorageQuota())
+
+	teamID, err := p.channelTeamID(post.ChannelId)
+	if err != nil {
+		p.API.LogWarn("Failed to get channel of deleted clip", "channel_id", post.ChannelId, "error", err.Error())
+		return
+	}
+	if teamID != "" {
+		p.freeStorage(teamUsageKey(teamID), freed, config.teamStorageQuota())
+	}
+}
+
+// usageResponse describes the usage and quota of a user or team.
+func usageResponse(usage *storageUsage, quota int64) map[string]interface{} {
+	byType := usage.ByType
+	if byType == nil {
+		byType = map[string]int64{}
+	}
+	return map[string]interface{}{
+		"used":    usage.Bytes,
+		"quota":   quota,
+		"by_type": byType,
+	}
+}
+
+// storageUsageResponse returns the usage of the user and, if teamID is set, of the
+// team.
+func (p *Plugin) storageUsageResponse(userID, teamID string) (map[string]interface{}, error) {
+	config := p.getConfiguration()
+	usage, err := p.getStorageUsage(userUsageKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	response := map[string]interface{}{
+		"user": usageResponse(usage, config.userStorageQuota()),
+	}
+
+	if teamID != "" {
+		usage, err := p.getStorageUsage(teamUsageKey(teamID))
+		if err != nil {
+			return nil, err
+		}
+		response["team"] = usageResponse(usage, config.teamStorageQuota())
+	}
+	return response, nil
+}
+
+// handleUsage returns the clip storage used by the user and, with team_id, by a team
+// the user belongs to.
+func (p *Plugin) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	teamID := r.URL.Query().Get("team_id")
+	if teamID != "" && !p.API.HasPermissionToTeam(userID, teamID, model.PermissionViewTeam) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	response, err := p.storageUsageResponse(userID, teamID)
+	if err != nil {
+		p.API.LogError("Failed to get storage usage", "user_id", userID, "error", err.Error())
+		http.Error(w, "Failed to get storage usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
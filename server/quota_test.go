@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const megabyte = 1024 * 1024
+
+func newQuotaPlugin(api *plugintest.API, config *configuration) (*Plugin, map[string][]byte) {
+	plugin := &Plugin{botUserID: "bot123"}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(config)
+	store := mockKVStore(api)
+	api.On("GetChannel", "channel123").Return(&model.Channel{Id: "channel123", TeamId: "team123"}, nil).Maybe()
+	api.On("GetChannel", "dm123").Return(&model.Channel{Id: "dm123", Type: model.ChannelTypeDirect}, nil).Maybe()
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	return plugin, store
+}
+
+func TestReserveStorage_UserQuota(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newQuotaPlugin(api, &configuration{UserStorageQuota: 10})
+
+	release, clipErr := plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": 2 * megabyte, "video": 4 * megabyte})
+	require.Nil(t, clipErr)
+	assert.JSONEq(t, `{"bytes": 6291456, "by_type": {"audio": 2097152, "video": 4194304}}`, string(store[userUsageKey("user123")]))
+
+	_, clipErr = plugin.reserveStorage("user123", "channel123", map[string]int64{"video": 5 * megabyte})
+	require.NotNil(t, clipErr)
+	assert.Equal(t, http.StatusForbidden, clipErr.Status)
+	assert.Equal(t, "Storage quota exceeded (10 MB)", clipErr.Message)
+
+	// A rejected clip is not counted against the team either.
+	assert.JSONEq(t, `{"bytes": 6291456, "by_type": {"audio": 2097152, "video": 4194304}}`, string(store[teamUsageKey("team123")]))
+
+	release()
+	assert.JSONEq(t, `{"bytes": 0, "by_type": {"audio": 0, "video": 0}}`, string(store[userUsageKey("user123")]))
+	assert.JSONEq(t, `{"bytes": 0, "by_type": {"audio": 0, "video": 0}}`, string(store[teamUsageKey("team123")]))
+}
+
+func TestReserveStorage_TeamQuota(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newQuotaPlugin(api, &configuration{TeamStorageQuota: 4})
+
+	_, clipErr := plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": 3 * megabyte})
+	require.Nil(t, clipErr)
+
+	_, clipErr = plugin.reserveStorage("user456", "channel123", map[string]int64{"audio": 2 * megabyte})
+	require.NotNil(t, clipErr)
+	assert.Equal(t, http.StatusForbidden, clipErr.Status)
+	assert.Equal(t, "Team storage quota exceeded (4 MB)", clipErr.Message)
+	assert.JSONEq(t, `{"bytes": 0, "by_type": {"audio": 0}}`, string(store[userUsageKey("user456")]))
+
+	// Direct messages only count towards the user.
+	_, clipErr = plugin.reserveStorage("user456", "dm123", map[string]int64{"audio": 2 * megabyte})
+	require.Nil(t, clipErr)
+	assert.JSONEq(t, `{"bytes": 3145728, "by_type": {"audio": 3145728}}`, string(store[teamUsageKey("team123")]))
+}
+
+func TestReserveStorage_Warning(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newQuotaPlugin(api, &configuration{UserStorageQuota: 10})
+	api.On("GetDirectChannel", "user123", "bot123").Return(&model.Channel{Id: "direct123"}, nil)
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Locale: "en"}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.UserId == "bot123" && post.ChannelId == "direct123" &&
+			post.Message == "You have used 80% of your clip storage quota (8 MB of 10 MB). Delete clips you no longer need to free up space."
+	})).Return(&model.Post{}, nil).Once()
+
+	_, clipErr := plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": 7 * megabyte})
+	require.Nil(t, clipErr)
+	api.AssertNotCalled(t, "CreatePost", mock.Anything)
+
+	release, clipErr := plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": megabyte})
+	require.Nil(t, clipErr)
+	api.AssertNumberOfCalls(t, "CreatePost", 1)
+
+	// The warning is sent once, and again after usage dropped below the warning level.
+	_, clipErr = plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": megabyte / 2})
+	require.Nil(t, clipErr)
+	api.AssertNumberOfCalls(t, "CreatePost", 1)
+
+	release()
+	plugin.freeStorage(userUsageKey("user123"), map[string]int64{"audio": -megabyte / 2}, 10*megabyte)
+	api.On("CreatePost", mock.Anything).Return(&model.Post{}, nil).Once()
+	_, clipErr = plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": megabyte})
+	require.Nil(t, clipErr)
+	api.AssertNumberOfCalls(t, "CreatePost", 2)
+}
+
+func TestReserveStorage_TeamWarningLocalized(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newQuotaPlugin(api, &configuration{TeamStorageQuota: 10})
+	api.On("GetDirectChannel", "user123", "bot123").Return(&model.Channel{Id: "direct123"}, nil)
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Locale: "de"}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "direct123" &&
+			post.Message == "Dieses Team hat 90% seines Clip-Speicherkontingents belegt (9 MB von 10 MB). Lösche Clips, die du nicht mehr brauchst, um Platz zu schaffen."
+	})).Return(&model.Post{}, nil).Once()
+
+	_, clipErr := plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": 9 * megabyte})
+	require.Nil(t, clipErr)
+	api.AssertNumberOfCalls(t, "CreatePost", 1)
+}
+
+func TestMessageHasBeenDeleted_FreesStorage(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newQuotaPlugin(api, &configuration{UserStorageQuota: 20})
+	_, clipErr := plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": 3 * megabyte, "video": 5 * megabyte})
+	require.Nil(t, clipErr)
+	api.On("GetFileInfo", "legacy123").Return(&model.FileInfo{Id: "legacy123", Size: 2 * megabyte}, nil)
+
+	post := &model.Post{UserId: "user123", ChannelId: "channel123", Type: "custom_voice_clip"}
+	post.AddProp("voice_clip", map[string]interface{}{
+		"files": []interface{}{
+			map[string]interface{}{"file_id": "file1", "type": "audio", "size": float64(megabyte)},
+			map[string]interface{}{"file_id": "legacy123", "type": "audio"},
+			map[string]interface{}{"file_id": "file2", "type": "video", "size": float64(5 * megabyte)},
+			map[string]interface{}{"file_id": "file3", "type": "file"},
+		},
+	})
+	plugin.MessageHasBeenDeleted(nil, post)
+
+	assert.JSONEq(t, `{"bytes": 0, "by_type": {"audio": 0, "video": 0}}`, string(store[userUsageKey("user123")]))
+	assert.JSONEq(t, `{"bytes": 0, "by_type": {"audio": 0, "video": 0}}`, string(store[teamUsageKey("team123")]))
+
+	// Regular posts and attachments converted before conversions were counted were
+	// never counted.
+	_, clipErr = plugin.reserveStorage("user123", "channel123", map[string]int64{"audio": megabyte})
+	require.Nil(t, clipErr)
+	before := string(store[userUsageKey("user123")])
+	plugin.MessageHasBeenDeleted(nil, &model.Post{UserId: "user123", ChannelId: "channel123"})
+	legacy := &model.Post{UserId: "user123", ChannelId: "channel123", Type: "custom_voice_clip"}
+	legacy.AddProp("voice_clip", map[string]interface{}{
+		"source": clipSourceAttachment,
+		"files":  []interface{}{map[string]interface{}{"file_id": "file4", "type": "audio"}},
+	})
+	plugin.MessageHasBeenDeleted(nil, legacy)
+	assert.Equal(t, before, string(store[userUsageKey("user123")]))
+
+	converted := &model.Post{UserId: "user123", ChannelId: "channel123", Type: "custom_voice_clip"}
+	converted.AddProp("voice_clip", map[string]interface{}{
+		"source": clipSourceAttachment,
+		"files":  []interface{}{map[string]interface{}{"file_id": "file5", "type": "audio", "size": float64(megabyte)}},
+	})
+	plugin.MessageHasBeenDeleted(nil, converted)
+	assert.JSONEq(t, `{"bytes": 0, "by_type": {"audio": 0, "video": 0}}`, string(store[userUsageKey("user123")]))
+}
+
+func TestHandleUsage(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newQuotaPlugin(api, &configuration{UserStorageQuota: 10, TeamStorageQuota: 100})
+	_, clipErr := plugin.reserveStorage("user123", "channel123", map[string]int64{"video": 2 * megabyte})
+	require.Nil(t, clipErr)
+	api.On("HasPermissionToTeam", "user123", "team123", model.PermissionViewTeam).Return(true)
+	api.On("HasPermissionToTeam", "user123", "team456", model.PermissionViewTeam).Return(false)
+
+	tests := []struct {
+		name           string
+		method         string
+		userID         string
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"own usage", http.MethodGet, "user123", "", http.StatusOK,
+			`{"user": {"used": 2097152, "quota": 10485760, "by_type": {"video": 2097152}}}`},
+		{"with team", http.MethodGet, "user123", "?team_id=team123", http.StatusOK,
+			`{"user": {"used": 2097152, "quota": 10485760, "by_type": {"video": 2097152}}, "team": {"used": 2097152, "quota": 104857600, "by_type": {"video": 2097152}}}`},
+		{"no usage yet", http.MethodGet, "user456", "", http.StatusOK,
+			`{"user": {"used": 0, "quota": 10485760, "by_type": {}}}`},
+		{"other team", http.MethodGet, "user123", "?team_id=team456", http.StatusForbidden, ""},
+		{"unauthorized", http.MethodGet, "", "", http.StatusUnauthorized, ""},
+		{"wrong method", http.MethodPost, "user123", "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, usagePath+tt.query, nil)
+			if tt.userID != "" {
+				req.Header.Set("Mattermost-User-Id", tt.userID)
+			}
+			w := httptest.NewRecorder()
+			plugin.ServeHTTP(nil, w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Result().StatusCode)
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleConfig_StorageUsage(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newQuotaPlugin(api, &configuration{})
+	config := &model.Config{}
+	config.SetDefaults()
+	api.On("GetConfig").Return(config)
+	api.On("HasPermissionToChannel", "user123", "channel123", mock.Anything).Return(true)
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Roles: model.SystemUserRoleId}, nil).Maybe()
+
+	getConfig := func() map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/config?channel_id=channel123", nil)
+		req.Header.Set("Mattermost-User-Id", "user123")
+		w := httptest.NewRecorder()
+		plugin.handleConfig(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	assert.NotContains(t, getConfig(), "storage_usage")
+
+	plugin.setConfiguration(&configuration{TeamStorageQuota: 100})
+	usage, ok := getConfig()["storage_usage"].(map[string]interface{})
+	require.True(t, ok)
+	assert.Contains(t, usage, "user")
+	assert.Equal(t, float64(100*megabyte), usage["team"].(map[string]interface{})["quota"])
+}
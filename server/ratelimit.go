@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const rateKeyPrefix = "rate_"
+
+// rateWindow is a fixed time window with limits on the clips a user may post and the
+// bytes they may upload in it. Zero values disable a limit.
+type rateWindow struct {
+	Name     string
+	Duration time.Duration
+	MaxClips int
+	MaxBytes int64
+}
+
+// rateCounter is the usage of one user in one window, stored in the KV store.
+type rateCounter struct {
+	Clips int   `json:"clips"`
+	Bytes int64 `json:"bytes"`
+}
+
+// rateWindows returns the windows that have a limit configured.
+func (c *configuration) rateWindows() []rateWindow {
+	windows := []rateWindow{
+		{Name: "minute", Duration: time.Minute, MaxClips: c.MaxClipsPerMinute, MaxBytes: int64(c.MaxUploadSizePerMinute) * 1024 * 1024},
+		{Name: "hour", Duration: time.Hour, MaxClips: c.MaxClipsPerHour, MaxBytes: int64(c.MaxUploadSizePerHour) * 1024 * 1024},
+		{Name: "day", Duration: 24 * time.Hour, MaxClips: c.MaxClipsPerDay, MaxBytes: int64(c.MaxUploadSizePerDay) * 1024 * 1024},
+	}
+
+	enabled := make([]rateWindow, 0, len(windows))
+	for _, window := range windows {
+		if window.MaxClips > 0 || window.MaxBytes > 0 {
+			enabled = append(enabled, window)
+		}
+	}
+	return enabled
+}
+
+// rateLimitExemptBots returns the usernames and user ids of bots without rate limits.
+func (c *configuration) rateLimitExemptBots() map[string]bool {
+	exempt := make(map[string]bool)
+	for _, name := range strings.Split(c.RateLimitExemptBots, ",") {
+		if name = strings.TrimPrefix(strings.TrimSpace(name), "@"); name != "" {
+			exempt[name] = true
+		}
+	}
+	return exempt
+}
+
+// rateKey is the KV key of the counter of a user for the window starting at start.
+func rateKey(userID string, window rateWindow, start int64) string {
+	return fmt.Sprintf("%s%s_%s_%d", rateKeyPrefix, window.Name, userID, start)
+}
+
+// isRateLimitExempt reports whether the user is a system admin or an allowlisted bot.
+func (p *Plugin) isRateLimitExempt(userID string) bool {
+	if p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		return true
+	}
+
+	exempt := p.getConfiguration().rateLimitExemptBots()
+	if len(exempt) == 0 {
+		return false
+	}
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get user for rate limit", "user_id", userID, "error", appErr.Error())
+		return false
+	}
+	return user.IsBot && (exempt[user.Id] || exempt[user.Username])
+}
+
+// reserveRate counts a clip of the given size against every rate limit window of the
+// user. Counters are shared by all cluster nodes through the KV store. If a limit
+// would be exceeded nothing is counted and a 429 error with the time until the window
+// ends is returned. Otherwise the returned release func undoes the reservation, for
+// when the clip is not posted after all.
+func (p *Plugin) reserveRate(userID string, bytes int64) (func(), *clipError) {
+	windows := p.getConfiguration().rateWindows()
+	if len(windows) == 0 || p.isRateLimitExempt(userID) {
+		return func() {}, nil
+	}
+
+	// Counters expire when their window ends, so they must keep that expiry when
+	// a reservation is released.
+	now := time.Now()
+	reserved := make(map[string]int64, len(windows))
+	release := func() {
+		for key, end := range reserved {
+			ttl := max(end-time.Now().Unix(), 1)
+			if _, err := p.addRateUsage(key, -1, -bytes, nil, ttl); err != nil {
+				p.API.LogWarn("Failed to release rate limit reservation", "key", key, "error", err.Error())
+			}
+		}
+	}
+
+	for _, window := range windows {
+		seconds := int64(window.Duration.Seconds())
+		start := now.Unix() / seconds * seconds
+		key := rateKey(userID, window, start)
+
+		added, err := p.addRateUsage(key, 1, bytes, &window, start+seconds-now.Unix())
+		if err != nil {
+			release()
+			p.API.LogError("Failed to update rate limit", "user_id", userID, "error", err.Error())
+			return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to check rate limit"}
+		}
+		if !added {
+			release()
+			retryAfter := int(math.Ceil(time.Unix(start+seconds, 0).Sub(now).Seconds()))
+			return nil, &clipError{
+				Status:     http.StatusTooManyRequests,
+				Message:    fmt.Sprintf("Rate limit reached for this %s, please try again later", window.Name),
+				RetryAfter: retryAfter,
+			}
+		}
+		reserved[key] = start + seconds
+	}
+	return release, nil
+}
+
+// addRateUsage atomically adds to the counter at key. With a window, nothing is
+// added and false is returned if that would exceed its limits.
+func (p *Plugin) addRateUsage(key string, clips int, bytes int64, window *rateWindow, ttl int64) (bool, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		oldData, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return false, appErr
+		}
+
+		var counter rateCounter
+		if oldData != nil {
+			if err := json.Unmarshal(oldData, &counter); err != nil {
+				return false, errors.Wrap(err, "failed to decode rate counter")
+			}
+		}
+		if window != nil {
+			if window.MaxClips > 0 && counter.Clips+clips > window.MaxClips {
+				return false, nil
+			}
+			if window.MaxBytes > 0 && counter.Bytes+bytes > window.MaxBytes {
+				return false, nil
+			}
+		} else if oldData == nil {
+			// The window has ended; there is nothing to release.
+			return true, nil
+		}
+
+		counter.Clips = max(counter.Clips+clips, 0)
+		counter.Bytes = max(counter.Bytes+bytes, 0)
+		newData, err := json.Marshal(&counter)
+		if err != nil {
+			return false, err
+		}
+
+		options := model.PluginKVSetOptions{Atomic: true, OldValue: oldData, ExpireInSeconds: ttl}
+		saved, appErr := p.API.KVSetWithOptions(key, newData, options)
+		if appErr != nil {
+			return false, appErr
+		}
+		if saved {
+			return true, nil
+		}
+	}
+	return false, errors.Errorf("failed to update %s after concurrent modifications", key)
+}
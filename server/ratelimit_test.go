@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newRateLimitPlugin(api *plugintest.API, config *configuration) (*Plugin, map[string][]byte) {
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(config)
+	store := mockKVStore(api)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	return plugin, store
+}
+
+func TestReserveRate_Clips(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, store := newRateLimitPlugin(api, &configuration{MaxClipsPerMinute: 2, MaxClipsPerDay: 10})
+	api.On("HasPermissionTo", "user123", model.PermissionManageSystem).Return(false)
+
+	_, clipErr := plugin.reserveRate("user123", 1024)
+	require.Nil(t, clipErr)
+	release, clipErr := plugin.reserveRate("user123", 1024)
+	require.Nil(t, clipErr)
+
+	_, clipErr = plugin.reserveRate("user123", 1024)
+	require.NotNil(t, clipErr)
+	assert.Equal(t, http.StatusTooManyRequests, clipErr.Status)
+	assert.Equal(t, "Rate limit reached for this minute, please try again later", clipErr.Message)
+	assert.Greater(t, clipErr.RetryAfter, 0)
+	assert.LessOrEqual(t, clipErr.RetryAfter, 60)
+
+	// A rejected clip is not counted, and a released one frees its slot.
+	dayKeys := kvKeysWithPrefix(store, rateKeyPrefix+"day_user123_")
+	require.Len(t, dayKeys, 1)
+	assert.JSONEq(t, `{"clips": 2, "bytes": 2048}`, string(store[dayKeys[0]]))
+
+	release()
+	assert.JSONEq(t, `{"clips": 1, "bytes": 1024}`, string(store[dayKeys[0]]))
+	_, clipErr = plugin.reserveRate("user123", 1024)
+	assert.Nil(t, clipErr)
+
+	// Other users have their own count.
+	api.On("HasPermissionTo", "user456", model.PermissionManageSystem).Return(false)
+	_, clipErr = plugin.reserveRate("user456", 1024)
+	assert.Nil(t, clipErr)
+}
+
+func TestReserveRate_Bytes(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newRateLimitPlugin(api, &configuration{MaxUploadSizePerHour: 3})
+	api.On("HasPermissionTo", "user123", model.PermissionManageSystem).Return(false)
+
+	_, clipErr := plugin.reserveRate("user123", 2*1024*1024)
+	require.Nil(t, clipErr)
+	_, clipErr = plugin.reserveRate("user123", 2*1024*1024)
+	require.NotNil(t, clipErr)
+	assert.Equal(t, "Rate limit reached for this hour, please try again later", clipErr.Message)
+	assert.LessOrEqual(t, clipErr.RetryAfter, 3600)
+	_, clipErr = plugin.reserveRate("user123", 1024*1024)
+	assert.Nil(t, clipErr)
+}
+
+func TestReserveRate_Exempt(t *testing.T) {
+	tests := []struct {
+		name   string
+		admin  bool
+		user   *model.User
+		exempt bool
+	}{
+		{"system admin", true, nil, true},
+		{"allowlisted bot", false, &model.User{Id: "user123", Username: "recorder-bot", IsBot: true}, true},
+		{"other bot", false, &model.User{Id: "user123", Username: "other-bot", IsBot: true}, false},
+		{"user named like a bot", false, &model.User{Id: "user123", Username: "recorder-bot"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin, _ := newRateLimitPlugin(api, &configuration{MaxClipsPerMinute: 1, RateLimitExemptBots: "@recorder-bot, id-of-another-bot"})
+			api.On("HasPermissionTo", "user123", model.PermissionManageSystem).Return(tt.admin)
+			if tt.user != nil {
+				api.On("GetUser", "user123").Return(tt.user, nil)
+			}
+
+			_, clipErr := plugin.reserveRate("user123", 1024)
+			require.Nil(t, clipErr)
+			_, clipErr = plugin.reserveRate("user123", 1024)
+			assert.Equal(t, tt.exempt, clipErr == nil)
+		})
+	}
+}
+
+func TestReserveRate_Disabled(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(&configuration{})
+
+	release, clipErr := plugin.reserveRate("user123", 1024)
+	require.Nil(t, clipErr)
+	release()
+	api.AssertNotCalled(t, "KVGet", mock.Anything)
+}
+
+func TestHandleUpload_RateLimited(t *testing.T) {
+	api := &plugintest.API{}
+	plugin, _ := newRateLimitPlugin(api, &configuration{RequireRecordingSession: true, MaxClipsPerHour: 1})
+	mockUploadAccess(api)
+
+	api.On("HasPermissionTo", "user123", model.PermissionManageSystem).Return(false)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.Anything).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+	upload := func() *httptest.ResponseRecorder {
+		req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM())
+		addSession(t, plugin, req, "channel123", "audio")
+		w := httptest.NewRecorder()
+		plugin.handleUpload(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, upload().Result().StatusCode)
+
+	w := upload()
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "Rate limit reached for this hour")
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.Greater(t, retryAfter, 0)
+	api.AssertNumberOfCalls(t, "UploadFile", 1)
+}
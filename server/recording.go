@@ -0,0 +1,658 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	recordingsBasePath = "/api/v1/recordings"
+
+	// recordingMaxSegmentSize bounds a single MediaRecorder chunk.
+	recordingMaxSegmentSize = 8 * 1024 * 1024
+
+	// recordingIdleTimeout is how long a recording may go without new segments
+	// before it is considered abandoned and turned into a draft.
+	recordingIdleTimeout = 5 * time.Minute
+
+	// recordingExpiry is how long recordings and drafts are kept in the KV store.
+	recordingExpiry = 7 * 24 * time.Hour
+
+	// recordingCompletionLease bounds how long a request may hold a recording
+	// while posting its clip, in case the server handling it goes away.
+	recordingCompletionLease = 10 * time.Minute
+
+	recordingKeyPrefix = "rec_"
+
+	// activeRecordingsKey lists the recordings that may still be abandoned, so the
+	// recovery job does not have to scan the KV store.
+	activeRecordingsKey = "active_recordings"
+
+	recordingStatusActive = "recording"
+	recordingStatusDraft  = "draft"
+)
+
+// recording is a server-side recording session that accumulates MediaRecorder
+// chunks while the user is still recording.
+type recording struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	Type      string `json:"type"`
+	Format    string `json:"format"`
+	Duration  string `json:"duration"`
+	Size      int64  `json:"size"`
+	Segments  int    `json:"segments"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+
+	// NotificationPostID is the bot DM telling the user about a recovered draft.
+	NotificationPostID string `json:"notification_post_id,omitempty"`
+
+	// Encrypted is set when the recording started with encryption at rest on; its
+	// segments are then stored encrypted with the data key of the channel.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// MaxDuration and MaxFileSize are the limits of the recording session the
+	// recording was started with, if any.
+	MaxDuration int   `json:"max_duration,omitempty"`
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	// CompletingUntil is set while a request posts the clip of the recording.
+	CompletingUntil int64 `json:"completing_until,omitempty"`
+}
+
+func recordingKey(id string) string {
+	return recordingKeyPrefix + id
+}
+
+func recordingSegmentKey(id string, index int) string {
+	return fmt.Sprintf("%s%s_%d", recordingKeyPrefix, id, index)
+}
+
+// handleRecordings routes the incremental recording API.
+func (p *Plugin) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, recordingsBasePath), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.handleRecordingStart(w, r, userID)
+		return
+	}
+
+	rec, err := p.getRecording(parts[0])
+	if err != nil {
+		p.API.LogError("Failed to load recording", "recording_id", parts[0], "error", err.Error())
+		http.Error(w, "Failed to load recording", http.StatusInternalServerError)
+		return
+	}
+	if rec == nil || rec.UserID != userID {
+		http.NotFound(w, r)
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete, action == "discard" && r.Method == http.MethodPost:
+		p.discardRecording(rec)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "discarded"})
+	case action == "segments" && r.Method == http.MethodPost:
+		p.handleRecordingSegment(w, r, rec)
+	case action == "finish" && r.Method == http.MethodPost:
+		p.handleRecordingFinish(w, r, rec)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRecordingStart opens a recording session for the given channel.
+func (p *Plugin) handleRecordingStart(w http.ResponseWriter, r *http.Request, userID string) {
+	var body struct {
+		ChannelID string `json:"channel_id"`
+		Type      string `json:"type"`
+		Format    string `json:"format"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFormValueSize)).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if body.ChannelID == "" {
+		http.Error(w, "channel_id is required", http.StatusBadRequest)
+		return
+	}
+
+	mediaType, clipErr := p.getMediaType(body.Type)
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	if clipErr := p.checkUploadAccess(userID, body.ChannelID); clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	// The recording session is used up by starting the recording, whose segments
+	// are then checked against its limits.
+	config := p.getConfiguration()
+	created := false
+	var session *recordingSession
+	if config.RequireRecordingSession {
+		session, clipErr = p.verifySession(r.Header.Get(sessionHeader), userID)
+		if clipErr == nil {
+			clipErr = session.checkRecording(body.ChannelID, mediaType)
+		}
+		if clipErr != nil {
+			writeClipError(w, clipErr)
+			return
+		}
+
+		claimed, err := p.claimSession(session)
+		if err != nil {
+			p.API.LogError("Failed to claim recording session", "error", err.Error())
+			http.Error(w, "Failed to verify recording session", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			http.Error(w, "Recording session has already been used", http.StatusConflict)
+			return
+		}
+		defer func() {
+			if created {
+				p.completeSession(session)
+			} else {
+				p.releaseSession(session)
+			}
+		}()
+	}
+
+	format := body.Format
+	if format == "" {
+		format = ".webm"
+	} else if !strings.HasPrefix(format, ".") {
+		format = "." + format
+	}
+
+	now := time.Now().Unix()
+	rec := &recording{
+		ID:        model.NewId(),
+		UserID:    userID,
+		ChannelID: body.ChannelID,
+		Type:      mediaType.Name,
+		Format:    format,
+		Status:    recordingStatusActive,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Encrypted: config.encryption != nil,
+	}
+	if session != nil {
+		rec.MaxDuration = session.MaxDuration
+		rec.MaxFileSize = session.MaxFileSize
+	}
+	if err := p.addToIDList(activeRecordingsKey, rec.ID); err != nil {
+		p.API.LogError("Failed to create recording", "error", err.Error())
+		http.Error(w, "Failed to create recording", http.StatusInternalServerError)
+		return
+	}
+	if err := p.saveRecording(rec, nil); err != nil {
+		p.API.LogError("Failed to create recording", "error", err.Error())
+		http.Error(w, "Failed to create recording", http.StatusInternalServerError)
+		return
+	}
+
+	created = true
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"recording_id": rec.ID,
+	})
+}
+
+// handleRecordingSegment appends one MediaRecorder chunk. Segments must arrive in
+// order; a repeated index is acknowledged without being stored again so that
+// clients can safely retry.
+func (p *Plugin) handleRecordingSegment(w http.ResponseWriter, r *http.Request, rec *recording) {
+	if rec.Status != recordingStatusActive || rec.CompletingUntil > time.Now().Unix() {
+		http.Error(w, "Recording is no longer active", http.StatusConflict)
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil || index < 0 {
+		http.Error(w, "Invalid segment index", http.StatusBadRequest)
+		return
+	}
+	if index > rec.Segments {
+		http.Error(w, fmt.Sprintf("Missing segments, expected index %d", rec.Segments), http.StatusConflict)
+		return
+	}
+	if index < rec.Segments {
+		writeRecordingStatus(w, rec)
+		return
+	}
+
+	release, ok := p.admitUpload(w, r, rec.UserID, expectedUploadSize(r, recordingMaxSegmentSize))
+	if !ok {
+		return
+	}
+	defer release()
+
+	segment, err := io.ReadAll(http.MaxBytesReader(w, r.Body, recordingMaxSegmentSize))
+	if err != nil {
+		if isRequestTooLarge(err) {
+			http.Error(w, "Segment is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read segment", http.StatusBadRequest)
+		return
+	}
+	if len(segment) == 0 {
+		http.Error(w, "Segment is empty", http.StatusBadRequest)
+		return
+	}
+
+	mediaType, clipErr := p.getMediaType(rec.Type)
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+	maxFileSize := p.maxFileSize(mediaType)
+	if rec.MaxFileSize > 0 && rec.MaxFileSize < maxFileSize {
+		maxFileSize = rec.MaxFileSize
+	}
+	if rec.Size+int64(len(segment)) > maxFileSize {
+		http.Error(w, fmt.Sprintf("File size exceeds maximum allowed (%d MB)", maxFileSize/(1024*1024)), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sealed, err := p.sealChunk(rec.Encrypted, rec.ChannelID, segment)
+	if err != nil {
+		p.API.LogError("Failed to encrypt recording segment", "recording_id", rec.ID, "error", err.Error())
+		http.Error(w, "Failed to store segment", http.StatusInternalServerError)
+		return
+	}
+	if appErr := p.API.KVSetWithExpiry(recordingSegmentKey(rec.ID, index), sealed, int64(recordingExpiry.Seconds())); appErr != nil {
+		p.API.LogError("Failed to store recording segment", "recording_id", rec.ID, "error", appErr.Error())
+		http.Error(w, "Failed to store segment", http.StatusInternalServerError)
+		return
+	}
+
+	old := *rec
+	rec.Segments++
+	rec.Size += int64(len(segment))
+	rec.UpdatedAt = time.Now().Unix()
+	if duration := r.URL.Query().Get("duration"); duration != "" {
+		rec.Duration = duration
+	}
+	if err := p.saveRecording(rec, &old); err != nil {
+		if errors.Is(err, errRecordingConflict) {
+			http.Error(w, "Recording was modified concurrently", http.StatusConflict)
+			return
+		}
+		p.API.LogError("Failed to update recording", "recording_id", rec.ID, "error", err.Error())
+		http.Error(w, "Failed to update recording", http.StatusInternalServerError)
+		return
+	}
+
+	writeRecordingStatus(w, rec)
+}
+
+// handleRecordingFinish assembles the segments and posts the clip. It works for
+// both active recordings and recovered drafts.
+func (p *Plugin) handleRecordingFinish(w http.ResponseWriter, r *http.Request, rec *recording) {
+	duration := r.URL.Query().Get("duration")
+	if duration == "" {
+		duration = rec.Duration
+	}
+	seconds, err := strconv.Atoi(duration)
+	if err != nil || seconds < 0 {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+
+	if rec.MaxDuration > 0 && seconds > rec.MaxDuration {
+		http.Error(w, fmt.Sprintf("Duration exceeds maximum allowed (%d seconds)", rec.MaxDuration), http.StatusBadRequest)
+		return
+	}
+
+	// The recording started on the server, so it can't be longer than the time since.
+	elapsed := time.Since(time.Unix(rec.CreatedAt, 0)) + sessionClockTolerance
+	if time.Duration(seconds)*time.Second > elapsed {
+		http.Error(w, "Duration is longer than the recording", http.StatusBadRequest)
+		return
+	}
+
+	release, ok := p.admitUpload(w, r, rec.UserID, rec.Size)
+	if !ok {
+		return
+	}
+	defer release()
+
+	result, clipErr := p.finishRecording(rec, duration)
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"post_id": result.Post.Id,
+		"file_id": result.FileInfo.Id,
+		"job_ids": result.JobIDs,
+	})
+}
+
+// finishRecording posts the clip of a recording. Only one request finishes a
+// recording at a time, so a repeated Send, a retried request or a concurrent
+// recovery can't post it twice. The recording is removed once the clip is posted
+// or rejected for good.
+func (p *Plugin) finishRecording(rec *recording, duration string) (*clipResult, *clipError) {
+	now := time.Now().Unix()
+	if rec.CompletingUntil > now {
+		return nil, &clipError{Status: http.StatusConflict, Message: "Recording is already being sent"}
+	}
+	old := *rec
+	rec.Duration = duration
+	rec.CompletingUntil = now + int64(recordingCompletionLease.Seconds())
+	if err := p.saveRecording(rec, &old); err != nil {
+		if errors.Is(err, errRecordingConflict) {
+			return nil, &clipError{Status: http.StatusConflict, Message: "Recording is already being sent"}
+		}
+		p.API.LogError("Failed to update recording", "recording_id", rec.ID, "error", err.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to update recording"}
+	}
+
+	result, clipErr := p.createRecordingClip(rec)
+	if clipErr == nil {
+		p.updateRecordingNotification(rec, "recording.sent")
+		p.deleteRecording(rec)
+		return result, nil
+	}
+	// Keep the segments unless the media itself was rejected, so the user can
+	// try again after a server error, a rate limit or a quota or policy refusal.
+	if clipErr.permanent() {
+		p.discardRecording(rec)
+		return nil, clipErr
+	}
+
+	old = *rec
+	rec.CompletingUntil = 0
+	if err := p.saveRecording(rec, &old); err != nil {
+		p.API.LogWarn("Failed to release recording", "recording_id", rec.ID, "error", err.Error())
+	}
+	return nil, clipErr
+}
+
+// createRecordingClip assembles the segments of a recording and posts its clip.
+func (p *Plugin) createRecordingClip(rec *recording) (*clipResult, *clipError) {
+	if rec.Segments == 0 {
+		return nil, &clipError{Status: http.StatusBadRequest, Message: "File is too small or empty"}
+	}
+
+	mediaType, clipErr := p.getMediaType(rec.Type)
+	if clipErr != nil {
+		return nil, clipErr
+	}
+
+	segments := &kvChunkReader{api: p.API, count: rec.Segments, key: func(i int) string {
+		return recordingSegmentKey(rec.ID, i)
+	}, open: p.openChunk(rec.Encrypted, rec.ChannelID)}
+	file, err := spoolFile(segments, "recording"+rec.Format, p.maxFileSize(mediaType))
+	if err != nil {
+		if isRequestTooLarge(err) {
+			return nil, &clipError{Status: http.StatusRequestEntityTooLarge, Message: "File size exceeds maximum allowed"}
+		}
+		p.API.LogError("Failed to assemble recording", "recording_id", rec.ID, "error", err.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to assemble recording"}
+	}
+	defer file.Close()
+
+	return p.createClip(&clipRequest{
+		UserID:    rec.UserID,
+		ChannelID: rec.ChannelID,
+		Media:     []*clipMedia{{Type: mediaType, Duration: rec.Duration, File: file}},
+	})
+}
+
+func writeRecordingStatus(w http.ResponseWriter, rec *recording) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"recording_id": rec.ID,
+		"segments":     rec.Segments,
+		"size":         rec.Size,
+	})
+}
+
+// errRecordingConflict is returned when a recording changed between read and write.
+var errRecordingConflict = errors.New("recording was modified concurrently")
+
+func (p *Plugin) getRecording(id string) (*recording, error) {
+	data, appErr := p.API.KVGet(recordingKey(id))
+	if appErr != nil {
+		return nil, appErr
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	var rec recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, errors.Wrap(err, "failed to decode recording")
+	}
+	return &rec, nil
+}
+
+// saveRecording stores rec, atomically replacing old when it is given.
+func (p *Plugin) saveRecording(rec, old *recording) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	options := model.PluginKVSetOptions{ExpireInSeconds: int64(recordingExpiry.Seconds())}
+	if old != nil {
+		oldData, err := json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		options.Atomic = true
+		options.OldValue = oldData
+	}
+
+	saved, appErr := p.API.KVSetWithOptions(recordingKey(rec.ID), data, options)
+	if appErr != nil {
+		return appErr
+	}
+	if !saved {
+		return errRecordingConflict
+	}
+	return nil
+}
+
+// discardRecording removes a recording the user no longer wants.
+func (p *Plugin) discardRecording(rec *recording) {
+	p.updateRecordingNotification(rec, "recording.discarded")
+	p.deleteRecording(rec)
+}
+
+func (p *Plugin) deleteRecording(rec *recording) {
+	for i := 0; i < rec.Segments; i++ {
+		if appErr := p.API.KVDelete(recordingSegmentKey(rec.ID, i)); appErr != nil {
+			p.API.LogWarn("Failed to delete recording segment", "recording_id", rec.ID, "error", appErr.Error())
+		}
+	}
+	if appErr := p.API.KVDelete(recordingKey(rec.ID)); appErr != nil {
+		p.API.LogWarn("Failed to delete recording", "recording_id", rec.ID, "error", appErr.Error())
+	}
+	if err := p.removeFromIDList(activeRecordingsKey, rec.ID); err != nil {
+		p.API.LogWarn("Failed to update active recordings", "recording_id", rec.ID, "error", err.Error())
+	}
+}
+
+// recoverAbandonedRecordings turns recordings that stopped receiving segments into
+// drafts and tells their owners about them. It runs as a cluster-wide job.
+func (p *Plugin) recoverAbandonedRecordings() {
+	now := time.Now()
+	cutoff := now.Add(-recordingIdleTimeout).Unix()
+
+	ids, err := p.getIDList(activeRecordingsKey)
+	if err != nil {
+		p.API.LogError("Failed to list recordings", "error", err.Error())
+		return
+	}
+
+	var inactive []string
+	for _, id := range ids {
+		rec, err := p.getRecording(id)
+		if err != nil {
+			p.API.LogWarn("Failed to load recording", "recording_id", id, "error", err.Error())
+			continue
+		}
+		if rec == nil || rec.Status != recordingStatusActive {
+			// Expired, or a draft that is no longer recovered.
+			inactive = append(inactive, id)
+			continue
+		}
+		if rec.UpdatedAt > cutoff || rec.CompletingUntil > now.Unix() {
+			continue
+		}
+
+		if rec.Segments == 0 {
+			p.deleteRecording(rec)
+			continue
+		}
+
+		p.recoverRecording(rec)
+	}
+
+	if err := p.removeFromIDList(activeRecordingsKey, inactive...); err != nil {
+		p.API.LogWarn("Failed to update active recordings", "error", err.Error())
+	}
+}
+
+func (p *Plugin) recoverRecording(rec *recording) {
+	old := *rec
+	rec.Status = recordingStatusDraft
+	if err := p.saveRecording(rec, &old); err != nil {
+		if !errors.Is(err, errRecordingConflict) {
+			p.API.LogError("Failed to save recovered recording", "recording_id", rec.ID, "error", err.Error())
+		}
+		return
+	}
+
+	p.API.PublishWebSocketEvent("recording_recovered", map[string]interface{}{
+		"recording_id": rec.ID,
+		"channel_id":   rec.ChannelID,
+		"type":         rec.Type,
+		"duration":     rec.Duration,
+		"size":         rec.Size,
+	}, &model.WebsocketBroadcast{
+		UserId: rec.UserID,
+	})
+
+	notification, err := p.sendRecordingNotification(rec)
+	if err != nil {
+		p.API.LogWarn("Failed to notify user about recovered recording", "recording_id", rec.ID, "error", err.Error())
+		return
+	}
+
+	old = *rec
+	rec.NotificationPostID = notification.Id
+	if err := p.saveRecording(rec, &old); err != nil {
+		p.API.LogWarn("Failed to save recording notification", "recording_id", rec.ID, "error", err.Error())
+	}
+}
+
+// sendRecordingNotification sends the owner a bot DM with buttons to send or
+// discard the recovered draft.
+func (p *Plugin) sendRecordingNotification(rec *recording) (*model.Post, error) {
+	if p.botUserID == "" {
+		return nil, errors.New("bot user is not available")
+	}
+
+	channel, appErr := p.API.GetDirectChannel(rec.UserID, p.botUserID)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	locale := p.userLocale(p.getUserForText(rec.UserID))
+	actionURL := p.pluginURL(recordingsBasePath + "/" + rec.ID)
+
+	post := &model.Post{
+		UserId:    p.botUserID,
+		ChannelId: channel.Id,
+		Message:   strings.ReplaceAll(translate(locale, "recording.recovered"), "{channel}", p.channelName(rec.ChannelID)),
+	}
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{{
+		Actions: []*model.PostAction{
+			{
+				Id:          "send",
+				Name:        translate(locale, "recording.send"),
+				Style:       "primary",
+				Integration: &model.PostActionIntegration{URL: actionURL + "/finish"},
+			},
+			{
+				Id:          "discard",
+				Name:        translate(locale, "recording.discard"),
+				Integration: &model.PostActionIntegration{URL: actionURL + "/discard"},
+			},
+		},
+	}})
+
+	created, appErr := p.API.CreatePost(post)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return created, nil
+}
+
+// updateRecordingNotification replaces the draft DM with the text for key in the
+// owner's locale, removing its buttons.
+func (p *Plugin) updateRecordingNotification(rec *recording, key string) {
+	if rec.NotificationPostID == "" {
+		return
+	}
+
+	post, appErr := p.API.GetPost(rec.NotificationPostID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to load recording notification", "recording_id", rec.ID, "error", appErr.Error())
+		return
+	}
+
+	post.Message = translate(p.userLocale(p.getUserForText(rec.UserID)), key)
+	post.DelProp("attachments")
+	if _, appErr := p.API.UpdatePost(post); appErr != nil {
+		p.API.LogWarn("Failed to update recording notification", "recording_id", rec.ID, "error", appErr.Error())
+	}
+}
+
+// channelName returns the channel name for display, falling back to its id.
+func (p *Plugin) channelName(channelID string) string {
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return channelID
+	}
+	return channel.Name
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newRecordingRequest(method, path string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Mattermost-User-Id", "user123")
+	return req
+}
+
+func startRecording(t *testing.T, plugin *Plugin) string {
+	req := newRecordingRequest(http.MethodPost, recordingsBasePath, []byte(`{"channel_id":"channel123","format":"webm"}`))
+	addSession(t, plugin, req, "channel123", "audio")
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var response map[string]interface{}
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&response))
+	return response["recording_id"].(string)
+}
+
+func TestRecording_SegmentsAndFinish(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+
+	media := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, bytes.Repeat([]byte{0x00}, 2044)...)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", media, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+	id := startRecording(t, plugin)
+	segmentsPath := recordingsBasePath + "/" + id + "/segments"
+
+	for i, segment := range [][]byte{media[:1024], media[1024:]} {
+		req := newRecordingRequest(http.MethodPost, segmentsPath+"?index="+strconv.Itoa(i), segment)
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+
+	// A retried segment is acknowledged but not stored twice.
+	req := newRecordingRequest(http.MethodPost, segmentsPath+"?index=1", media[1024:])
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// Skipping ahead is rejected.
+	req = newRecordingRequest(http.MethodPost, segmentsPath+"?index=5", media[:10])
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+
+	req = newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/finish?duration=3", nil)
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "post123")
+
+	api.AssertCalled(t, "UploadFile", media, "channel123", mock.AnythingOfType("string"))
+	assert.Empty(t, kvKeysWithPrefix(store, "rec_"))
+	assert.Equal(t, "[]", string(store[activeRecordingsKey]))
+}
+
+func TestRecording_OtherUserCannotAccess(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	id := startRecording(t, plugin)
+
+	req := newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/segments?index=0", []byte("data"))
+	req.Header.Set("Mattermost-User-Id", "other")
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestRecoverAbandonedRecordings(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{botUserID: "bot123"}
+	plugin.SetAPI(api)
+	store := mockKVStore(api)
+
+	stale := &recording{
+		ID:        "rec1",
+		UserID:    "user123",
+		ChannelID: "channel123",
+		Format:    ".webm",
+		Segments:  1,
+		Size:      2048,
+		Status:    recordingStatusActive,
+		UpdatedAt: time.Now().Add(-time.Hour).Unix(),
+	}
+	fresh := &recording{
+		ID:        "rec2",
+		UserID:    "user123",
+		ChannelID: "channel123",
+		Segments:  1,
+		Status:    recordingStatusActive,
+		UpdatedAt: time.Now().Unix(),
+	}
+	require.NoError(t, plugin.saveRecording(stale, nil))
+	require.NoError(t, plugin.saveRecording(fresh, nil))
+	require.NoError(t, plugin.addToIDList(activeRecordingsKey, "rec1"))
+	require.NoError(t, plugin.addToIDList(activeRecordingsKey, "rec2"))
+	require.NoError(t, plugin.addToIDList(activeRecordingsKey, "expired"))
+	api.On("PublishWebSocketEvent", "recording_recovered", mock.Anything, mock.Anything).Return()
+	api.On("GetDirectChannel", "user123", "bot123").Return(&model.Channel{Id: "dm123"}, nil)
+	api.On("GetChannel", "channel123").Return(&model.Channel{Id: "channel123", Name: "town-square"}, nil)
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Locale: "de"}, nil)
+	config := &model.Config{}
+	config.SetDefaults()
+	*config.ServiceSettings.SiteURL = "https://chat.example.com/"
+	api.On("GetConfig").Return(config)
+	var notice *model.Post
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "dm123" && strings.Contains(post.Message, "town-square")
+	})).Run(func(args mock.Arguments) {
+		notice = args.Get(0).(*model.Post)
+	}).Return(&model.Post{Id: "notice123"}, nil)
+
+	plugin.recoverAbandonedRecordings()
+
+	// The message is in the owner's language, and the server calls the buttons
+	// back, so their URLs are absolute.
+	require.NotNil(t, notice)
+	assert.Equal(t, "Deine Aufnahme in ~town-square wurde unterbrochen. Das Aufgenommene wurde als Entwurf gespeichert.", notice.Message)
+	attachments := notice.Attachments()
+	require.Len(t, attachments, 1)
+	require.Len(t, attachments[0].Actions, 2)
+	assert.Equal(t, "Senden", attachments[0].Actions[0].Name)
+	assert.Equal(t, "Verwerfen", attachments[0].Actions[1].Name)
+	assert.Equal(t, "https://chat.example.com/plugins/"+pluginID+recordingsBasePath+"/rec1/finish", attachments[0].Actions[0].Integration.URL)
+	assert.Equal(t, "https://chat.example.com/plugins/"+pluginID+recordingsBasePath+"/rec1/discard", attachments[0].Actions[1].Integration.URL)
+
+	recovered, err := plugin.getRecording("rec1")
+	require.NoError(t, err)
+	assert.Equal(t, recordingStatusDraft, recovered.Status)
+	assert.Equal(t, "notice123", recovered.NotificationPostID)
+
+	untouched, err := plugin.getRecording("rec2")
+	require.NoError(t, err)
+	assert.Equal(t, recordingStatusActive, untouched.Status)
+
+	api.AssertNumberOfCalls(t, "PublishWebSocketEvent", 1)
+
+	// The draft and the expired recording are no longer checked.
+	plugin.recoverAbandonedRecordings()
+	active, err := plugin.getIDList(activeRecordingsKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rec2"}, active)
+	assert.NotNil(t, store[recordingKey("rec1")])
+}
+
+func TestDiscardRecording_UpdatesNotification(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{botUserID: "bot123"}
+	plugin.SetAPI(api)
+	mockKVStore(api)
+
+	rec := &recording{ID: "rec1", UserID: "user123", ChannelID: "channel123", Status: recordingStatusDraft, NotificationPostID: "notice123"}
+	require.NoError(t, plugin.saveRecording(rec, nil))
+
+	notice := &model.Post{Id: "notice123", Message: "interrupted"}
+	notice.AddProp("attachments", []*model.SlackAttachment{{}})
+	api.On("GetPost", "notice123").Return(notice, nil)
+	api.On("GetUser", "user123").Return(&model.User{Id: "user123", Locale: "ru"}, nil)
+	var updated *model.Post
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		updated = args.Get(0).(*model.Post)
+	}).Return(notice, nil)
+
+	plugin.discardRecording(rec)
+
+	require.NotNil(t, updated)
+	assert.Equal(t, "Восстановленная запись удалена.", updated.Message)
+	assert.Nil(t, updated.GetProp("attachments"))
+}
+
+func TestRecording_FinishRefused(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         *configuration
+		segment        []byte
+		expectedStatus int
+		kept           bool
+	}{
+		{"storage quota", &configuration{UserStorageQuota: 1}, testWebM(), http.StatusForbidden, true},
+		{"rate limit", &configuration{MaxClipsPerHour: 1}, testWebM(), http.StatusTooManyRequests, true},
+		{"invalid media", &configuration{}, bytes.Repeat([]byte{0x01}, 2048), http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{}
+			plugin.SetAPI(api)
+			plugin.setConfiguration(tt.config)
+			mockUploadAccess(api)
+			store := mockKVStore(api)
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+			api.On("HasPermissionTo", "user123", model.PermissionManageSystem).Return(false).Maybe()
+
+			// The user has used up the quota and rate limit already.
+			store[userUsageKey("user123")] = []byte(`{"bytes": 1048576}`)
+			_, clipErr := plugin.reserveRate("user123", 1024)
+			require.Nil(t, clipErr)
+
+			id := startRecording(t, plugin)
+			req := newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/segments?index=0", tt.segment)
+			w := httptest.NewRecorder()
+			plugin.ServeHTTP(nil, w, req)
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			req = newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/finish?duration=3", nil)
+			w = httptest.NewRecorder()
+			plugin.ServeHTTP(nil, w, req)
+			assert.Equal(t, tt.expectedStatus, w.Result().StatusCode, w.Body.String())
+
+			rec, err := plugin.getRecording(id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.kept, rec != nil)
+			api.AssertNotCalled(t, "CreatePost", mock.Anything)
+		})
+	}
+}
+
+func TestRecording_FinishInvalidDuration(t *testing.T) {
+	for _, duration := range []string{"", "abc", "-1"} {
+		t.Run(duration, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{}
+			plugin.SetAPI(api)
+			mockUploadAccess(api)
+			mockKVStore(api)
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+			id := startRecording(t, plugin)
+			req := newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/segments?index=0", testWebM())
+			w := httptest.NewRecorder()
+			plugin.ServeHTTP(nil, w, req)
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			req = newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/finish?duration="+duration, nil)
+			w = httptest.NewRecorder()
+			plugin.ServeHTTP(nil, w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+			api.AssertNotCalled(t, "CreatePost", mock.Anything)
+		})
+	}
+}
+
+func TestRecording_FinishOnce(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	id := startRecording(t, plugin)
+	req := newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/segments?index=0", testWebM())
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// Another request is posting the clip.
+	rec, err := plugin.getRecording(id)
+	require.NoError(t, err)
+	old := *rec
+	rec.CompletingUntil = time.Now().Add(time.Minute).Unix()
+	require.NoError(t, plugin.saveRecording(rec, &old))
+
+	req = newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/finish?duration=0", nil)
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+
+	// Neither can segments be added nor the recording be recovered meanwhile.
+	req = newRecordingRequest(http.MethodPost, recordingsBasePath+"/"+id+"/segments?index=1", testWebM())
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+
+	old = *rec
+	rec.UpdatedAt = time.Now().Add(-time.Hour).Unix()
+	require.NoError(t, plugin.saveRecording(rec, &old))
+	plugin.recoverAbandonedRecordings()
+
+	api.AssertNotCalled(t, "CreatePost", mock.Anything)
+	rec, err = plugin.getRecording(id)
+	require.NoError(t, err)
+	assert.Equal(t, recordingStatusActive, rec.Status)
+}
+
+func TestRecording_StartRequiresSession(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	start := func(sessionChannel string) *http.Request {
+		req := newRecordingRequest(http.MethodPost, recordingsBasePath, []byte(`{"channel_id":"channel123","format":"webm"}`))
+		if sessionChannel != "" {
+			addSession(t, plugin, req, sessionChannel, "audio")
+		}
+		return req
+	}
+	send := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, req)
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(t, http.StatusBadRequest, send(start("")))
+	assert.Equal(t, http.StatusForbidden, send(start("channel456")))
+
+	// A session starts one recording only.
+	req := start("channel123")
+	assert.Equal(t, http.StatusOK, send(req))
+	replay := start("")
+	replay.Header.Set(sessionHeader, req.Header.Get(sessionHeader))
+	assert.Equal(t, http.StatusConflict, send(replay))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const maxAttempts = 3
+
+// retryBackoff is the delay before the first retry; it doubles on each attempt.
+var retryBackoff = 200 * time.Millisecond
+
+// isTransientError reports whether a failed API call may succeed if retried.
+func isTransientError(appErr *model.AppError) bool {
+	return appErr.StatusCode == 0 || appErr.StatusCode >= http.StatusInternalServerError || appErr.StatusCode == http.StatusTooManyRequests
+}
+
+// withRetry calls fn until it succeeds, fails with a non-transient error or runs out
+// of attempts, backing off exponentially between attempts.
+func (p *Plugin) withRetry(operation string, fn func() *model.AppError) *model.AppError {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		appErr := fn()
+		if appErr == nil || attempt == maxAttempts || !isTransientError(appErr) {
+			return appErr
+		}
+
+		p.API.LogWarn("Retrying after transient error", "operation", operation, "attempt", attempt, "error", appErr.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	malwareScanFailOpen   = "open"
+	malwareScanFailClosed = "closed"
+
+	quarantinePath      = "/api/v1/quarantine"
+	quarantineKeyPrefix = "quarantine_"
+
+	// quarantineListKey lists the ids of the quarantine records.
+	quarantineListKey = "quarantined_uploads"
+
+	// scanChunkSize is the size of the INSTREAM chunks sent to the scanner.
+	scanChunkSize = 64 * 1024
+)
+
+// quarantineRecord is the audit record of an upload rejected by the malware scanner,
+// stored in the KV store.
+type quarantineRecord struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	MediaType string `json:"media_type"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	Signature string `json:"signature"`
+
+	// FileID is the quarantined copy, kept in the bot's own direct channel, or the
+	// claimed file that was removed. Empty if the file could not be kept.
+	FileID string `json:"file_id,omitempty"`
+
+	// RemovalFailed is set when a claimed file could not be removed and is still
+	// among the user's uploads.
+	RemovalFailed bool `json:"removal_failed,omitempty"`
+
+	CreatedAt int64 `json:"created_at"`
+}
+
+func quarantineKey(id string) string {
+	return quarantineKeyPrefix + id
+}
+
+// malwareScanFailure returns what happens to uploads when the scanner fails.
+func (c *configuration) malwareScanFailure() string {
+	if c.MalwareScanFailure == malwareScanFailOpen {
+		return malwareScanFailOpen
+	}
+	return malwareScanFailClosed // Default closed
+}
+
+// malwareScanTimeout returns how long a scan may take, including connecting.
+func (c *configuration) malwareScanTimeout() time.Duration {
+	if c.MalwareScanTimeout <= 0 {
+		return 30 * time.Second // Default 30 seconds
+	}
+	return time.Duration(c.MalwareScanTimeout) * time.Second
+}
+
+// scannerAddress splits the scanner setting into a network and address:
+// "unix:///path" or an absolute path for a Unix socket, "tcp://host:port" or
+// "host:port" for TCP.
+func scannerAddress(setting string) (string, string) {
+	setting = strings.TrimSpace(setting)
+	switch {
+	case strings.HasPrefix(setting, "unix://"):
+		return "unix", strings.TrimPrefix(setting, "unix://")
+	case strings.HasPrefix(setting, "/"):
+		return "unix", setting
+	}
+	return "tcp", strings.TrimPrefix(setting, "tcp://")
+}
+
+// scanStream sends r to a clamd-compatible scanner with the INSTREAM command and
+// returns the name of the signature found, or "" if the stream is clean.
+func scanStream(network, address string, timeout time.Duration, r io.Reader) (string, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to connect to scanner")
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return "", errors.Wrap(err, "failed to set scanner deadline")
+	}
+
+	// The z prefix makes commands and replies NUL-terminated.
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", errors.Wrap(err, "failed to send scan command")
+	}
+
+	// The stream is sent in chunks prefixed with their length in network byte order
+	// and ends with a zero-length chunk.
+	chunk := make([]byte, 4+scanChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return "", errors.Wrap(err, "failed to send file to scanner")
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", errors.Wrap(readErr, "failed to read file for scanning")
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", errors.Wrap(err, "failed to send file to scanner")
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", errors.Wrap(err, "failed to read scanner reply")
+	}
+	return parseScanReply(reply)
+}
+
+// parseScanReply interprets a reply such as "stream: OK" or
+// "stream: Eicar-Signature FOUND".
+func parseScanReply(reply string) (string, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", errors.Errorf("scanner error: %s", reply)
+}
+
+// scanClipMedia scans each media file when a scanner is configured. Infected files
+// are quarantined and reject the clip. If the scanner cannot be reached the clip is
+// rejected or, when failing open, posted unscanned.
+func (p *Plugin) scanClipMedia(req *clipRequest, media []*clipMedia) *clipError {
+	config := p.getConfiguration()
+	if strings.TrimSpace(config.MalwareScanAddress) == "" {
+		return nil
+	}
+	network, address := scannerAddress(config.MalwareScanAddress)
+
+	for _, m := range media {
+		r, err := m.File.Reader()
+		if err == nil {
+			var signature string
+			if signature, err = scanStream(network, address, config.malwareScanTimeout(), r); err == nil && signature != "" {
+				if err := p.quarantineMedia(req, m, signature); err != nil {
+					// The infected file is still among the user's uploads.
+					return &clipError{Status: http.StatusInternalServerError, Message: "Failed to remove infected file"}
+				}
+				return &clipError{Status: http.StatusUnprocessableEntity, Message: "File was rejected by the malware scanner"}
+			}
+		}
+		if err != nil {
+			if config.malwareScanFailure() == malwareScanFailOpen {
+				p.API.LogWarn("Failed to scan file, posting it unscanned", "user_id", req.UserID, "error", err.Error())
+				continue
+			}
+			p.API.LogError("Failed to scan file", "user_id", req.UserID, "error", err.Error())
+			return &clipError{Status: http.StatusServiceUnavailable, Message: "Malware scanner is unavailable, please try again later"}
+		}
+	}
+	return nil
+}
+
+// quarantineMedia keeps a copy of an infected file where only the bot can reach it,
+// removes claimed files from the user's uploads, and records the upload for audit.
+// It fails when a claimed file could not be removed.
+func (p *Plugin) quarantineMedia(req *clipRequest, m *clipMedia, signature string) error {
+	record := &quarantineRecord{
+		ID:        model.NewId(),
+		UserID:    req.UserID,
+		ChannelID: req.ChannelID,
+		MediaType: m.Type.Name,
+		Filename:  m.File.Filename,
+		Size:      m.File.Size,
+		Signature: signature,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+
+	var removeErr error
+	if m.Stored != nil {
+		record.FileID = m.Stored.Id
+		if removeErr = p.deleteFile(m.Stored); removeErr != nil {
+			p.API.LogError("Failed to remove infected file", "file_id", m.Stored.Id, "error", removeErr.Error())
+			record.RemovalFailed = true
+		}
+	} else if fileID, err := p.storeQuarantinedFile(record.ID, m); err != nil {
+		p.API.LogError("Failed to quarantine infected file", "error", err.Error())
+	} else {
+		record.FileID = fileID
+	}
+
+	p.API.LogWarn("Infected upload quarantined",
+		"quarantine_id", record.ID, "user_id", record.UserID, "channel_id", record.ChannelID,
+		"filename", record.Filename, "signature", record.Signature, "file_id", record.FileID)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return removeErr
+	}
+	if appErr := p.API.KVSet(quarantineKey(record.ID), data); appErr != nil {
+		p.API.LogError("Failed to record quarantined upload", "quarantine_id", record.ID, "error", appErr.Error())
+		return removeErr
+	}
+	if err := p.addToIDList(quarantineListKey, record.ID); err != nil {
+		p.API.LogError("Failed to record quarantined upload", "quarantine_id", record.ID, "error", err.Error())
+	}
+	return removeErr
+}
+
+// storeQuarantinedFile uploads an infected file to the bot's own direct channel,
+// which nobody else can see, and returns its id.
+func (p *Plugin) storeQuarantinedFile(id string, m *clipMedia) (string, error) {
+	if p.botUserID == "" {
+		return "", errors.New("bot user is not available")
+	}
+	data, err := m.File.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	channel, appErr := p.API.GetDirectChannel(p.botUserID, p.botUserID)
+	if appErr != nil {
+		return "", appErr
+	}
+	info, appErr := p.API.UploadFile(data, channel.Id, fmt.Sprintf("quarantine_%s_%s", id, m.File.Filename))
+	if appErr != nil {
+		return "", appErr
+	}
+	return info.Id, nil
+}
+
+// handleQuarantine lists the quarantined uploads, newest first. Requires the
+// manage_system permission.
+func (p *Plugin) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ids, err := p.getIDList(quarantineListKey)
+	if err != nil {
+		p.API.LogError("Failed to list quarantined uploads", "error", err.Error())
+		http.Error(w, "Failed to list quarantined uploads", http.StatusInternalServerError)
+		return
+	}
+
+	records := []*quarantineRecord{}
+	for _, id := range ids {
+		data, appErr := p.API.KVGet(quarantineKey(id))
+		if appErr != nil || data == nil {
+			continue
+		}
+		record := &quarantineRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreatedAt > records[j].CreatedAt
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"quarantined": records})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// testMalware is the content the fake scanner reports as infected.
+var testMalware = []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+
+// fakeClamd is a clamd-compatible scanner that answers INSTREAM commands and
+// records the streams it received.
+type fakeClamd struct {
+	listener net.Listener
+	streams  chan []byte
+
+	// delay holds replies back, to test timeouts.
+	delay time.Duration
+}
+
+func startFakeClamd(t *testing.T, network, address string) *fakeClamd {
+	listener, err := net.Listen(network, address)
+	require.NoError(t, err)
+	clamd := &fakeClamd{listener: listener, streams: make(chan []byte, 10)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go clamd.serve(conn)
+		}
+	}()
+	return clamd
+}
+
+func (c *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+		_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var stream bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+			return
+		}
+	}
+	c.streams <- stream.Bytes()
+
+	time.Sleep(c.delay)
+	if bytes.Contains(stream.Bytes(), []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	_, _ = conn.Write([]byte("stream: OK\x00"))
+}
+
+func (c *fakeClamd) address() string {
+	if c.listener.Addr().Network() == "unix" {
+		return "unix://" + c.listener.Addr().String()
+	}
+	return "tcp://" + c.listener.Addr().String()
+}
+
+func TestScannerAddress(t *testing.T) {
+	tests := []struct {
+		setting         string
+		expectedNetwork string
+		expectedAddress string
+	}{
+		{"tcp://clamav:3310", "tcp", "clamav:3310"},
+		{"clamav:3310", "tcp", "clamav:3310"},
+		{"unix:///run/clamd.sock", "unix", "/run/clamd.sock"},
+		{" /run/clamd.sock ", "unix", "/run/clamd.sock"},
+	}
+	for _, tt := range tests {
+		network, address := scannerAddress(tt.setting)
+		assert.Equal(t, tt.expectedNetwork, network, tt.setting)
+		assert.Equal(t, tt.expectedAddress, address, tt.setting)
+	}
+}
+
+func TestScanStream(t *testing.T) {
+	clamd := startFakeClamd(t, "tcp", "127.0.0.1:0")
+
+	// Files larger than a chunk are streamed in several chunks.
+	data := append(testWebM(), make([]byte, 3*scanChunkSize)...)
+	signature, err := scanStream("tcp", clamd.listener.Addr().String(), time.Second, bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Empty(t, signature)
+	assert.Equal(t, data, <-clamd.streams)
+
+	signature, err = scanStream("tcp", clamd.listener.Addr().String(), time.Second, bytes.NewReader(testMalware))
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", signature)
+}
+
+func TestScanStream_UnixSocket(t *testing.T) {
+	clamd := startFakeClamd(t, "unix", filepath.Join(t.TempDir(), "clamd.sock"))
+
+	signature, err := scanStream("unix", clamd.listener.Addr().String(), time.Second, bytes.NewReader(testMalware))
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", signature)
+}
+
+func TestScanStream_Timeout(t *testing.T) {
+	clamd := startFakeClamd(t, "tcp", "127.0.0.1:0")
+	clamd.delay = time.Second
+
+	_, err := scanStream("tcp", clamd.listener.Addr().String(), 100*time.Millisecond, bytes.NewReader(testWebM()))
+	require.Error(t, err)
+}
+
+func TestParseScanReply(t *testing.T) {
+	_, err := parseScanReply("INSTREAM size limit exceeded. ERROR\x00")
+	assert.Error(t, err)
+}
+
+func newScanPlugin(api *plugintest.API, config *configuration) (*Plugin, map[string][]byte) {
+	plugin := &Plugin{botUserID: "bot123"}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(config)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	return plugin, store
+}
+
+func TestHandleUpload_MalwareScan(t *testing.T) {
+	api := &plugintest.API{}
+	clamd := startFakeClamd(t, "tcp", "127.0.0.1:0")
+	plugin, _ := newScanPlugin(api, &configuration{MalwareScanAddress: clamd.address()})
+	api.On("UploadFile", testWebM(), "channel123", mock.Anything).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM()))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, testWebM(), <-clamd.streams)
+}
+
+func TestHandleUpload_MalwareQuarantined(t *testing.T) {
+	api := &plugintest.API{}
+	clamd := startFakeClamd(t, "tcp", "127.0.0.1:0")
+	plugin, store := newScanPlugin(api, &configuration{MalwareScanAddress: clamd.address()})
+
+	data := append(testWebM(), testMalware...)
+	api.On("GetDirectChannel", "bot123", "bot123").Return(&model.Channel{Id: "botdm123"}, nil)
+	api.On("UploadFile", data, "botdm123", mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, "quarantine_") && strings.HasSuffix(name, "_clip.webm")
+	})).Return(&model.FileInfo{Id: "quarantined123"}, nil)
+
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", data))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "File was rejected by the malware scanner")
+	api.AssertNotCalled(t, "UploadFile", mock.Anything, "channel123", mock.Anything)
+	api.AssertNotCalled(t, "CreatePost", mock.Anything)
+
+	keys := kvKeysWithPrefix(store, quarantineKeyPrefix)
+	require.Len(t, keys, 1)
+	var record quarantineRecord
+	require.NoError(t, json.Unmarshal(store[keys[0]], &record))
+	assert.Equal(t, "user123", record.UserID)
+	assert.Equal(t, "channel123", record.ChannelID)
+	assert.Equal(t, "audio", record.MediaType)
+	assert.Equal(t, "Eicar-Test-Signature", record.Signature)
+	assert.Equal(t, "quarantined123", record.FileID)
+	assert.Equal(t, int64(len(data)), record.Size)
+}
+
+func TestHandleClaim_MalwareQuarantined(t *testing.T) {
+	tests := []struct {
+		name           string
+		attached       bool
+		expectedStatus int
+	}{
+		{"removed", true, http.StatusUnprocessableEntity},
+		{"not removed", false, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			clamd := startFakeClamd(t, "tcp", "127.0.0.1:0")
+			plugin, store := newScanPlugin(api, &configuration{MalwareScanAddress: clamd.address()})
+
+			data := append(testWebM(), testMalware...)
+			info := &model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", Name: "clip.webm", Size: int64(len(data))}
+			api.On("GetFileInfo", "file123").Return(info, nil)
+			api.On("GetFile", "file123").Return(data, nil)
+			api.On("GetDirectChannel", "bot123", "bot123").Return(&model.Channel{Id: "botdm123"}, nil)
+			api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+				return post.Type == fileRemovalPostType && post.UserId == "user123"
+			})).Return(func(post *model.Post) *model.Post {
+				removal := &model.Post{Id: "removal123"}
+				if tt.attached {
+					removal.FileIds = post.FileIds
+				}
+				return removal
+			}, nil)
+			api.On("DeletePost", "removal123").Return(nil)
+			api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+			req := newClaimRequest(t, plugin, `{"file_id": "file123", "channel_id": "channel123", "type": "video", "duration": 5}`)
+			w := httptest.NewRecorder()
+			plugin.handleClaim(w, req)
+			assert.Equal(t, tt.expectedStatus, w.Result().StatusCode, w.Body.String())
+
+			keys := kvKeysWithPrefix(store, quarantineKeyPrefix)
+			require.Len(t, keys, 1)
+			var record quarantineRecord
+			require.NoError(t, json.Unmarshal(store[keys[0]], &record))
+			assert.Equal(t, "file123", record.FileID)
+			assert.Equal(t, !tt.attached, record.RemovalFailed)
+		})
+	}
+}
+
+func TestHandleUpload_MalwareScannerUnavailable(t *testing.T) {
+	// Reserve an address nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	t.Run("fail closed", func(t *testing.T) {
+		api := &plugintest.API{}
+		plugin, _ := newScanPlugin(api, &configuration{MalwareScanAddress: address, MalwareScanFailure: "closed", MalwareScanTimeout: 1})
+
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM()))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+		assert.Contains(t, w.Body.String(), "Malware scanner is unavailable")
+		api.AssertNotCalled(t, "UploadFile", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		api := &plugintest.API{}
+		plugin, _ := newScanPlugin(api, &configuration{MalwareScanAddress: address, MalwareScanFailure: "open", MalwareScanTimeout: 1})
+		api.On("UploadFile", testWebM(), "channel123", mock.Anything).Return(&model.FileInfo{Id: "file123"}, nil)
+		api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM()))
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+}
+
+func TestHandleQuarantine(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	store := mockKVStore(api)
+	api.On("HasPermissionTo", "admin123", model.PermissionManageSystem).Return(true)
+	api.On("HasPermissionTo", "user123", model.PermissionManageSystem).Return(false)
+
+	for _, record := range []*quarantineRecord{
+		{ID: "old", UserID: "user123", Signature: "Eicar-Test-Signature", CreatedAt: 1000},
+		{ID: "new", UserID: "user456", Signature: "Win.Trojan.Agent", CreatedAt: 2000},
+	} {
+		data, err := json.Marshal(record)
+		require.NoError(t, err)
+		store[quarantineKey(record.ID)] = data
+		require.NoError(t, plugin.addToIDList(quarantineListKey, record.ID))
+	}
+	// Records that are missing from the store are skipped.
+	require.NoError(t, plugin.addToIDList(quarantineListKey, "missing"))
+
+	get := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, quarantinePath, nil)
+		req.Header.Set("Mattermost-User-Id", userID)
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("user123").Result().StatusCode)
+
+	w := get("admin123")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var body struct {
+		Quarantined []*quarantineRecord `json:"quarantined"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Len(t, body.Quarantined, 2)
+	assert.Equal(t, "new", body.Quarantined[0].ID)
+	assert.Equal(t, "old", body.Quarantined[1].ID)
+}
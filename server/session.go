@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	sessionsPath = "/api/v1/sessions"
+
+	// sessionHeader carries the session token on upload requests.
+	sessionHeader = "Voice-Clip-Session"
+
+	sessionKeyPrefix = "session_"
+
+	// sessionUploadGrace is how long after the maximum duration a session can still
+	// be used to upload, covering pauses and slow networks.
+	sessionUploadGrace = 15 * time.Minute
+
+	// sessionClockTolerance absorbs rounding of the declared duration and clock
+	// differences between cluster nodes.
+	sessionClockTolerance = 3 * time.Second
+
+	sessionStatusPending = "pending"
+	sessionStatusUsed    = "used"
+)
+
+var (
+	// errSessionInvalid is returned for tokens that are malformed or not signed by
+	// this plugin.
+	errSessionInvalid = errors.New("invalid recording session")
+
+	// errSessionExpired is returned for tokens past their expiry.
+	errSessionExpired = errors.New("recording session expired")
+)
+
+// recordingSession is issued when recording starts and carries the limits that
+// apply to the upload. It is handed to the client as a signed token.
+type recordingSession struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	ChannelID   string `json:"channel_id"`
+	Type        string `json:"type"`
+	MaxDuration int    `json:"max_duration"`
+	MaxFileSize int64  `json:"max_file_size"`
+	IssuedAt    int64  `json:"issued_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+
+	// mediaType is looked up from Type when the token is verified.
+	mediaType *mediaType
+}
+
+func sessionKey(id string) string {
+	return sessionKeyPrefix + id
+}
+
+// handleCreateSession issues a recording session token for the given channel.
+func (p *Plugin) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		ChannelID string `json:"channel_id"`
+		Type      string `json:"type"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFormValueSize)).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if body.ChannelID == "" {
+		http.Error(w, "channel_id is required", http.StatusBadRequest)
+		return
+	}
+	mediaType, clipErr := p.getMediaType(body.Type)
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	if clipErr := p.checkUploadAccess(userID, body.ChannelID); clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+	if clipErr := p.checkMediaPolicy(userID, body.ChannelID, mediaType); clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	// Guests get their own, possibly lower, limits.
+	maxDuration, maxFileSize := mediaType.MaxDuration, p.maxFileSize(mediaType)
+	guest, clipErr := p.isGuest(userID)
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+	if guest {
+		restrictions := p.getConfiguration().guestRestrictions()
+		if !restrictions.allows(mediaType) {
+			writeClipError(w, guestTypeDenied(mediaType))
+			return
+		}
+		maxDuration, maxFileSize = restrictions.maxDuration(mediaType), p.guestMaxFileSize(restrictions, mediaType)
+	}
+
+	now := time.Now()
+	session := &recordingSession{
+		ID:          model.NewId(),
+		UserID:      userID,
+		ChannelID:   body.ChannelID,
+		Type:        mediaType.Name,
+		MaxDuration: maxDuration,
+		MaxFileSize: maxFileSize,
+		IssuedAt:    now.UnixMilli(),
+		ExpiresAt:   now.Add(time.Duration(maxDuration)*time.Second + sessionUploadGrace).UnixMilli(),
+	}
+
+	token, err := p.encodeSession(session)
+	if err != nil {
+		p.API.LogError("Failed to sign recording session", "error", err.Error())
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":         token,
+		"session_id":    session.ID,
+		"expires_at":    session.ExpiresAt,
+		"max_duration":  session.MaxDuration,
+		"max_file_size": session.MaxFileSize,
+	})
+}
+
+// encodeSession serializes and signs a session as "<payload>.<signature>", both
+// base64url encoded.
+func (p *Plugin) encodeSession(session *recordingSession) (string, error) {
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	signature, err := p.sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// decodeSession verifies a session token and returns the session it carries.
+func (p *Plugin) decodeSession(token string) (*recordingSession, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errSessionInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+
+	valid, err := p.verifySignature(payload, signature)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, errSessionInvalid
+	}
+
+	var session recordingSession
+	if err := json.Unmarshal(payload, &session); err != nil {
+		return nil, errSessionInvalid
+	}
+	if time.Now().UnixMilli() > session.ExpiresAt {
+		return nil, errSessionExpired
+	}
+	return &session, nil
+}
+
+// verifySession decodes the session token sent by userID, or returns the error that
+// should be sent to the client.
+func (p *Plugin) verifySession(token, userID string) (*recordingSession, *clipError) {
+	if token == "" {
+		return nil, &clipError{Status: http.StatusBadRequest, Message: "Recording session is required"}
+	}
+
+	session, err := p.decodeSession(token)
+	switch {
+	case errors.Is(err, errSessionExpired):
+		return nil, &clipError{Status: http.StatusForbidden, Message: "Recording session has expired"}
+	case errors.Is(err, errSessionInvalid):
+		return nil, &clipError{Status: http.StatusForbidden, Message: "Invalid recording session"}
+	case err != nil:
+		p.API.LogError("Failed to verify recording session", "error", err.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to verify recording session"}
+	}
+
+	if session.UserID != userID {
+		return nil, &clipError{Status: http.StatusForbidden, Message: "Invalid recording session"}
+	}
+
+	// The media type may have been removed from the configuration since.
+	if session.mediaType = p.getConfiguration().mediaTypes().get(session.Type); session.mediaType == nil {
+		return nil, &clipError{Status: http.StatusForbidden, Message: "Invalid recording session"}
+	}
+	return session, nil
+}
+
+// checkMedia checks an upload against the channel and limits of its session.
+// Every file must declare its duration, which may not be longer than the time
+// since the session started.
+// The session must have been returned by verifySession.
+func (s *recordingSession) checkMedia(channelID string, media []*clipMedia) *clipError {
+	if s.ChannelID != channelID {
+		return &clipError{Status: http.StatusForbidden, Message: "Recording session is for a different channel"}
+	}
+
+	elapsed := time.Since(time.UnixMilli(s.IssuedAt)) + sessionClockTolerance
+	for _, m := range media {
+		if !s.mediaType.allows(m.Type) {
+			return &clipError{Status: http.StatusForbidden, Message: fmt.Sprintf("Recording session does not allow %s", m.Type.Name)}
+		}
+		if m.File != nil && m.File.Size > s.MaxFileSize {
+			return &clipError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("File size exceeds maximum allowed (%d MB)", s.MaxFileSize/(1024*1024))}
+		}
+
+		// Without a duration the upload could not be checked against the session.
+		if m.Duration == "" {
+			return &clipError{Status: http.StatusBadRequest, Message: "Duration is required"}
+		}
+		duration, err := strconv.Atoi(m.Duration)
+		if err != nil || duration < 0 {
+			return &clipError{Status: http.StatusBadRequest, Message: "Invalid duration"}
+		}
+		if duration > s.MaxDuration {
+			return &clipError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Duration exceeds maximum allowed (%d seconds)", s.MaxDuration)}
+		}
+		if time.Duration(duration)*time.Second > elapsed {
+			return &clipError{Status: http.StatusBadRequest, Message: "Duration is longer than the recording session"}
+		}
+	}
+	return nil
+}
+
+// checkRecording checks a server-side recording against the channel and media
+// type of its session. The limits are checked as the recording grows.
+// The session must have been returned by verifySession.
+func (s *recordingSession) checkRecording(channelID string, mediaType *mediaType) *clipError {
+	if s.ChannelID != channelID {
+		return &clipError{Status: http.StatusForbidden, Message: "Recording session is for a different channel"}
+	}
+	if !s.mediaType.allows(mediaType) {
+		return &clipError{Status: http.StatusForbidden, Message: fmt.Sprintf("Recording session does not allow %s", mediaType.Name)}
+	}
+	return nil
+}
+
+// claimSession marks a session as in use so that it cannot be replayed. It returns
+// false when the session was already used or is being used by another request.
+func (p *Plugin) claimSession(s *recordingSession) (bool, error) {
+	claimed, appErr := p.API.KVSetWithOptions(sessionKey(s.ID), []byte(sessionStatusPending), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: sessionTTL(s),
+	})
+	if appErr != nil {
+		return false, appErr
+	}
+	return claimed, nil
+}
+
+// completeSession marks a claimed session as used until it expires.
+func (p *Plugin) completeSession(s *recordingSession) {
+	if appErr := p.API.KVSetWithExpiry(sessionKey(s.ID), []byte(sessionStatusUsed), sessionTTL(s)); appErr != nil {
+		p.API.LogError("Failed to mark recording session as used", "session_id", s.ID, "error", appErr.Error())
+	}
+}
+
+// releaseSession frees a claimed session after a failed upload so the client can retry.
+func (p *Plugin) releaseSession(s *recordingSession) {
+	if appErr := p.API.KVDelete(sessionKey(s.ID)); appErr != nil {
+		p.API.LogError("Failed to release recording session", "session_id", s.ID, "error", appErr.Error())
+	}
+}
+
+// sessionTTL returns how long the used marker must be kept, in seconds.
+func sessionTTL(s *recordingSession) int64 {
+	ttl := (s.ExpiresAt - time.Now().UnixMilli()) / 1000
+	if ttl < 1 {
+		return 1
+	}
+	return ttl + 1
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSigningKey_SharedAcrossNodes(t *testing.T) {
+	api := &plugintest.API{}
+	mockKVStore(api)
+
+	node1 := &Plugin{}
+	node1.SetAPI(api)
+	node2 := &Plugin{}
+	node2.SetAPI(api)
+
+	key1, err := node1.getSigningKey()
+	require.NoError(t, err)
+	key2, err := node2.getSigningKey()
+	require.NoError(t, err)
+
+	assert.Len(t, key1, 32)
+	assert.Equal(t, key1, key2)
+}
+
+func TestHandleCreateSession(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("HasPermissionToChannel", "user123", "readonly123", model.PermissionCreatePost).Return(false)
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"audio", `{"channel_id":"channel123"}`, http.StatusOK},
+		{"video", `{"channel_id":"channel123","type":"video"}`, http.StatusOK},
+		{"unknown type", `{"channel_id":"channel123","type":"image"}`, http.StatusBadRequest},
+		{"missing channel", `{}`, http.StatusBadRequest},
+		{"no permission", `{"channel_id":"readonly123"}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, sessionsPath, strings.NewReader(tt.body))
+			req.Header.Set("Mattermost-User-Id", "user123")
+			w := httptest.NewRecorder()
+			plugin.ServeHTTP(nil, w, req)
+
+			require.Equal(t, tt.expectedStatus, w.Result().StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Token       string `json:"token"`
+				MaxDuration int    `json:"max_duration"`
+			}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+
+			session, err := plugin.decodeSession(body.Token)
+			require.NoError(t, err)
+			assert.Equal(t, "user123", session.UserID)
+			assert.Equal(t, "channel123", session.ChannelID)
+			assert.Equal(t, body.MaxDuration, session.MaxDuration)
+		})
+	}
+}
+
+func TestDecodeSession_Rejected(t *testing.T) {
+	plugin := &Plugin{signingKey: []byte("test-signing-key")}
+
+	valid, err := plugin.encodeSession(&recordingSession{ID: "session123", ExpiresAt: time.Now().Add(time.Hour).UnixMilli()})
+	require.NoError(t, err)
+	payload, signature, _ := strings.Cut(valid, ".")
+
+	expired, err := plugin.encodeSession(&recordingSession{ID: "session123", ExpiresAt: time.Now().Add(-time.Second).UnixMilli()})
+	require.NoError(t, err)
+
+	other := &Plugin{signingKey: []byte("other-signing-key")}
+	foreign, err := other.encodeSession(&recordingSession{ID: "session123", ExpiresAt: time.Now().Add(time.Hour).UnixMilli()})
+	require.NoError(t, err)
+
+	_, err = plugin.decodeSession(valid)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		token    string
+		expected error
+	}{
+		{"malformed", "not-a-token", errSessionInvalid},
+		{"tampered payload", payload + "x." + signature, errSessionInvalid},
+		{"tampered signature", payload + "." + signature[1:], errSessionInvalid},
+		{"other key", foreign, errSessionInvalid},
+		{"expired", expired, errSessionExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := plugin.decodeSession(tt.token)
+			assert.ErrorIs(t, err, tt.expected)
+		})
+	}
+}
+
+func TestHandleUpload_Session(t *testing.T) {
+	newSession := func(mutate func(s *recordingSession)) *recordingSession {
+		s := &recordingSession{
+			ID:          model.NewId(),
+			UserID:      "user123",
+			ChannelID:   "channel123",
+			Type:        "audio",
+			MaxDuration: 300,
+			MaxFileSize: 50 * 1024 * 1024,
+			IssuedAt:    time.Now().Add(-time.Minute).UnixMilli(),
+			ExpiresAt:   time.Now().Add(time.Hour).UnixMilli(),
+		}
+		if mutate != nil {
+			mutate(s)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name           string
+		session        *recordingSession
+		field          string
+		duration       string
+		expectedStatus int
+		expectedError  string
+	}{
+		{"valid", newSession(nil), "audio", "55", http.StatusOK, ""},
+		{"missing", nil, "audio", "5", http.StatusBadRequest, "Recording session is required"},
+		{"other user", newSession(func(s *recordingSession) { s.UserID = "other123" }), "audio", "5", http.StatusForbidden, "Invalid recording session"},
+		{"other channel", newSession(func(s *recordingSession) { s.ChannelID = "channel456" }), "audio", "5", http.StatusForbidden, "different channel"},
+		{"video in audio session", newSession(nil), "video", "5", http.StatusForbidden, "does not allow video"},
+		{"longer than session", newSession(nil), "audio", "90", http.StatusBadRequest, "longer than the recording session"},
+		{"over session limit", newSession(func(s *recordingSession) { s.MaxDuration = 30 }), "audio", "40", http.StatusBadRequest, "Duration exceeds maximum allowed (30 seconds)"},
+		{"without duration", newSession(nil), "audio", "", http.StatusBadRequest, "Duration is required"},
+		{"invalid duration", newSession(nil), "audio", "5s", http.StatusBadRequest, "Invalid duration"},
+		{"negative duration", newSession(nil), "audio", "-5", http.StatusBadRequest, "Invalid duration"},
+		{"expired", newSession(func(s *recordingSession) { s.ExpiresAt = time.Now().Add(-time.Second).UnixMilli() }), "audio", "5", http.StatusForbidden, "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{signingKey: []byte("test-signing-key")}
+			plugin.SetAPI(api)
+			mockUploadAccess(api)
+			mockKVStore(api)
+
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+			api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil)
+			api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+			req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": tt.duration}, tt.field, testWebM())
+			if tt.session != nil {
+				token, err := plugin.encodeSession(tt.session)
+				require.NoError(t, err)
+				req.Header.Set(sessionHeader, token)
+			}
+			w := httptest.NewRecorder()
+			plugin.handleUpload(w, req)
+
+			require.Equal(t, tt.expectedStatus, w.Result().StatusCode, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.expectedError)
+		})
+	}
+}
+
+func TestHandleUpload_SessionReplay(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(nil, model.NewAppError("UploadFile", "store.error", nil, "", http.StatusBadRequest)).Once()
+	api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything).Return()
+
+	first := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM())
+	addSession(t, plugin, first, "channel123", "audio")
+	token := first.Header.Get(sessionHeader)
+
+	upload := func() int {
+		req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5"}, "audio", testWebM())
+		req.Header.Set(sessionHeader, token)
+		w := httptest.NewRecorder()
+		plugin.handleUpload(w, req)
+		return w.Result().StatusCode
+	}
+
+	// A failed upload releases the session so the client can retry.
+	assert.Equal(t, http.StatusInternalServerError, upload())
+	assert.Equal(t, http.StatusOK, upload())
+	assert.Equal(t, http.StatusConflict, upload())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// signingKeyKVKey stores the HMAC key shared by every node of the cluster.
+const signingKeyKVKey = "signing_key"
+
+// clipSignatureProp is the post prop holding the signature of a clip post.
+const clipSignatureProp = "clip_signature"
+
+// getSigningKey returns the plugin's HMAC key, generating and storing it on first use.
+func (p *Plugin) getSigningKey() ([]byte, error) {
+	p.signingKeyLock.Lock()
+	defer p.signingKeyLock.Unlock()
+
+	if p.signingKey != nil {
+		return p.signingKey, nil
+	}
+
+	key, appErr := p.API.KVGet(signingKeyKVKey)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if key == nil {
+		generated := make([]byte, 32)
+		if _, err := rand.Read(generated); err != nil {
+			return nil, errors.Wrap(err, "failed to generate signing key")
+		}
+
+		// Another node may have stored its key first; use whichever won.
+		saved, appErr := p.API.KVSetWithOptions(signingKeyKVKey, generated, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: nil,
+		})
+		if appErr != nil {
+			return nil, appErr
+		}
+		if saved {
+			key = generated
+		} else if key, appErr = p.API.KVGet(signingKeyKVKey); appErr != nil {
+			return nil, appErr
+		}
+		if key == nil {
+			return nil, errors.New("signing key is missing")
+		}
+	}
+
+	p.signingKey = key
+	return key, nil
+}
+
+// sign returns the HMAC-SHA256 of data.
+func (p *Plugin) sign(data []byte) ([]byte, error) {
+	key, err := p.getSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// verifySignature reports whether signature is the HMAC of data.
+func (p *Plugin) verifySignature(data, signature []byte) (bool, error) {
+	expected, err := p.sign(data)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(expected, signature), nil
+}
+
+// clipSignatureData returns the parts of a clip post covered by its signature: the
+// post type, author, channel, files and the clip props. The caption is not signed so
+// that it can be edited.
+func clipSignatureData(post *model.Post, propsKey string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":       post.Type,
+		"user_id":    post.UserId,
+		"channel_id": post.ChannelId,
+		"file_ids":   []string(post.FileIds),
+		"props":      post.GetProp(propsKey),
+	})
+}
+
+// signClipPost stores the signature of a clip post in its props. It must be called
+// again after every change to the signed parts.
+func (p *Plugin) signClipPost(post *model.Post, propsKey string) error {
+	data, err := clipSignatureData(post, propsKey)
+	if err != nil {
+		return err
+	}
+	signature, err := p.sign(data)
+	if err != nil {
+		return err
+	}
+	post.AddProp(clipSignatureProp, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// verifyClipPost reports whether a clip post carries a valid signature, i.e. it was
+// created by the plugin and its signed parts have not been changed since.
+func (p *Plugin) verifyClipPost(post *model.Post, propsKey string) (bool, error) {
+	encoded, ok := post.GetProp(clipSignatureProp).(string)
+	if !ok {
+		return false, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false, nil
+	}
+
+	data, err := clipSignatureData(post, propsKey)
+	if err != nil {
+		return false, err
+	}
+	return p.verifySignature(data, signature)
+}
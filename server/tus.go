@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusBasePath   = "/api/v1/tus"
+
+	// tusUploadExpiry is how long an unfinished upload is kept before it is
+	// discarded together with its chunks.
+	tusUploadExpiry = 24 * time.Hour
+
+	// tusMaxChunkSize bounds how much of a single PATCH request is accepted. Clients
+	// sending more simply resume from the returned offset.
+	tusMaxChunkSize = 8 * 1024 * 1024
+
+	// tusCompletionLease bounds how long a request may hold a complete upload
+	// while posting its clip, in case the server handling it goes away.
+	tusCompletionLease = 10 * time.Minute
+
+	tusKeyPrefix = "tus_"
+)
+
+// tusUpload is the server-side state of a resumable upload, stored in the plugin
+// KV store so that any cluster node can continue it.
+type tusUpload struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	Type      string `json:"type"`
+	Filename  string `json:"filename"`
+	Duration  string `json:"duration"`
+	Message   string `json:"message,omitempty"`
+	RootID    string `json:"root_id,omitempty"`
+	Length    int64  `json:"length"`
+	Offset    int64  `json:"offset"`
+	Chunks    int    `json:"chunks"`
+	ExpiresAt int64  `json:"expires_at"`
+
+	// Encrypted is set when the upload started with encryption at rest on; its
+	// chunks are then stored encrypted with the data key of the channel.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// CompletingUntil is set while a request posts the clip of the complete upload.
+	CompletingUntil int64 `json:"completing_until,omitempty"`
+}
+
+func tusUploadKey(id string) string {
+	return tusKeyPrefix + id
+}
+
+func tusChunkKey(id string, index int) string {
+	return fmt.Sprintf("%s%s_%d", tusKeyPrefix, id, index)
+}
+
+// handleTus implements the tus resumable upload protocol (core, creation, expiration
+// and termination) for clip media.
+func (p *Plugin) handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodOptions {
+		var maxSize int64
+		for _, t := range p.getConfiguration().mediaTypes().all() {
+			if limit := p.maxFileSize(t); limit > maxSize {
+				maxSize = limit
+			}
+		}
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, tusBasePath), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.handleTusCreate(w, r, userID)
+		return
+	}
+
+	upload, err := p.getTusUpload(id)
+	if err != nil {
+		p.API.LogError("Failed to load upload", "upload_id", id, "error", err.Error())
+		http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+		return
+	}
+	if upload == nil || upload.UserID != userID {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", time.Unix(upload.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		p.handleTusPatch(w, r, upload)
+	case http.MethodDelete:
+		p.deleteTusUpload(upload)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTusCreate creates a new upload from the Upload-Length and Upload-Metadata headers.
+func (p *Plugin) handleTusCreate(w http.ResponseWriter, r *http.Request, userID string) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Deferred upload length is not supported", http.StatusBadRequest)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	channelID := metadata["channel_id"]
+	if channelID == "" {
+		http.Error(w, "channel_id is required", http.StatusBadRequest)
+		return
+	}
+
+	config := p.getConfiguration()
+	mediaType, clipErr := p.getMediaType(metadata["type"])
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+	if maxFileSize := p.maxFileSize(mediaType); length > maxFileSize {
+		http.Error(w, fmt.Sprintf("File size exceeds maximum allowed (%d MB)", maxFileSize/(1024*1024)), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if _, clipErr := p.validateClipDuration(&clipMedia{Type: mediaType, Duration: metadata["duration"]}); clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	// Check access up front so that clients don't transfer a file that can never be posted.
+	if clipErr := p.checkUploadAccess(userID, channelID); clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	// The recording session is used up by creating the upload; the upload itself
+	// can then be resumed as often as needed.
+	created := false
+	if config.RequireRecordingSession {
+		session, clipErr := p.verifySession(metadata["session"], userID)
+		if clipErr == nil && length > session.MaxFileSize {
+			clipErr = &clipError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("File size exceeds maximum allowed (%d MB)", session.MaxFileSize/(1024*1024))}
+		}
+		if clipErr == nil {
+			clipErr = session.checkMedia(channelID, []*clipMedia{{Type: mediaType, Duration: metadata["duration"]}})
+		}
+		if clipErr != nil {
+			writeClipError(w, clipErr)
+			return
+		}
+
+		claimed, err := p.claimSession(session)
+		if err != nil {
+			p.API.LogError("Failed to claim recording session", "error", err.Error())
+			http.Error(w, "Failed to verify recording session", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			http.Error(w, "Recording session has already been used", http.StatusConflict)
+			return
+		}
+		defer func() {
+			if created {
+				p.completeSession(session)
+			} else {
+				p.releaseSession(session)
+			}
+		}()
+	}
+
+	upload := &tusUpload{
+		ID:        model.NewId(),
+		UserID:    userID,
+		ChannelID: channelID,
+		Type:      mediaType.Name,
+		Filename:  metadata["filename"],
+		Duration:  metadata["duration"],
+		Message:   metadata["message"],
+		RootID:    metadata["root_id"],
+		Length:    length,
+		ExpiresAt: time.Now().Add(tusUploadExpiry).Unix(),
+		Encrypted: config.encryption != nil,
+	}
+
+	data, err := json.Marshal(upload)
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if appErr := p.API.KVSetWithExpiry(tusUploadKey(upload.ID), data, int64(tusUploadExpiry.Seconds())); appErr != nil {
+		p.API.LogError("Failed to create upload", "error", appErr.Error())
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	created = true
+
+	w.Header().Set("Location", fmt.Sprintf("/plugins/%s%s/%s", pluginID, tusBasePath, upload.ID))
+	w.Header().Set("Upload-Expires", time.Unix(upload.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleTusPatch appends the request body to the upload at the given offset and,
+// once all bytes have arrived, validates the media and creates the clip post.
+func (p *Plugin) handleTusPatch(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, "Upload-Offset does not match current offset", http.StatusConflict)
+		return
+	}
+
+	limit := upload.Length - upload.Offset
+	reserve := upload.Length
+	if limit > tusMaxChunkSize {
+		limit = tusMaxChunkSize
+		reserve = limit
+	}
+
+	// The request that completes the upload holds the whole file while it is posted.
+	release, ok := p.admitUpload(w, r, upload.UserID, reserve)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// A client that drops mid-request still gets to keep what was received.
+	chunk, readErr := io.ReadAll(io.LimitReader(r.Body, limit))
+	if len(chunk) > 0 {
+		ttl := upload.ExpiresAt - time.Now().Unix()
+		if ttl <= 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		sealed, err := p.sealChunk(upload.Encrypted, upload.ChannelID, chunk)
+		if err != nil {
+			p.API.LogError("Failed to encrypt upload chunk", "upload_id", upload.ID, "error", err.Error())
+			http.Error(w, "Failed to store upload chunk", http.StatusInternalServerError)
+			return
+		}
+
+		// The chunk key is claimed atomically, so of two requests for the same
+		// offset only one stores its chunk; the other gets a conflict and resumes.
+		key := tusChunkKey(upload.ID, upload.Chunks)
+		stored, appErr := p.API.KVSetWithOptions(key, sealed, model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        nil,
+			ExpireInSeconds: ttl,
+		})
+		if appErr != nil {
+			p.API.LogError("Failed to store upload chunk", "upload_id", upload.ID, "error", appErr.Error())
+			http.Error(w, "Failed to store upload chunk", http.StatusInternalServerError)
+			return
+		}
+		if !stored {
+			http.Error(w, "Upload was modified concurrently", http.StatusConflict)
+			return
+		}
+
+		saved, err := p.updateTusUpload(upload, func(u *tusUpload) {
+			u.Offset += int64(len(chunk))
+			u.Chunks++
+		})
+		if err != nil || !saved {
+			if appErr := p.API.KVDelete(key); appErr != nil {
+				p.API.LogWarn("Failed to delete upload chunk", "upload_id", upload.ID, "error", appErr.Error())
+			}
+		}
+		if err != nil {
+			p.API.LogError("Failed to update upload", "upload_id", upload.ID, "error", err.Error())
+			http.Error(w, "Failed to update upload", http.StatusInternalServerError)
+			return
+		}
+		if !saved {
+			http.Error(w, "Upload was modified concurrently", http.StatusConflict)
+			return
+		}
+	}
+
+	if readErr != nil {
+		p.API.LogWarn("Upload chunk interrupted", "upload_id", upload.ID, "error", readErr.Error())
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", time.Unix(upload.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+
+	if upload.Offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	result, clipErr := p.completeTusUpload(upload)
+	if clipErr != nil {
+		writeClipError(w, clipErr)
+		return
+	}
+
+	w.Header().Set("Voice-Clip-Post-Id", result.Post.Id)
+	w.Header().Set("Voice-Clip-File-Id", result.FileInfo.Id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeTusUpload assembles the stored chunks and runs them through the regular
+// clip pipeline. Only one request completes an upload at a time. The upload is
+// removed once the clip is posted or rejected for good; after a failure the client
+// may retry, e.g. after Retry-After, with an empty PATCH at the final offset.
+func (p *Plugin) completeTusUpload(upload *tusUpload) (*clipResult, *clipError) {
+	now := time.Now().Unix()
+	if upload.CompletingUntil > now {
+		return nil, &clipError{Status: http.StatusConflict, Message: "Upload is already being completed"}
+	}
+	saved, err := p.updateTusUpload(upload, func(u *tusUpload) {
+		u.CompletingUntil = now + int64(tusCompletionLease.Seconds())
+	})
+	if err != nil {
+		p.API.LogError("Failed to update upload", "upload_id", upload.ID, "error", err.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to update upload"}
+	}
+	if !saved {
+		return nil, &clipError{Status: http.StatusConflict, Message: "Upload is already being completed"}
+	}
+
+	result, clipErr := p.createTusClip(upload)
+	if clipErr == nil || clipErr.permanent() {
+		p.deleteTusUpload(upload)
+		return result, clipErr
+	}
+
+	// Keep the chunks for a retry.
+	if _, err := p.updateTusUpload(upload, func(u *tusUpload) {
+		u.CompletingUntil = 0
+	}); err != nil {
+		p.API.LogWarn("Failed to release upload", "upload_id", upload.ID, "error", err.Error())
+	}
+	return nil, clipErr
+}
+
+// createTusClip posts the clip of a complete upload.
+func (p *Plugin) createTusClip(upload *tusUpload) (*clipResult, *clipError) {
+	mediaType, clipErr := p.getMediaType(upload.Type)
+	if clipErr != nil {
+		return nil, clipErr
+	}
+
+	chunks := &kvChunkReader{api: p.API, count: upload.Chunks, key: func(i int) string {
+		return tusChunkKey(upload.ID, i)
+	}, open: p.openChunk(upload.Encrypted, upload.ChannelID)}
+	file, err := spoolFile(chunks, upload.Filename, upload.Length)
+	if err != nil {
+		p.API.LogError("Failed to assemble upload", "upload_id", upload.ID, "error", err.Error())
+		return nil, &clipError{Status: http.StatusInternalServerError, Message: "Failed to assemble upload"}
+	}
+	defer file.Close()
+
+	return p.createClip(&clipRequest{
+		UserID:    upload.UserID,
+		ChannelID: upload.ChannelID,
+		Media:     []*clipMedia{{Type: mediaType, Duration: upload.Duration, File: file}},
+		Message:   upload.Message,
+		RootID:    upload.RootID,
+	})
+}
+
+// updateTusUpload applies update to the upload and stores it if the stored upload
+// has not changed since it was loaded. It reports false on a concurrent change, in
+// which case upload is left as it was.
+func (p *Plugin) updateTusUpload(upload *tusUpload, update func(*tusUpload)) (bool, error) {
+	ttl := upload.ExpiresAt - time.Now().Unix()
+	if ttl <= 0 {
+		return false, nil
+	}
+
+	oldData, err := json.Marshal(upload)
+	if err != nil {
+		return false, err
+	}
+	updated := *upload
+	update(&updated)
+	newData, err := json.Marshal(&updated)
+	if err != nil {
+		return false, err
+	}
+
+	saved, appErr := p.API.KVSetWithOptions(tusUploadKey(upload.ID), newData, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        oldData,
+		ExpireInSeconds: ttl,
+	})
+	if appErr != nil {
+		return false, appErr
+	}
+	if saved {
+		*upload = updated
+	}
+	return saved, nil
+}
+
+func (p *Plugin) getTusUpload(id string) (*tusUpload, error) {
+	data, appErr := p.API.KVGet(tusUploadKey(id))
+	if appErr != nil {
+		return nil, appErr
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, errors.Wrap(err, "failed to decode upload")
+	}
+	return &upload, nil
+}
+
+func (p *Plugin) deleteTusUpload(upload *tusUpload) {
+	for i := 0; i < upload.Chunks; i++ {
+		if appErr := p.API.KVDelete(tusChunkKey(upload.ID, i)); appErr != nil {
+			p.API.LogWarn("Failed to delete upload chunk", "upload_id", upload.ID, "error", appErr.Error())
+		}
+	}
+	if appErr := p.API.KVDelete(tusUploadKey(upload.ID)); appErr != nil {
+		p.API.LogWarn("Failed to delete upload", "upload_id", upload.ID, "error", appErr.Error())
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header of comma-separated
+// "key base64value" pairs.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid metadata value for %s", fields[0])
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, errors.Errorf("invalid metadata pair %q", pair)
+		}
+	}
+	return metadata, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTusRequest(method, path string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Mattermost-User-Id", "user123")
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return req
+}
+
+func encodeTusMetadata(values map[string]string) string {
+	var pairs []string
+	for key, value := range values {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	metadata, err := parseTusMetadata("filename dm9pY2Uud2VibQ==,channel_id Y2hhbm5lbDEyMw==,empty")
+	require.NoError(t, err)
+	assert.Equal(t, "voice.webm", metadata["filename"])
+	assert.Equal(t, "channel123", metadata["channel_id"])
+	assert.Equal(t, "", metadata["empty"])
+
+	_, err = parseTusMetadata("filename !!!")
+	assert.Error(t, err)
+}
+
+func TestHandleTus_Options(t *testing.T) {
+	api := &plugintest.API{}
+	mockUploadAccess(api)
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	req := newTusRequest(http.MethodOptions, tusBasePath, nil)
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, tusVersion, resp.Header.Get("Tus-Version"))
+	assert.Contains(t, resp.Header.Get("Tus-Extension"), "creation")
+}
+
+func TestHandleTus_UnsupportedVersion(t *testing.T) {
+	plugin := &Plugin{}
+	plugin.SetAPI(&plugintest.API{})
+
+	req := newTusRequest(http.MethodPost, tusBasePath, nil)
+	req.Header.Set("Tus-Resumable", "0.2.2")
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Result().StatusCode)
+}
+
+func TestHandleTus_CreateTooLarge(t *testing.T) {
+	api := &plugintest.API{}
+	mockUploadAccess(api)
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	req := newTusRequest(http.MethodPost, tusBasePath, nil)
+	req.Header.Set("Upload-Length", "999999999999")
+	req.Header.Set("Upload-Metadata", encodeTusMetadata(map[string]string{"channel_id": "channel123"}))
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+}
+
+func TestHandleTus_ResumableUpload(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+
+	media := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, bytes.Repeat([]byte{0x00}, 4092)...)
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", media, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+	// Create
+	req := newTusRequest(http.MethodPost, tusBasePath, nil)
+	addSession(t, plugin, req, "channel123", "audio")
+	req.Header.Set("Upload-Length", "4096")
+	req.Header.Set("Upload-Metadata", encodeTusMetadata(map[string]string{
+		"channel_id": "channel123",
+		"filename":   "voice.webm",
+		"duration":   "5",
+		"session":    req.Header.Get(sessionHeader),
+	}))
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+
+	resp := w.Result()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	require.True(t, strings.HasPrefix(location, "/plugins/"+pluginID+tusBasePath+"/"))
+	uploadPath := strings.TrimPrefix(location, "/plugins/"+pluginID)
+
+	// First chunk
+	req = newTusRequest(http.MethodPatch, uploadPath, media[:1000])
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	assert.Equal(t, "1000", w.Result().Header.Get("Upload-Offset"))
+
+	// Stale offset is rejected
+	req = newTusRequest(http.MethodPatch, uploadPath, media[:1000])
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+
+	// Status
+	req = newTusRequest(http.MethodHead, uploadPath, nil)
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	assert.Equal(t, "1000", w.Result().Header.Get("Upload-Offset"))
+	assert.Equal(t, "4096", w.Result().Header.Get("Upload-Length"))
+
+	// Final chunk creates the post
+	req = newTusRequest(http.MethodPatch, uploadPath, media[1000:])
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "1000")
+	w = httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+
+	resp = w.Result()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "post123", resp.Header.Get("Voice-Clip-Post-Id"))
+	assert.Equal(t, "file123", resp.Header.Get("Voice-Clip-File-Id"))
+	assert.Empty(t, kvKeysWithPrefix(store, "tus_"), "completed uploads should be removed from the KV store")
+}
+
+// createTusUpload creates an upload of length bytes and returns its path.
+func createTusUpload(t *testing.T, plugin *Plugin, length int) string {
+	req := newTusRequest(http.MethodPost, tusBasePath, nil)
+	addSession(t, plugin, req, "channel123", "audio")
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", encodeTusMetadata(map[string]string{
+		"channel_id": "channel123",
+		"filename":   "voice.webm",
+		"duration":   "5",
+		"session":    req.Header.Get(sessionHeader),
+	}))
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	return strings.TrimPrefix(w.Result().Header.Get("Location"), "/plugins/"+pluginID)
+}
+
+func patchTusUpload(plugin *Plugin, uploadPath string, offset int, data []byte) *httptest.ResponseRecorder {
+	req := newTusRequest(http.MethodPatch, uploadPath, data)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, req)
+	return w
+}
+
+func TestHandleTus_ConcurrentChunk(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	uploadPath := createTusUpload(t, plugin, 4096)
+	id := path.Base(uploadPath)
+
+	// Another request stored its chunk for the same offset but has not
+	// advanced the offset yet.
+	store[tusChunkKey(id, 0)] = []byte("other")
+
+	w := patchTusUpload(plugin, uploadPath, 0, bytes.Repeat([]byte{0x01}, 1000))
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+	assert.Equal(t, []byte("other"), store[tusChunkKey(id, 0)])
+
+	upload, err := plugin.getTusUpload(id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), upload.Offset)
+	assert.Equal(t, 0, upload.Chunks)
+}
+
+func TestHandleTus_RetryCompletion(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+	retryBackoff = 0
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+	media := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, bytes.Repeat([]byte{0x00}, 4092)...)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("UploadFile", media, "channel123", mock.AnythingOfType("string")).
+		Return(nil, model.NewAppError("UploadFile", "app.file.upload.error", nil, "", http.StatusInternalServerError)).Times(maxAttempts)
+	api.On("UploadFile", media, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post123"}, nil)
+
+	uploadPath := createTusUpload(t, plugin, len(media))
+
+	// A server error keeps the chunks.
+	w := patchTusUpload(plugin, uploadPath, 0, media)
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	assert.NotEmpty(t, kvKeysWithPrefix(store, "tus_"))
+
+	// An empty request at the final offset retries the completion.
+	w = patchTusUpload(plugin, uploadPath, len(media), nil)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	assert.Equal(t, "post123", w.Result().Header.Get("Voice-Clip-Post-Id"))
+	assert.Empty(t, kvKeysWithPrefix(store, "tus_"))
+}
+
+func TestHandleTus_RejectedCompletion(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	store := mockKVStore(api)
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+	uploadPath := createTusUpload(t, plugin, 4096)
+
+	// Media that fails validation cannot pass on a retry and is discarded.
+	w := patchTusUpload(plugin, uploadPath, 0, bytes.Repeat([]byte{0x01}, 4096))
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Empty(t, kvKeysWithPrefix(store, "tus_"))
+}
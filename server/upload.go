@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sniffLen is the number of leading bytes kept in memory for file signature checks.
+	sniffLen = 512
+
+	// maxFormValueSize bounds the size of a single non-file form field.
+	maxFormValueSize = 64 * 1024
+
+	// multipartOverhead is the slack allowed on top of the media size limit for
+	// multipart boundaries, part headers and form fields.
+	multipartOverhead = 1024 * 1024
+)
+
+// errFileTooLarge is returned when an uploaded part exceeds its size limit.
+var errFileTooLarge = errors.New("file exceeds maximum allowed size")
+
+// spooledFile is an uploaded file whose leading bytes are kept in memory and whose
+// full content is spooled to a temporary file on disk, or held in memory for files
+// read back from Mattermost.
+type spooledFile struct {
+	Filename string
+	Header   []byte
+	Size     int64
+
+	file *os.File
+	data []byte
+}
+
+// spoolFile copies r into a temporary file, failing with errFileTooLarge as soon as
+// more than limit bytes have been read.
+func spoolFile(r io.Reader, filename string, limit int64) (*spooledFile, error) {
+	tmp, err := os.CreateTemp("", "voice-clip-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temporary file")
+	}
+
+	spooled := &spooledFile{Filename: filename, file: tmp}
+
+	header := &bytes.Buffer{}
+	size, err := io.Copy(io.MultiWriter(tmp, &prefixWriter{buf: header, max: sniffLen}), io.LimitReader(r, limit+1))
+	if err != nil {
+		_ = spooled.Close()
+		return nil, errors.Wrap(err, "failed to spool file")
+	}
+	if size > limit {
+		_ = spooled.Close()
+		return nil, errFileTooLarge
+	}
+
+	spooled.Header = header.Bytes()
+	spooled.Size = size
+	return spooled, nil
+}
+
+// ReadAll returns the full spooled content.
+func (s *spooledFile) ReadAll() ([]byte, error) {
+	r, err := s.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// Reader returns a reader over the full content from the start.
+func (s *spooledFile) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.data), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "failed to rewind spooled file")
+	}
+	return s.file, nil
+}
+
+// Close releases and removes the temporary file.
+func (s *spooledFile) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	closeErr := s.file.Close()
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return closeErr
+}
+
+// prefixWriter keeps the first max bytes written to it and discards the rest.
+type prefixWriter struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	if remaining := w.max - w.buf.Len(); remaining > 0 {
+		if len(b) > remaining {
+			w.buf.Write(b[:remaining])
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return len(b), nil
+}
+
+// uploadForm holds the parsed fields and spooled files of a multipart upload, in
+// the order they were sent.
+type uploadForm struct {
+	Values map[string][]string
+	Files  []*formFile
+}
+
+// formFile is a spooled file part together with its form field name.
+type formFile struct {
+	Field string
+	*spooledFile
+}
+
+// readUploadForm streams a multipart request, keeping form values in memory and
+// spooling file parts to disk. fileLimit returns the size limit for a file field
+// and whether the field is accepted at all; unknown file fields are discarded.
+func readUploadForm(r *http.Request, fileLimit func(field string) (int64, bool)) (*uploadForm, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &uploadForm{
+		Values: make(map[string][]string),
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			form.Close()
+			return nil, err
+		}
+
+		if err := form.readPart(part, fileLimit); err != nil {
+			part.Close()
+			form.Close()
+			return nil, err
+		}
+		part.Close()
+	}
+}
+
+func (f *uploadForm) readPart(part *multipart.Part, fileLimit func(field string) (int64, bool)) error {
+	name := part.FormName()
+	if name == "" {
+		return nil
+	}
+
+	if part.FileName() == "" {
+		value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+		if err != nil {
+			return err
+		}
+		if len(value) > maxFormValueSize {
+			return errors.Errorf("form field %s is too large", name)
+		}
+		f.Values[name] = append(f.Values[name], string(value))
+		return nil
+	}
+
+	limit, ok := fileLimit(name)
+	if !ok {
+		_, err := io.Copy(io.Discard, part)
+		return err
+	}
+
+	spooled, err := spoolFile(part, part.FileName(), limit)
+	if err != nil {
+		return err
+	}
+	f.Files = append(f.Files, &formFile{Field: name, spooledFile: spooled})
+	return nil
+}
+
+// Value returns the first form value for the given field, or an empty string.
+func (f *uploadForm) Value(name string) string {
+	if values := f.Values[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// List returns every value of a field, splitting comma-separated values.
+func (f *uploadForm) List(name string) []string {
+	var list []string
+	for _, value := range f.Values[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// Close removes every spooled file.
+func (f *uploadForm) Close() {
+	for _, file := range f.Files {
+		_ = file.Close()
+	}
+}
+
+// kvChunkReader reads a sequence of chunks stored under separate KV keys as a
+// single stream.
+type kvChunkReader struct {
+	api   plugin.API
+	key   func(index int) string
+	count int
+	next  int
+	cur   *bytes.Reader
+
+	// open decrypts a chunk stored encrypted; nil leaves chunks as they are.
+	open func(data []byte) ([]byte, error)
+}
+
+func (c *kvChunkReader) Read(b []byte) (int, error) {
+	for c.cur == nil || c.cur.Len() == 0 {
+		if c.next >= c.count {
+			return 0, io.EOF
+		}
+		data, appErr := c.api.KVGet(c.key(c.next))
+		if appErr != nil {
+			return 0, appErr
+		}
+		if data == nil {
+			return 0, errors.Errorf("chunk %d is missing", c.next)
+		}
+		if c.open != nil {
+			var err error
+			if data, err = c.open(data); err != nil {
+				return 0, errors.Wrapf(err, "failed to decrypt chunk %d", c.next)
+			}
+		}
+		c.cur = bytes.NewReader(data)
+		c.next++
+	}
+	return c.cur.Read(b)
+}
+
+// isRequestTooLarge reports whether err was caused by exceeding a size limit.
+func isRequestTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.Is(err, errFileTooLarge) || errors.As(err, &maxBytesErr)
+}
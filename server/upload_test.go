@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolFile(t *testing.T) {
+	data := bytes.Repeat([]byte{0xAB}, 2048)
+
+	spooled, err := spoolFile(bytes.NewReader(data), "clip.webm", 4096)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(len(data)), spooled.Size)
+	assert.Equal(t, data[:sniffLen], spooled.Header)
+
+	content, err := spooled.ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+
+	name := spooled.file.Name()
+	require.NoError(t, spooled.Close())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSpoolFile_TooLarge(t *testing.T) {
+	_, err := spoolFile(bytes.NewReader(make([]byte, 2048)), "clip.webm", 1024)
+	assert.ErrorIs(t, err, errFileTooLarge)
+}
+
+func TestHandleUpload_FileTooLarge(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	plugin.setConfiguration(&configuration{
+		MaxAudioFileSize: 1,
+		MaxVideoFileSize: 1,
+	})
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("audio", "clip.webm")
+	require.NoError(t, err)
+	_, err = part.Write(bytes.Repeat([]byte{0x1A}, 2*1024*1024))
+	require.NoError(t, err)
+	require.NoError(t, writer.WriteField("channel_id", "channel123"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/v1/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Mattermost-User-Id", "user123")
+	w := httptest.NewRecorder()
+
+	plugin.handleUpload(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestHandleUpload_InvalidDuration(t *testing.T) {
+	tests := []struct {
+		name            string
+		duration        string
+		expectedMessage string
+	}{
+		{"missing", "", "Duration is required"},
+		{"not a number", "5s", "Invalid duration"},
+		{"negative", "-5", "Invalid duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{}
+			plugin.SetAPI(api)
+			plugin.setConfiguration(&configuration{})
+			mockUploadAccess(api)
+			mockKVStore(api)
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+
+			fields := map[string]string{"channel_id": "channel123"}
+			if tt.duration != "" {
+				fields["duration"] = tt.duration
+			}
+			w := httptest.NewRecorder()
+			plugin.handleUpload(w, newUploadRequest(t, fields, "audio", testWebM()))
+			assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+			assert.Contains(t, w.Body.String(), tt.expectedMessage)
+			api.AssertNotCalled(t, "UploadFile", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestReadUploadForm_DiscardsUnknownFiles(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("other", "other.bin")
+	require.NoError(t, err)
+	_, err = part.Write([]byte(strings.Repeat("x", 100)))
+	require.NoError(t, err)
+	require.NoError(t, writer.WriteField("channel_id", "channel123"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/v1/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	form, err := readUploadForm(req, func(field string) (int64, bool) {
+		return 1024, field == "audio"
+	})
+	require.NoError(t, err)
+	defer form.Close()
+
+	assert.Equal(t, "channel123", form.Value("channel_id"))
+	assert.Empty(t, form.Files)
+}
+
+func TestReadUploadForm_KeepsPartOrder(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, field := range []string{"video", "audio", "audio"} {
+		part, err := writer.CreateFormFile(field, field+".webm")
+		require.NoError(t, err)
+		_, err = part.Write(testWebM())
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.WriteField("duration", "30"))
+	require.NoError(t, writer.WriteField("duration", "12"))
+	require.NoError(t, writer.WriteField("file_ids", "file1, file2"))
+	require.NoError(t, writer.WriteField("file_ids", "file3"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/v1/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	form, err := readUploadForm(req, func(field string) (int64, bool) {
+		return 4096, field == "audio" || field == "video"
+	})
+	require.NoError(t, err)
+	defer form.Close()
+
+	require.Len(t, form.Files, 3)
+	assert.Equal(t, "video", form.Files[0].Field)
+	assert.Equal(t, "audio", form.Files[1].Field)
+	assert.Equal(t, "audio", form.Files[2].Field)
+	assert.Equal(t, "30", form.Value("duration"))
+	assert.Equal(t, []string{"30", "12"}, form.Values["duration"])
+	assert.Equal(t, []string{"file1", "file2", "file3"}, form.List("file_ids"))
+}
+
+func TestHandleUpload_MultipleFiles(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	mockUploadAccess(api)
+	mockKVStore(api)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, field := range []string{"audio", "video"} {
+		part, err := writer.CreateFormFile(field, field+".webm")
+		require.NoError(t, err)
+		_, err = part.Write(testWebM())
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.WriteField("channel_id", "channel123"))
+	require.NoError(t, writer.WriteField("duration", "20"))
+	require.NoError(t, writer.WriteField("duration", "45"))
+	require.NoError(t, writer.WriteField("file_ids", "screenshot123"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/v1/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Mattermost-User-Id", "user123")
+	addSession(t, plugin, req, "channel123", "video")
+
+	api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+	api.On("GetFileInfo", "screenshot123").Return(&model.FileInfo{Id: "screenshot123", CreatorId: "user123", ChannelId: "channel123", Name: "screenshot.png", MimeType: "image/png"}, nil)
+	api.On("UploadFile", mock.Anything, "channel123", mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, "video_clip_")
+	})).Return(&model.FileInfo{Id: "video123"}, nil)
+	api.On("UploadFile", mock.Anything, "channel123", mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, "voice_clip_")
+	})).Return(&model.FileInfo{Id: "audio123"}, nil)
+
+	var created *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		created = args.Get(0).(*model.Post)
+	}).Return(&model.Post{Id: "post123"}, nil)
+
+	w := httptest.NewRecorder()
+	plugin.handleUpload(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// The video is the primary media and comes first.
+	require.NotNil(t, created)
+	assert.Equal(t, "custom_video_clip", created.Type)
+	assert.Equal(t, model.StringArray{"video123", "audio123", "screenshot123"}, created.FileIds)
+
+	requireGobEncodable(t, created)
+	props := created.GetProp("video_clip").(map[string]interface{})
+	assert.Equal(t, 45, props["duration"])
+	files := props["files"].([]interface{})
+	require.Len(t, files, 3)
+	assert.Equal(t, map[string]interface{}{"file_id": "video123", "type": "video", "duration": 45, "format": ".webm", "size": int64(2048)}, files[0])
+	assert.Equal(t, map[string]interface{}{"file_id": "audio123", "type": "audio", "duration": 20, "format": ".webm", "size": int64(2048)}, files[1])
+	assert.Equal(t, map[string]interface{}{"file_id": "screenshot123", "type": "file", "name": "screenshot.png", "mime_type": "image/png"}, files[2])
+	assert.Len(t, props["job_ids"], 2)
+
+	var response map[string]interface{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, "video123", response["file_id"])
+	assert.Equal(t, []interface{}{"video123", "audio123", "screenshot123"}, response["file_ids"])
+}
+
+func TestHandleUpload_RejectsForeignAttachments(t *testing.T) {
+	tests := []struct {
+		name string
+		info *model.FileInfo
+	}{
+		{"other user", &model.FileInfo{Id: "file123", CreatorId: "other123", ChannelId: "channel123"}},
+		{"other channel", &model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel456"}},
+		{"already attached", &model.FileInfo{Id: "file123", CreatorId: "user123", ChannelId: "channel123", PostId: "post456"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{}
+			plugin.SetAPI(api)
+			mockUploadAccess(api)
+			mockKVStore(api)
+
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+			api.On("GetFileInfo", "file123").Return(tt.info, nil)
+
+			req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5", "file_ids": "file123"}, "audio", testWebM())
+			addSession(t, plugin, req, "channel123", "audio")
+			w := httptest.NewRecorder()
+			plugin.handleUpload(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+			assert.Contains(t, w.Body.String(), "cannot be attached")
+			api.AssertNotCalled(t, "UploadFile", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestHandleUpload_Caption(t *testing.T) {
+	tests := []struct {
+		name            string
+		message         string
+		expectedStatus  int
+		expectedMessage string
+	}{
+		{"no caption", "", http.StatusOK, "🎤 Voice message"},
+		{"blank caption", "   ", http.StatusOK, "🎤 Voice message"},
+		{"caption", " Repro steps for @alice #bug ", http.StatusOK, "Repro steps for @alice #bug"},
+		{"caption too long", strings.Repeat("a", model.PostMessageMaxRunesV2+1), http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{}
+			plugin.SetAPI(api)
+			mockUploadAccess(api)
+			mockKVStore(api)
+
+			var created *model.Post
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+			api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil)
+			api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+				created = args.Get(0).(*model.Post)
+			}).Return(&model.Post{Id: "post123"}, nil)
+
+			req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5", "message": tt.message}, "audio", testWebM())
+			addSession(t, plugin, req, "channel123", "audio")
+			w := httptest.NewRecorder()
+			plugin.handleUpload(w, req)
+
+			require.Equal(t, tt.expectedStatus, w.Result().StatusCode)
+			if tt.expectedStatus == http.StatusOK {
+				require.NotNil(t, created)
+				assert.Equal(t, tt.expectedMessage, created.Message)
+				assert.Equal(t, "custom_voice_clip", created.Type)
+			} else {
+				api.AssertNotCalled(t, "UploadFile", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestHandleUpload_ThreadReply(t *testing.T) {
+	tests := []struct {
+		name           string
+		rootID         string
+		root           *model.Post
+		canRead        bool
+		expectedStatus int
+		expectedRootID string
+	}{
+		{"no root", "", nil, true, http.StatusOK, ""},
+		{"reply to root", "root123", &model.Post{Id: "root123", ChannelId: "channel123"}, true, http.StatusOK, "root123"},
+		{"reply to reply", "reply123", &model.Post{Id: "reply123", RootId: "root123", ChannelId: "channel123"}, true, http.StatusOK, "root123"},
+		{"root in other channel", "root123", &model.Post{Id: "root123", ChannelId: "channel456"}, true, http.StatusBadRequest, ""},
+		{"deleted root", "root123", &model.Post{Id: "root123", ChannelId: "channel123", DeleteAt: 1}, true, http.StatusBadRequest, ""},
+		{"unreadable root", "root123", &model.Post{Id: "root123", ChannelId: "channel123"}, false, http.StatusForbidden, ""},
+		{"unknown root", "missing123", nil, true, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &plugintest.API{}
+			plugin := &Plugin{}
+			plugin.SetAPI(api)
+			mockUploadAccess(api)
+			mockKVStore(api)
+
+			var created *model.Post
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionCreatePost).Return(true)
+			api.On("HasPermissionToChannel", "user123", "channel123", model.PermissionReadChannelContent).Return(tt.canRead)
+			if tt.root != nil {
+				api.On("GetPost", tt.rootID).Return(tt.root, nil)
+			} else if tt.rootID != "" {
+				api.On("GetPost", tt.rootID).Return(nil, model.NewAppError("GetPost", "app.post.get.app_error", nil, "", http.StatusNotFound))
+			}
+			api.On("UploadFile", mock.Anything, "channel123", mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file123"}, nil)
+			api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+				created = args.Get(0).(*model.Post)
+			}).Return(&model.Post{Id: "post123"}, nil)
+
+			req := newUploadRequest(t, map[string]string{"channel_id": "channel123", "duration": "5", "root_id": tt.rootID}, "audio", testWebM())
+			addSession(t, plugin, req, "channel123", "audio")
+			w := httptest.NewRecorder()
+			plugin.handleUpload(w, req)
+
+			require.Equal(t, tt.expectedStatus, w.Result().StatusCode)
+			if tt.expectedStatus == http.StatusOK {
+				require.NotNil(t, created)
+				assert.Equal(t, tt.expectedRootID, created.RootId)
+			} else {
+				api.AssertNotCalled(t, "CreatePost", mock.Anything)
+			}
+		})
+	}
+}
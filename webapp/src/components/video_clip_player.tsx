@@ -1,4 +1,6 @@
 import React, {useEffect, useState, useRef} from 'react';
+import {getPluginConfig} from '../utils/config_service';
+import {getClipFileUrl} from '../utils/clip_files';
 
 interface VideoClipPlayerProps {
     post: any;
@@ -11,13 +13,7 @@ const VideoClipPlayer: React.FC<VideoClipPlayerProps> = ({post}) => {
     const [isMuted, setIsMuted] = useState(true);
     const videoRef = useRef<HTMLVideoElement>(null);
 
-    const getFileUrl = () => {
-        if (post.file_ids && post.file_ids.length > 0) {
-            const fileId = post.file_ids[0];
-            return `/api/v4/files/${fileId}`;
-        }
-        return '';
-    };
+    const getFileUrl = () => getClipFileUrl(post);
 
     useEffect(() => {
         const video = videoRef.current;
@@ -136,6 +132,12 @@ const VideoClipPlayer: React.FC<VideoClipPlayerProps> = ({post}) => {
                     muted={isMuted}
                     playsInline
                     style={videoStyle}
+                    onContextMenu={(e) => {
+                        // Hide "Save video as" when downloads are not allowed
+                        if (!getPluginConfig().can_download) {
+                            e.preventDefault();
+                        }
+                    }}
                 />
 
                 {/* Play/Pause overlay */}
@@ -1,6 +1,7 @@
 import React, {useEffect, useState, useRef} from 'react';
 import {isIOS, isPauseResumeSupported, getVideoMimeType, getFileExtensionForMimeType} from '../utils/audio_recorder';
-import {fetchPluginConfig, getVideoBitrate, getMaxVideoDuration} from '../utils/config_service';
+import {fetchPluginConfig, fetchRecordingAvailability, getVideoBitrate, getMaxVideoDuration} from '../utils/config_service';
+import {createRecordingSession, getRecordingSessionHeaders} from '../utils/recording_session';
 import {t} from '../i18n/translations';
 
 interface VideoRecorderButtonProps {
@@ -23,6 +24,7 @@ const VideoRecorderButton: React.FC<VideoRecorderButtonProps> = ({channelId, onR
     const streamRef = useRef<MediaStream | null>(null);
     const chunksRef = useRef<Blob[]>([]);
     const timerRef = useRef<NodeJS.Timeout | null>(null);
+    const sessionTokenRef = useRef<string | null>(null);
 
     useEffect(() => {
         const handleOpenRecorder = async () => {
@@ -98,12 +100,21 @@ const VideoRecorderButton: React.FC<VideoRecorderButtonProps> = ({channelId, onR
     };
 
     const startRecording = async () => {
+        const availability = await fetchRecordingAvailability(channelId || getCurrentChannelId(), 'video');
+        if (!availability.available) {
+            setErrorMessage(availability.reason || t('failedToStartRecording'));
+            return;
+        }
+
         const permitted = await requestPermission();
         if (!permitted || !streamRef.current) {
             return;
         }
 
         try {
+            // Open a recording session before the recorder starts
+            sessionTokenRef.current = await createRecordingSession(channelId || getCurrentChannelId(), 'video');
+
             // Get platform-appropriate video codec
             const mimeType = getVideoMimeType();
 
@@ -223,6 +234,7 @@ const VideoRecorderButton: React.FC<VideoRecorderButtonProps> = ({channelId, onR
         try {
             const response = await fetch('/plugins/com.mattermost.voice-clips/api/v1/upload', {
                 method: 'POST',
+                headers: getRecordingSessionHeaders(sessionTokenRef.current),
                 body: formData,
                 credentials: 'same-origin',
             });
@@ -1,5 +1,6 @@
 import React, {useEffect, useState, useRef} from 'react';
 import WaveformVisualizer from './waveform_visualizer';
+import {getClipFileUrl} from '../utils/clip_files';
 
 interface VoiceClipPlayerProps {
     post: any;
@@ -13,14 +14,7 @@ const VoiceClipPlayer: React.FC<VoiceClipPlayerProps> = ({post}) => {
     const audioRef = useRef<HTMLAudioElement>(null);
     const progressBarRef = useRef<HTMLDivElement>(null);
 
-    // Get file URL from post
-    const getFileUrl = () => {
-        if (post.file_ids && post.file_ids.length > 0) {
-            const fileId = post.file_ids[0];
-            return `/api/v4/files/${fileId}`;
-        }
-        return '';
-    };
+    const getFileUrl = () => getClipFileUrl(post);
 
     useEffect(() => {
         const audio = audioRef.current;
@@ -1,6 +1,7 @@
 import React, {useEffect, useState, useRef} from 'react';
 import {getAudioRecorder, isPauseResumeSupported, getFileExtensionForMimeType} from '../utils/audio_recorder';
-import {fetchPluginConfig, getAudioBitrate, getMaxAudioDuration} from '../utils/config_service';
+import {fetchPluginConfig, fetchRecordingAvailability, getAudioBitrate, getMaxAudioDuration} from '../utils/config_service';
+import {createRecordingSession, getRecordingSessionHeaders} from '../utils/recording_session';
 import {t} from '../i18n/translations';
 
 interface VoiceRecorderButtonProps {
@@ -18,6 +19,7 @@ const VoiceRecorderButton: React.FC<VoiceRecorderButtonProps> = ({channelId, onR
     const [maxDuration, setMaxDuration] = useState(300);
 
     const recorderRef = useRef<any>(null);
+    const sessionTokenRef = useRef<string | null>(null);
     const timerRef = useRef<NodeJS.Timeout | null>(null);
 
     useEffect(() => {
@@ -61,12 +63,21 @@ const VoiceRecorderButton: React.FC<VoiceRecorderButtonProps> = ({channelId, onR
     };
 
     const startRecording = async () => {
+        const availability = await fetchRecordingAvailability(channelId || getCurrentChannelId(), 'audio');
+        if (!availability.available) {
+            setErrorMessage(availability.reason || t('failedToStartRecording'));
+            return;
+        }
+
         const permitted = await requestPermission();
         if (!permitted) {
             return;
         }
 
         try {
+            // Open a recording session before the recorder starts
+            sessionTokenRef.current = await createRecordingSession(channelId || getCurrentChannelId(), 'audio');
+
             // Get audio bitrate from config
             const audioBitrate = getAudioBitrate();
             const recorder = await getAudioRecorder(audioBitrate);
@@ -156,6 +167,7 @@ const VoiceRecorderButton: React.FC<VoiceRecorderButtonProps> = ({channelId, onR
         try {
             const response = await fetch('/plugins/com.mattermost.voice-clips/api/v1/upload', {
                 method: 'POST',
+                headers: getRecordingSessionHeaders(sessionTokenRef.current),
                 body: formData,
                 credentials: 'same-origin',
             });
@@ -6,6 +6,10 @@ import VideoRecorderButton from './components/video_recorder_button';
 import VideoClipPlayer from './components/video_clip_player';
 import {initI18n, t} from './i18n/translations';
 import {playVoiceMessageSound, playVideoMessageSound} from './utils/notification_sound';
+import {fetchPluginConfig} from './utils/config_service';
+
+// Post types with a player registered up front
+const BUILTIN_POST_TYPES = ['custom_voice_clip', 'custom_video_clip', 'custom_screen_clip'];
 
 // PluginRegistry is injected by Mattermost
 interface PluginRegistry {
@@ -71,7 +75,7 @@ class Plugin {
                     // Play appropriate notification sound
                     if (post.type === 'custom_voice_clip') {
                         playVoiceMessageSound();
-                    } else if (post.type === 'custom_video_clip') {
+                    } else if (post.type === 'custom_video_clip' || post.type === 'custom_screen_clip') {
                         playVideoMessageSound();
                     }
                 } catch (err) {
@@ -83,6 +87,16 @@ class Plugin {
         // Register custom post types
         registry.registerPostTypeComponent('custom_voice_clip', VoiceClipPlayer);
         registry.registerPostTypeComponent('custom_video_clip', VideoClipPlayer);
+        registry.registerPostTypeComponent('custom_screen_clip', VideoClipPlayer);
+
+        // Register players for media types added in the plugin settings
+        fetchPluginConfig().then((config) => {
+            for (const mediaType of config.media_types) {
+                if (!BUILTIN_POST_TYPES.includes(mediaType.post_type)) {
+                    registry.registerPostTypeComponent(mediaType.post_type, mediaType.player === 'video' ? VideoClipPlayer : VoiceClipPlayer);
+                }
+            }
+        });
 
         // Register recorders as root components (always available)
         if (registry.registerRootComponent) {
@@ -0,0 +1,30 @@
+/**
+ * Clip Files
+ * Resolves the URL a player loads a clip file from
+ */
+
+interface ClipFileProps {
+    file_id: string;
+    encrypted?: boolean;
+}
+
+/**
+ * Get the URL of the first file of a clip post.
+ * Files encrypted at rest are decrypted by the plugin; others are read through the file API.
+ */
+export function getClipFileUrl(post: any): string {
+    if (!post.file_ids || post.file_ids.length === 0) {
+        return '';
+    }
+    const fileId = post.file_ids[0];
+
+    const props = post.props || {};
+    const encrypted = Object.values(props).some((value: any) => {
+        const files: ClipFileProps[] | undefined = value && Array.isArray(value.files) ? value.files : undefined;
+        return files?.some((file) => file.file_id === fileId && file.encrypted);
+    });
+    if (encrypted) {
+        return `/plugins/com.mattermost.voice-clips/api/v1/media/${fileId}`;
+    }
+    return `/api/v4/files/${fileId}`;
+}
@@ -3,6 +3,27 @@
  * Fetches and caches plugin settings from the server
  */
 
+export interface MediaTypeConfig {
+    name: string;
+    label: string;
+    player: 'audio' | 'video';
+    post_type: string;
+    props_key: string;
+    max_duration: number;
+    max_file_size: number;
+    allowed_formats: string;
+
+    // Whether media policies let the current user post this type
+    allowed?: boolean;
+    unavailable_reason?: string;
+}
+
+export interface StorageUsage {
+    used: number;
+    quota: number;
+    by_type: Record<string, number>;
+}
+
 export interface PluginConfig {
     // Audio settings
     max_duration: number;
@@ -20,6 +41,23 @@ export interface PluginConfig {
     // Allowed formats
     allowed_audio_formats: string;
     allowed_video_formats: string;
+
+    // Every media type, including screen recordings and custom types
+    media_types: MediaTypeConfig[];
+
+    // Availability
+    recording_available: boolean;
+    unavailable_reason?: string;
+
+    // Playback, false for guests when restricted
+    can_view_transcripts: boolean;
+    can_download: boolean;
+
+    // Clip storage used, in bytes, when quotas are enforced
+    storage_usage?: {
+        user: StorageUsage;
+        team?: StorageUsage;
+    };
 }
 
 // Default configuration
@@ -35,6 +73,10 @@ const defaultConfig: PluginConfig = {
     video_bitrate: 1500,
     allowed_audio_formats: 'webm,ogg,mp4,m4a,mp3,aac,wav',
     allowed_video_formats: 'webm,mp4,mov',
+    media_types: [],
+    recording_available: true,
+    can_view_transcripts: true,
+    can_download: true,
 };
 
 // Cached configuration
@@ -128,3 +170,34 @@ export function getMaxAudioDuration(): number {
 export function getMaxVideoDuration(): number {
     return getPluginConfig().max_video_duration;
 }
+
+/**
+ * Check whether recording is possible in a channel, for a media type when given
+ * Returns the reason reported by the server when it is not
+ */
+export async function fetchRecordingAvailability(channelId: string, mediaType?: string): Promise<{available: boolean; reason?: string}> {
+    try {
+        const response = await fetch(`/plugins/com.mattermost.voice-clips/api/v1/config?channel_id=${encodeURIComponent(channelId)}`, {
+            method: 'GET',
+            credentials: 'same-origin',
+        });
+
+        if (!response.ok) {
+            return {available: true};
+        }
+
+        const config = await response.json();
+        if (config.recording_available === false) {
+            return {available: false, reason: config.unavailable_reason};
+        }
+
+        const typeConfig = (config.media_types || []).find((t: MediaTypeConfig) => t.name === mediaType);
+        if (typeConfig && typeConfig.allowed === false) {
+            return {available: false, reason: typeConfig.unavailable_reason};
+        }
+        return {available: true};
+    } catch (err) {
+        // Let the upload report the error instead
+        return {available: true};
+    }
+}
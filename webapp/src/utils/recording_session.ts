@@ -0,0 +1,37 @@
+/**
+ * Recording Session Service
+ * Opens a server-side recording session when recording starts
+ */
+
+// Header that carries the session token on uploads
+export const RECORDING_SESSION_HEADER = 'Voice-Clip-Session';
+
+/**
+ * Create a recording session for the channel.
+ * Returns the signed session token, or null if the server did not issue one.
+ */
+export async function createRecordingSession(channelId: string, type: 'audio' | 'video'): Promise<string | null> {
+    try {
+        const response = await fetch('/plugins/com.mattermost.voice-clips/api/v1/sessions', {
+            method: 'POST',
+            body: JSON.stringify({channel_id: channelId, type}),
+            credentials: 'same-origin',
+        });
+
+        if (!response.ok) {
+            return null;
+        }
+
+        const session = await response.json();
+        return session.token || null;
+    } catch (err) {
+        return null;
+    }
+}
+
+/**
+ * Build upload request headers for a session token
+ */
+export function getRecordingSessionHeaders(token: string | null): Record<string, string> {
+    return token ? {[RECORDING_SESSION_HEADER]: token} : {};
+}